@@ -2,10 +2,19 @@ package main
 
 import (
 	"log"
+	"os"
 	"shorter/internal/app"
 )
 
 func main() {
+	//Run the schema migrations subcommand
+	if isMigrateCommand() {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	//Initialize app
 	application, err := app.NewApp()
 	if err != nil {
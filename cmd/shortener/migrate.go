@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"shorter/internal/config"
+	"shorter/internal/storage"
+	"shorter/internal/urlkey"
+	"strconv"
+	"strings"
+)
+
+const migrateUsage = `Usage: shortener migrate [-d connection] status|up [N]|down [N]
+
+  status   list the migrations and when they were applied
+  up       apply N pending migrations, all of them by default
+  down     revert the last N applied migrations, 1 by default`
+
+// runMigrate - handles the "migrate" subcommand
+func runMigrate(args []string) error {
+	appConfig := config.NewConfig(config.LoadFromEnv)
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(flags.Output(), migrateUsage) }
+	flags.StringVar(&appConfig.DBConnection, "d", appConfig.DBConnection, "Database connection string")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(appConfig.DBConnection) == "" {
+		return errors.New("database connection string is required: set DATABASE_DSN or -d")
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("migrate command is missing")
+	}
+
+	command := flags.Arg(0)
+	steps := 0
+	if flags.NArg() > 1 {
+		n, err := strconv.Atoi(flags.Arg(1))
+		if err != nil || n < 1 {
+			return fmt.Errorf("the number of steps should be a positive number: %s", flags.Arg(1))
+		}
+		steps = n
+	}
+
+	// The migrations that move links to new keys use the configured generator
+	keys, err := urlkey.NewKeyGenerator(appConfig.KeyStrategy, appConfig.KeyLength, appConfig.KeyAlphabet)
+	if err != nil {
+		return fmt.Errorf("failed to initialize key generator: %w", err)
+	}
+	dbStorage, err := storage.NewDBStorage(appConfig.DBConnection, keys)
+	if err != nil {
+		return err
+	}
+	defer dbStorage.Close()
+
+	migrator, err := storage.NewMigrator(dbStorage.DB(), keys)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch command {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+	case "up":
+		applied, err := migrator.Up(ctx, steps)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("No pending migrations")
+		}
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("Reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown migrate command: %s", command)
+	}
+	return nil
+}
+
+// isMigrateCommand - checks if the binary was started as "shortener migrate ..."
+func isMigrateCommand() bool {
+	return len(os.Args) > 1 && os.Args[1] == "migrate"
+}
@@ -2,15 +2,22 @@ package app
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"shorter/internal/config"
 	"shorter/internal/handlers"
+	"shorter/internal/jobs"
+	"shorter/internal/middleware"
 	"shorter/internal/models"
 	"shorter/internal/router"
 	"shorter/internal/storage"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -18,13 +25,25 @@ type App struct {
 	Router     http.Handler
 	Config     *config.Config
 	Storage    storage.Storer
-	DeleteChan chan models.KeysToDelete
+	DeleteJobs *jobs.Tracker
+	ClickChan  chan models.Click
+
+	server      *http.Server
+	serveErr    chan error
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
 }
 
 func NewApp() (*App, error) {
 	// Load configuration
 	appConfig := config.NewConfig(config.LoadFromEnv, config.LoadFromFlags, config.LoadDefault)
 
+	// Load the keys that sign the auth cookies before anything is started
+	keys, err := loadJWTKeys(appConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize storage
 	appStorage, err := storage.NewStorage(*appConfig)
 
@@ -32,11 +51,21 @@ func NewApp() (*App, error) {
 		return nil, err
 	}
 
-	// Create a channel for batch deleting records
-	deleteChan := make(chan models.KeysToDelete, appConfig.DeleteBufferSize)
+	// Track the progress of the queued deletions
+	deleteJobs := jobs.NewTracker(appConfig.DeleteJobsTTL)
+
+	// Create a channel for recording clicks in the background
+	clickChan := make(chan models.Click, appConfig.ClickBufferSize)
+
+	// Issue the auth cookies with a sliding lifetime
+	tokens := middleware.NewTokens(keys, middleware.TokenPolicy{
+		TTL:           appConfig.TokenTTL,
+		PersistentTTL: appConfig.PersistentTTL,
+		RefreshAfter:  appConfig.TokenRefresh,
+	})
 
 	// Initialize handlers
-	h := handlers.NewHandlers(appStorage, deleteChan)
+	h := handlers.NewHandlers(appStorage, deleteJobs, clickChan, tokens)
 
 	// Initialize router
 	r := router.NewRouter(h)
@@ -45,65 +74,305 @@ func NewApp() (*App, error) {
 		Router:     r,
 		Config:     appConfig,
 		Storage:    appStorage,
-		DeleteChan: deleteChan,
+		DeleteJobs: deleteJobs,
+		ClickChan:  clickChan,
 	}, nil
 }
 
-// Run starts the HTTP server.
-func (a *App) Run() error {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+// loadJWTKeys - parses the configured keys, the well-known default secret is refused in production
+func loadJWTKeys(appConfig *config.Config) (*middleware.KeySet, error) {
+	spec, err := appConfig.LoadJWTKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := middleware.ParseKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+	if keys.Contains(config.DefaultJWTSecret) {
+		if appConfig.Environment == config.EnvProduction {
+			return nil, errors.New("the default JWT secret is not allowed in production, set JWT_KEYS or JWT_KEYS_FILE")
+		}
+		log.Println("Warning: the auth cookies are signed with the default JWT secret")
+	}
+	return keys, nil
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// Run starts the app and shuts it down gracefully on SIGINT or SIGTERM.
+// An error of the listener, e.g. "address in use", is returned.
+func (a *App) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	log.Println("Local Host: " + a.Config.LocalHost)
 	log.Println("Result Host: " + a.Config.ResultHost)
 	log.Println("File Storage Path: " + a.Config.StoragePath)
 	log.Println("Db Connection String: " + a.Config.DBConnection)
 
+	if err := a.Start(); err != nil {
+		a.Storage.Close()
+		return err
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		log.Println("Shutdown signal received")
+	case serveErr = <-a.serveErr:
+		log.Printf("HTTP server stopped: %v\n", serveErr)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.Config.ShutdownTimeout)
+	defer cancel()
+	return errors.Join(serveErr, a.Shutdown(shutdownCtx))
+}
+
+// Start binds the listener, then serves HTTP and runs the background workers until Shutdown.
+func (a *App) Start() error {
+	listener, err := net.Listen("tcp", config.GetPort("Local"))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	workersCtx, cancel := context.WithCancel(context.Background())
+	a.stopWorkers = cancel
+
 	// Start background deletion worker
-	go a.StartDeletionWorker(ctx)
+	a.runWorker(func() { a.StartDeletionWorker(workersCtx) })
+
+	// Start background worker that marks expired links
+	a.runWorker(func() { a.StartExpirationWorker(workersCtx) })
+
+	// Start background worker that removes the links deleted long ago
+	a.runWorker(func() { a.StartPurgeWorker(workersCtx) })
+
+	// Start background worker that records clicks
+	a.runWorker(func() { a.StartClickWorker(workersCtx) })
 
+	a.server = &http.Server{Handler: a.Router}
+	a.serveErr = make(chan error, 1)
 	go func() {
-		_ = http.ListenAndServe(config.GetPort("Local"), a.Router)
+		if err := a.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			a.serveErr <- err
+		}
 	}()
-
-	<-sigChan
-	log.Println("Shutdown signal received")
-	a.Storage.Close()
 	return nil
 }
 
-// StartDeletionWorker processes delete tasks from the queue.
+// Shutdown stops accepting requests and waits for the active ones until ctx is done,
+// then stops the workers, applies the pending deletions and closes the storage.
+func (a *App) Shutdown(ctx context.Context) error {
+	var errs []error
+	if err := a.server.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to drain HTTP requests: %w", err))
+	}
+
+	a.stopWorkers()
+	a.workers.Wait()
+
+	// Nothing adds deletions anymore, so the due ones are applied before the storage goes away
+	for ctx.Err() == nil {
+		if a.processDeletions(ctx) == 0 {
+			break
+		}
+	}
+
+	if err := a.Storage.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close storage: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// runWorker - runs the worker in the background, Shutdown waits for it to return
+func (a *App) runWorker(worker func()) {
+	a.workers.Add(1)
+	go func() {
+		defer a.workers.Done()
+		worker()
+	}()
+}
+
+// StartDeletionWorker periodically processes the deletion requests persisted in the storage.
+// The requests left from the previous run are picked up on the first tick.
 func (a *App) StartDeletionWorker(ctx context.Context) {
 
 	ticker := time.NewTicker(10 * time.Second)
-	var keysToDelete []models.KeysToDelete
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("Deletion worker shutting down...")
 			return
-		case k := <-a.DeleteChan:
-			//Add a key to the slice for deleting later
-			keysToDelete = append(keysToDelete, k)
 		case <-ticker.C:
-			//Wait for at least one message
-			if len(keysToDelete) == 0 {
+			a.processDeletions(ctx)
+		}
+	}
+}
+
+// processDeletions - deletes the keys of all due requests at once and returns the number of processed requests.
+// If the storage fails, every request is retried with backoff, and after the last attempt it is dead-lettered.
+func (a *App) processDeletions(ctx context.Context) int {
+	const batchSize = 100
+
+	pending, err := a.Storage.PendingDeletions(ctx, time.Now(), batchSize)
+	if err != nil {
+		log.Printf("Failed to load pending deletions: %v\n", err)
+		return 0
+	}
+	//Wait for at least one request
+	if len(pending) == 0 {
+		return 0
+	}
+
+	items := make([]models.KeysToDelete, 0, len(pending))
+	ids := make([]int64, 0, len(pending))
+	for _, entry := range pending {
+		a.DeleteJobs.Start(entry.Item.JobID)
+		items = append(items, entry.Item)
+		ids = append(ids, entry.ID)
+	}
+
+	//update all requests at once
+	results, err := a.Storage.DeleteBatch(ctx, items)
+	if err != nil {
+		// An interrupted batch is not a failed attempt, it stays in the queue for Shutdown or the next start
+		if ctx.Err() != nil {
+			return 0
+		}
+		log.Printf("Failed to delete records: %v\n", err)
+		for _, entry := range pending {
+			a.failDeletion(ctx, entry, err)
+		}
+		return 0
+	}
+
+	// The results follow the order of the keys, so every job gets its own part
+	for _, item := range items {
+		n := min(len(item.Keys), len(results))
+		a.DeleteJobs.Finish(item.JobID, results[:n])
+		results = results[n:]
+	}
+
+	//Remove the processed requests from the queue
+	if err := a.Storage.CompleteDeletions(ctx, ids); err != nil {
+		log.Printf("Failed to complete deletions: %v\n", err)
+		return 0
+	}
+	return len(pending)
+}
+
+// failDeletion - postpones the request or moves it to the dead letters once the attempts are exhausted
+func (a *App) failDeletion(ctx context.Context, entry models.PendingDeletion, cause error) {
+	attempt := entry.Attempts + 1
+	if attempt >= a.Config.DeleteAttempts {
+		log.Printf("Deletion %d failed %d times, moving it to the dead letters\n", entry.ID, attempt)
+		a.DeleteJobs.Fail(entry.Item.JobID, cause)
+		if err := a.Storage.DeadLetterDeletion(ctx, entry.ID, cause.Error()); err != nil {
+			log.Printf("Failed to dead-letter deletion %d: %v\n", entry.ID, err)
+		}
+		return
+	}
+
+	a.DeleteJobs.Retry(entry.Item.JobID, cause)
+	next := time.Now().Add(deleteBackoff(attempt, a.Config.DeleteBackoff, a.Config.DeleteMaxBackoff))
+	if err := a.Storage.RetryDeletion(ctx, entry.ID, cause.Error(), next); err != nil {
+		log.Printf("Failed to postpone deletion %d: %v\n", entry.ID, err)
+	}
+}
+
+// deleteBackoff - doubles the delay after every failed attempt, up to the limit
+func deleteBackoff(attempt int, base, limit time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+// StartExpirationWorker periodically marks the links whose expiry time has passed.
+func (a *App) StartExpirationWorker(ctx context.Context) {
+
+	ticker := time.NewTicker(a.Config.ExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Expiration worker shutting down...")
+			return
+		case <-ticker.C:
+			expired, err := a.Storage.ExpireLinks(ctx)
+			if err != nil {
+				log.Printf("Failed to expire links: %v\n", err)
 				continue
 			}
-			//update all incoming requests at once
-			_, err := a.Storage.DeleteBatch(ctx, keysToDelete)
+			if expired > 0 {
+				log.Printf("Marked %d links as expired\n", expired)
+			}
+		}
+	}
+}
+
+// StartPurgeWorker periodically removes the links that stayed deleted longer than the retention period.
+func (a *App) StartPurgeWorker(ctx context.Context) {
+
+	ticker := time.NewTicker(a.Config.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Purge worker shutting down...")
+			return
+		case <-ticker.C:
+			purged, err := a.Storage.PurgeDeleted(ctx, time.Now().Add(-a.Config.DeletedRetention))
 			if err != nil {
-				log.Printf("Failed to delete records: %v\n", err)
+				log.Printf("Failed to purge deleted links: %v\n", err)
 				continue
 			}
+			if purged > 0 {
+				log.Printf("Purged %d deleted links\n", purged)
+			}
+		}
+	}
+}
+
+// StartClickWorker writes the queued clicks to the storage in batches.
+// The clicks that are still queued when ctx is done are written before it returns.
+func (a *App) StartClickWorker(ctx context.Context) {
+	const batchSize = 100
 
-			//Remove all keys that have been sent
-			keysToDelete = nil
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var clicks []models.Click
+
+	flush := func(ctx context.Context) {
+		if len(clicks) == 0 {
+			return
+		}
+		if err := a.Storage.RecordClicks(ctx, clicks); err != nil {
+			log.Printf("Failed to record clicks: %v\n", err)
+		}
+		clicks = nil
+	}
 
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Click worker shutting down...")
+			for len(a.ClickChan) > 0 {
+				clicks = append(clicks, <-a.ClickChan)
+			}
+			flush(context.WithoutCancel(ctx))
+			return
+		case c := <-a.ClickChan:
+			clicks = append(clicks, c)
+			if len(clicks) >= batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
 		}
 	}
 }
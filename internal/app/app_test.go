@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"shorter/internal/config"
+	"shorter/internal/jobs"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"shorter/internal/urlkey"
+	"testing"
+	"time"
+)
+
+func newTestApp(t *testing.T, address string) *App {
+	previous := config.AppConfig.LocalHost
+	config.AppConfig.LocalHost = "http://" + address
+	t.Cleanup(func() { config.AppConfig.LocalHost = previous })
+
+	return &App{
+		Router:     http.NewServeMux(),
+		Config:     &config.AppConfig,
+		Storage:    storage.NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet)),
+		DeleteJobs: jobs.NewTracker(time.Hour),
+		ClickChan:  make(chan models.Click, 10),
+	}
+}
+
+func TestApp_ShutdownAppliesPendingDeletions(t *testing.T) {
+	ctx := context.Background()
+	a := newTestApp(t, "localhost:0")
+
+	key, err := a.Storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user"})
+	require.NoError(t, err)
+	job, err := a.DeleteJobs.Create("user", 1)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Start())
+	require.NoError(t, a.Storage.EnqueueDeletion(ctx, models.KeysToDelete{Keys: []string{key}, UserID: "user", JobID: job.ID}))
+	require.NoError(t, a.Shutdown(ctx))
+
+	// The worker did not tick yet, so the deletion should be applied by Shutdown
+	job, _ = a.DeleteJobs.Get(job.ID)
+	assert.Equal(t, jobs.StatusDone, job.Status)
+	assert.Equal(t, 1, job.Deleted)
+
+	_, err = a.Storage.Get(ctx, key)
+	assert.True(t, storage.IsErrorType(err, "deleted"))
+}
+
+func TestApp_StartAddressInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	a := newTestApp(t, listener.Addr().String())
+	assert.Error(t, a.Start())
+}
+
+func TestLoadJWTKeys(t *testing.T) {
+	cfg := config.Config{JWTKeys: config.DefaultJWTKeys, Environment: "development"}
+	_, err := loadJWTKeys(&cfg)
+	assert.NoError(t, err)
+
+	cfg.Environment = config.EnvProduction
+	_, err = loadJWTKeys(&cfg)
+	assert.Error(t, err, "The default secret should be refused in production")
+
+	cfg.JWTKeys = "new:another-secret,old:" + config.DefaultJWTSecret
+	_, err = loadJWTKeys(&cfg)
+	assert.Error(t, err, "The default secret should be refused even as an old key")
+
+	keysFile := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(keysFile, []byte("new:another-secret\n"), 0600))
+	cfg = config.Config{JWTKeysFile: keysFile, Environment: config.EnvProduction}
+	_, err = loadJWTKeys(&cfg)
+	assert.NoError(t, err)
+}
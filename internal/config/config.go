@@ -1,10 +1,15 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/caarlos0/env/v6"
 	"net/url"
+	"os"
+	"shorter/internal/urlkey"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -13,16 +18,61 @@ type Config struct {
 	StoragePath      string `env:"FILE_STORAGE_PATH"`
 	DBConnection     string `env:"DATABASE_DSN"`
 	LoadedFrom       map[string]string
-	DeleteBufferSize int `env:"DELETE_BUFFER_SIZE"`
+	KeyStrategy      string        `env:"KEY_STRATEGY"`
+	KeyLength        int           `env:"KEY_LENGTH"`
+	KeyAlphabet      string        `env:"KEY_ALPHABET"`
+	ExpireInterval   time.Duration `env:"EXPIRE_INTERVAL"`
+	ClickBufferSize  int           `env:"CLICK_BUFFER_SIZE"`
+	FileSync         string        `env:"FILE_SYNC"`
+	FileSyncInterval time.Duration `env:"FILE_SYNC_INTERVAL"`
+	StripTracking    bool          `env:"STRIP_TRACKING_PARAMS"`
+	DeletedRetention time.Duration `env:"DELETED_RETENTION"`
+	PurgeInterval    time.Duration `env:"PURGE_INTERVAL"`
+	DeleteJobsTTL    time.Duration `env:"DELETE_JOBS_TTL"`
+	DeleteAttempts   int           `env:"DELETE_MAX_ATTEMPTS"`
+	DeleteBackoff    time.Duration `env:"DELETE_RETRY_BACKOFF"`
+	DeleteMaxBackoff time.Duration `env:"DELETE_RETRY_MAX_BACKOFF"`
+	ShutdownTimeout  time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	Environment      string        `env:"APP_ENV"`
+	JWTKeys          string        `env:"JWT_KEYS"`
+	JWTKeysFile      string        `env:"JWT_KEYS_FILE"`
+	TokenTTL         time.Duration `env:"TOKEN_TTL"`
+	PersistentTTL    time.Duration `env:"PERSISTENT_TOKEN_TTL"`
+	TokenRefresh     time.Duration `env:"TOKEN_REFRESH_AFTER"`
 }
 
+const (
+	EnvProduction = "production"
+
+	// DefaultJWTSecret - the well-known secret used when no keys are configured, it is refused in production
+	DefaultJWTSecret = "supersecretkey"
+	DefaultJWTKeys   = "default:" + DefaultJWTSecret
+)
+
 var AppConfig = Config{
 	LocalHost:        "",
 	ResultHost:       "",
 	StoragePath:      "",
 	DBConnection:     "",
 	LoadedFrom:       make(map[string]string),
-	DeleteBufferSize: 1024,
+	KeyStrategy:      urlkey.StrategyHash,
+	KeyLength:        urlkey.DefaultLength,
+	KeyAlphabet:      urlkey.Base62Alphabet,
+	ExpireInterval:   time.Minute,
+	ClickBufferSize:  1024,
+	FileSync:         "interval",
+	FileSyncInterval: time.Second,
+	DeletedRetention: 30 * 24 * time.Hour,
+	PurgeInterval:    time.Hour,
+	DeleteJobsTTL:    24 * time.Hour,
+	DeleteAttempts:   5,
+	DeleteBackoff:    5 * time.Second,
+	DeleteMaxBackoff: 10 * time.Minute,
+	ShutdownTimeout:  10 * time.Second,
+	Environment:      "development",
+	TokenTTL:         30 * 24 * time.Hour,
+	PersistentTTL:    365 * 24 * time.Hour,
+	TokenRefresh:     time.Hour,
 }
 
 // NewConfig - loads configs in the required order
@@ -44,6 +94,8 @@ func LoadFromEnv() {
 	AppConfig.ResultHost = addPrefix(AppConfig.ResultHost)
 	AppConfig.StoragePath = strings.TrimSpace(AppConfig.StoragePath)
 	AppConfig.DBConnection = strings.TrimSpace(AppConfig.DBConnection)
+	AppConfig.JWTKeys = strings.TrimSpace(AppConfig.JWTKeys)
+	AppConfig.JWTKeysFile = strings.TrimSpace(AppConfig.JWTKeysFile)
 }
 
 // LoadFromFlags - loads from command-line flags
@@ -76,6 +128,17 @@ func LoadFromFlags() {
 			return nil
 		})
 	}
+
+	if AppConfig.JWTKeys == "" && AppConfig.JWTKeysFile == "" {
+		flag.Func("k", "JWT keys as kid:secret pairs separated by commas or new lines, the first one signs", func(value string) error {
+			AppConfig.JWTKeys = strings.TrimSpace(value)
+			return nil
+		})
+		flag.Func("k-file", "The file with the JWT keys, one kid:secret pair per line", func(value string) error {
+			AppConfig.JWTKeysFile = strings.TrimSpace(value)
+			return nil
+		})
+	}
 	flag.Parse()
 }
 
@@ -89,6 +152,24 @@ func LoadDefault() {
 	if AppConfig.StoragePath == "" {
 		AppConfig.StoragePath = "./tmp/data.txt"
 	}
+	if AppConfig.JWTKeys == "" && AppConfig.JWTKeysFile == "" {
+		AppConfig.JWTKeys = DefaultJWTKeys
+	}
+}
+
+// LoadJWTKeys - returns the JWT keys, reading them from the keys file if it is set
+func (c *Config) LoadJWTKeys() (string, error) {
+	if c.JWTKeysFile == "" {
+		return c.JWTKeys, nil
+	}
+	if c.JWTKeys != "" {
+		return "", errors.New("the JWT keys and the JWT keys file should not be set together")
+	}
+	data, err := os.ReadFile(c.JWTKeysFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the JWT keys file: %w", err)
+	}
+	return string(data), nil
 }
 
 func GetPort(typeOf string) string {
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"shorter/internal/middleware"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"strings"
+)
+
+// maxAPIKeyName - the longest name a user can give to an API key
+const maxAPIKeyName = 255
+
+// CreateAPIKey - issues a new API key to the user, the secret is shown only in this response
+func (h *Handlers) CreateAPIKey(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if len(body.Name) > maxAPIKeyName {
+		http.Error(res, "The name of the key is too long", http.StatusBadRequest)
+		return
+	}
+
+	key, secret, err := middleware.NewAPIKey(userID, body.Name)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.Storage.CreateAPIKey(ctx, key); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jRes := toAPIKeyRes(key)
+	jRes.Key = secret
+	out, err := json.Marshal(jRes)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusCreated)
+	res.Write(out)
+}
+
+// GetAPIKeys - lists the user's API keys without their secrets
+func (h *Handlers) GetAPIKeys(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := h.Storage.GetUserAPIKeys(ctx, userID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jResBatch := make([]models.JSONAPIKeyRes, 0, len(keys))
+	for _, key := range keys {
+		jResBatch = append(jResBatch, toAPIKeyRes(key))
+	}
+	out, err := json.Marshal(jResBatch)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
+}
+
+// RevokeAPIKey - disables the user's API key, the requests with it are rejected afterwards
+func (h *Handlers) RevokeAPIKey(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = h.Storage.RevokeAPIKey(ctx, userID, chi.URLParam(req, "keyID"))
+	if storage.IsErrorType(err, "not found") {
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func toAPIKeyRes(key models.APIKey) models.JSONAPIKeyRes {
+	return models.JSONAPIKeyRes{
+		ID:        key.ID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		CreatedAt: key.CreatedAt,
+		RevokedAt: key.RevokedAt,
+	}
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"shorter/internal/middleware"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, nil)
+
+	r := chi.NewRouter()
+	r.Post("/api/user/keys", h.CreateAPIKey)
+	r.Get("/api/user/keys", h.GetAPIKeys)
+	r.Delete("/api/user/keys/{keyID}", h.RevokeAPIKey)
+
+	w := serve(t, r, "POST", "/api/user/keys", "user", `{"name":"deploy"}`)
+	require.Equal(t, 201, w.Code)
+
+	var created models.JSONAPIKeyRes
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "deploy", created.Name)
+	assert.True(t, strings.HasPrefix(created.Key, middleware.APIKeyPrefix))
+	assert.True(t, strings.HasPrefix(created.Key, created.Prefix))
+
+	// The secret is stored only as a hash
+	stored, err := memStorage.GetAPIKey(context.Background(), middleware.HashAPIKey(created.Key))
+	require.NoError(t, err)
+	assert.Equal(t, "user", stored.UserID)
+	assert.NotContains(t, stored.Hash, created.Key)
+
+	w = serve(t, r, "GET", "/api/user/keys", "user", "")
+	require.Equal(t, 200, w.Code)
+	var listed []models.JSONAPIKeyRes
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, created.ID, listed[0].ID)
+	assert.Empty(t, listed[0].Key, "The secret should not be listed")
+
+	assert.Equal(t, 404, serve(t, r, "DELETE", "/api/user/keys/"+created.ID, "intruder", "").Code)
+	assert.Equal(t, 204, serve(t, r, "DELETE", "/api/user/keys/"+created.ID, "user", "").Code)
+	assert.Equal(t, 400, serve(t, r, "POST", "/api/user/keys", "user", `not json`).Code)
+
+	_, err = memStorage.GetAPIKey(context.Background(), middleware.HashAPIKey(created.Key))
+	assert.True(t, storage.IsErrorType(err, "not found"))
+}
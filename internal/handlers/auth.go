@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"strings"
+	"time"
+)
+
+const (
+	minLoginLength    = 3
+	maxLoginLength    = 64
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores the bytes beyond
+)
+
+// dummyPasswordHash - compared when the login is unknown, so the response time does not reveal the registered logins
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+// Register - creates an account and logs the user in. The account takes over the current
+// anonymous identity, so the links created before the registration stay with the user.
+func (h *Handlers) Register(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	creds, ok := decodeCredentials(res, req)
+	if !ok {
+		return
+	}
+
+	// An identity that already has an account can not be taken over by another one
+	userID, _ := getUserIDFromContext(req)
+	if userID != "" {
+		_, err := h.Storage.GetUser(ctx, userID)
+		if err == nil {
+			userID = ""
+		} else if !storage.IsErrorType(err, "not found") {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if userID == "" {
+		if userID, ok = newUserID(res); !ok {
+			return
+		}
+	}
+
+	if h.createAccount(res, req, userID, creds) {
+		h.startSession(res, userID, http.StatusCreated)
+	}
+}
+
+// Login - checks the password and issues the auth cookie for the UserID of the account
+func (h *Handlers) Login(res http.ResponseWriter, req *http.Request) {
+	creds, ok := decodeCredentials(res, req)
+	if !ok {
+		return
+	}
+
+	user, err := h.Storage.GetUserByLogin(req.Context(), creds.Login)
+	if err != nil && !storage.IsErrorType(err, "not found") {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hash := []byte(user.PasswordHash)
+	if err != nil {
+		hash = dummyPasswordHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(creds.Password)) != nil || err != nil {
+		http.Error(res, "Invalid login or password", http.StatusUnauthorized)
+		return
+	}
+
+	h.startSession(res, user.ID, http.StatusOK)
+}
+
+// Logout - drops the auth cookie, the account can be logged in again from any browser
+func (h *Handlers) Logout(res http.ResponseWriter, req *http.Request) {
+	h.Tokens.ClearCookie(res)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// ClaimUser - upgrades the current anonymous identity to an account with the login and password.
+// The UserID stays the same, so the user keeps the links and can log in with them from any browser.
+func (h *Handlers) ClaimUser(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	userID, err := getUserIDFromContext(req)
+	if err != nil || userID == "" {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	creds, ok := decodeCredentials(res, req)
+	if !ok {
+		return
+	}
+
+	_, err = h.Storage.GetUser(ctx, userID)
+	if err == nil {
+		http.Error(res, "The identity is already claimed", http.StatusConflict)
+		return
+	}
+	if !storage.IsErrorType(err, "not found") {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if h.createAccount(res, req, userID, creds) {
+		h.startSession(res, userID, http.StatusCreated)
+	}
+}
+
+// createAccount - stores the account of the identity, responding with an error if it fails
+func (h *Handlers) createAccount(res http.ResponseWriter, req *http.Request, userID string, creds models.JSONAuthReq) bool {
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	user := models.User{ID: userID, Login: creds.Login, PasswordHash: string(hash), CreatedAt: time.Now().UTC()}
+	err = h.Storage.CreateUser(req.Context(), user)
+	if storage.IsErrorType(err, "already exists") {
+		http.Error(res, "The login is already taken", http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// startSession - sets the persistent cookie for the user and responds with the session
+func (h *Handlers) startSession(res http.ResponseWriter, userID string, status int) {
+	expiresAt, err := h.Tokens.SetCookie(res, userID, true)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(models.Session{UserID: userID, Persistent: true, ExpiresAt: expiresAt})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(out)
+}
+
+// decodeCredentials - reads and validates the login and password, responding with 400 if they are not valid
+func decodeCredentials(res http.ResponseWriter, req *http.Request) (models.JSONAuthReq, bool) {
+	var creds models.JSONAuthReq
+	if err := json.NewDecoder(req.Body).Decode(&creds); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return creds, false
+	}
+
+	creds.Login = strings.ToLower(strings.TrimSpace(creds.Login))
+	if err := validateCredentials(creds); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return creds, false
+	}
+	return creds, true
+}
+
+func validateCredentials(creds models.JSONAuthReq) error {
+	if len(creds.Login) < minLoginLength || len(creds.Login) > maxLoginLength {
+		return errors.New("the login should be from 3 to 64 characters long")
+	}
+	if len(creds.Password) < minPasswordLength || len(creds.Password) > maxPasswordLength {
+		return errors.New("the password should be from 8 to 72 bytes long")
+	}
+	return nil
+}
+
+// newUserID - generates an identity for an account, responding with 500 if it fails
+func newUserID(res http.ResponseWriter) (string, bool) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	return hex.EncodeToString(b), true
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"shorter/internal/middleware"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"testing"
+	"time"
+)
+
+func newTestTokens(t *testing.T) *middleware.Tokens {
+	keys, err := middleware.ParseKeys("test:secret")
+	require.NoError(t, err)
+	return middleware.NewTokens(keys, middleware.TokenPolicy{TTL: time.Hour, PersistentTTL: 24 * time.Hour, RefreshAfter: time.Minute})
+}
+
+func TestClaimUser(t *testing.T) {
+	tokens := newTestTokens(t)
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, tokens)
+	claim := http.HandlerFunc(h.ClaimUser)
+
+	assert.Equal(t, 400, serve(t, claim, "POST", "/api/user/claim", "user", `{"login":"alice","password":"short"}`).Code)
+
+	w := serve(t, claim, "POST", "/api/user/claim", "user", `{"login":"alice","password":"correct horse"}`)
+	require.Equal(t, 201, w.Code)
+
+	var session models.Session
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, "user", session.UserID)
+	assert.True(t, session.Persistent)
+
+	// The account is bound to the claimed identity
+	user, err := memStorage.GetUserByLogin(context.Background(), "alice")
+	require.NoError(t, err)
+	assert.Equal(t, "user", user.ID)
+
+	// The new cookie keeps the identity and outlives an anonymous one
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	claims, err := tokens.Parse(cookies[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "user", claims.UserID)
+	assert.True(t, claims.Persistent)
+	assert.True(t, claims.ExpiresAt.After(time.Now().Add(time.Hour)))
+
+	// Neither the identity nor the login can be claimed twice
+	assert.Equal(t, 409, serve(t, claim, "POST", "/api/user/claim", "user", `{"login":"bob","password":"correct horse"}`).Code)
+	assert.Equal(t, 409, serve(t, claim, "POST", "/api/user/claim", "other", `{"login":"alice","password":"correct horse"}`).Code)
+	assert.Equal(t, 401, serve(t, claim, "POST", "/api/user/claim", "", `{"login":"carol","password":"correct horse"}`).Code)
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	tokens := newTestTokens(t)
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, tokens)
+
+	sessionOf := func(w *httptest.ResponseRecorder) models.Session {
+		var session models.Session
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+		return session
+	}
+
+	// The account takes over the anonymous identity
+	w := serve(t, http.HandlerFunc(h.Register), "POST", "/", "anonymous", `{"login":" Alice ","password":"correct horse"}`)
+	require.Equal(t, 201, w.Code)
+	assert.Equal(t, "anonymous", sessionOf(w).UserID)
+	require.Len(t, w.Result().Cookies(), 1)
+
+	assert.Equal(t, 409, serve(t, http.HandlerFunc(h.Register), "POST", "/", "other", `{"login":"alice","password":"another one"}`).Code)
+	assert.Equal(t, 400, serve(t, http.HandlerFunc(h.Register), "POST", "/", "other", `{"login":"bob","password":"short"}`).Code)
+
+	// An identity with an account gets a new one for the second account
+	w = serve(t, http.HandlerFunc(h.Register), "POST", "/", "anonymous", `{"login":"bob","password":"correct horse"}`)
+	require.Equal(t, 201, w.Code)
+	assert.NotEqual(t, "anonymous", sessionOf(w).UserID)
+
+	// Another browser gets the same identity after the login
+	w = serve(t, http.HandlerFunc(h.Login), "POST", "/", "fresh", `{"login":"ALICE","password":"correct horse"}`)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "anonymous", sessionOf(w).UserID)
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	claims, err := tokens.Parse(cookies[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", claims.UserID)
+
+	assert.Equal(t, 401, serve(t, http.HandlerFunc(h.Login), "POST", "/", "fresh", `{"login":"alice","password":"wrong password"}`).Code)
+	assert.Equal(t, 401, serve(t, http.HandlerFunc(h.Login), "POST", "/", "fresh", `{"login":"nobody","password":"correct horse"}`).Code)
+
+	w = serve(t, http.HandlerFunc(h.Logout), "POST", "/", "anonymous", "")
+	assert.Equal(t, 204, w.Code)
+	require.Len(t, w.Result().Cookies(), 1)
+	assert.True(t, w.Result().Cookies()[0].MaxAge < 0)
+}
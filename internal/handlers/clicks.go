@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"shorter/internal/models"
+	"strings"
+	"time"
+)
+
+// trackClick - queues the click of the redirect, the click is dropped if the queue is full
+func (h *Handlers) trackClick(req *http.Request, urlKey string) {
+	click := models.Click{
+		ShortURL:  urlKey,
+		Time:      time.Now().UTC(),
+		Referrer:  req.Referer(),
+		UserAgent: req.UserAgent(),
+		IP:        anonymizeIP(clientIP(req)),
+	}
+
+	select {
+	case h.ClickQueue <- click:
+	default:
+		log.Printf("Click queue is full, the click on %s is dropped\n", urlKey)
+	}
+}
+
+// clientIP - returns the address of the client, taking proxies into account
+func clientIP(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+		return strings.TrimSpace(realIP)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// anonymizeIP - zeroes the host part of the address: the last octet of IPv4 and the last 80 bits of IPv6
+func anonymizeIP(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
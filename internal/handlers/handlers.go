@@ -7,23 +7,30 @@ import (
 	"io"
 	"net/http"
 	"shorter/internal/config"
+	"shorter/internal/jobs"
 	"shorter/internal/middleware"
 	"shorter/internal/models"
 	"shorter/internal/storage"
 	"shorter/internal/urlkey"
+	"strconv"
+	"time"
 )
 
 // Handlers struct holds dependencies (storage)
 type Handlers struct {
-	Storage     storage.Storer
-	DeleteQueue chan models.KeysToDelete
+	Storage    storage.Storer
+	DeleteJobs *jobs.Tracker
+	ClickQueue chan models.Click
+	Tokens     *middleware.Tokens
 }
 
 // NewHandlers initializes handlers with storage
-func NewHandlers(s storage.Storer, dq chan models.KeysToDelete) *Handlers {
+func NewHandlers(s storage.Storer, dj *jobs.Tracker, cq chan models.Click, tk *middleware.Tokens) *Handlers {
 	return &Handlers{
-		Storage:     s,
-		DeleteQueue: dq,
+		Storage:    s,
+		DeleteJobs: dj,
+		ClickQueue: cq,
+		Tokens:     tk,
 	}
 }
 
@@ -35,6 +42,30 @@ func getUserIDFromContext(req *http.Request) (string, error) {
 	return userID, nil
 }
 
+// normalizeURL - the canonical form of the URL, the storage finds the duplicates by it
+func normalizeURL(originalURL string) (string, error) {
+	return urlkey.Normalize(originalURL, config.AppConfig.StripTracking)
+}
+
+// resolveExpiry - converts the ttl of the request into the absolute expiry time
+func resolveExpiry(jReq *models.JSONReq) error {
+	if jReq.TTL < 0 {
+		return errors.New("ttl should be a positive number of seconds")
+	}
+	if jReq.TTL > 0 && jReq.ExpiresAt != nil {
+		return errors.New("only one of ttl and expires_at can be set")
+	}
+	if jReq.TTL > 0 {
+		expiresAt := time.Now().Add(time.Duration(jReq.TTL) * time.Second)
+		jReq.ExpiresAt = &expiresAt
+		jReq.TTL = 0
+	}
+	if jReq.ExpiresAt != nil && !jReq.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at should be in the future")
+	}
+	return nil
+}
+
 func (h *Handlers) PostURL(res http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 
@@ -46,15 +77,20 @@ func (h *Handlers) PostURL(res http.ResponseWriter, req *http.Request) {
 	}
 
 	originalURL, valid := urlkey.IsValidURL(string(body))
+	normalizedURL, err := normalizeURL(originalURL)
 
-	if !valid {
+	if !valid || err != nil {
 		res.WriteHeader(http.StatusBadRequest)
 		res.Write([]byte("The body should contain a valid URL"))
 		return
 	}
 
-	userID, _ := getUserIDFromContext(req)
-	urlKey, err := h.Storage.Set(ctx, originalURL, userID)
+	ownerID, ok := h.actingOwner(res, req, storage.RoleEditor)
+	if !ok {
+		return
+	}
+	link := models.Link{OriginalURL: originalURL, NormalizedURL: normalizedURL, UserID: ownerID}
+	urlKey, err := h.Storage.Set(ctx, link)
 
 	HeaderStatus := http.StatusCreated
 
@@ -81,20 +117,51 @@ func (h *Handlers) ShortenURL(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if _, valid := urlkey.IsValidURL(jReq.URL); !valid {
+	normalizedURL, err := normalizeURL(jReq.URL)
+	if _, valid := urlkey.IsValidURL(jReq.URL); !valid || err != nil {
 		res.WriteHeader(http.StatusBadRequest)
 		res.Write([]byte("The incoming JSON string should contain a valid URL"))
 		return
 	}
-	userID, _ := getUserIDFromContext(req)
 
-	urlKey, err := h.Storage.Set(ctx, jReq.URL, userID)
+	if jReq.Alias != "" {
+		if err := urlkey.ValidateAlias(jReq.Alias); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := resolveExpiry(&jReq); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if jReq.Tags, jReq.Folder, err = normalizeLabels(jReq.Tags, jReq.Folder); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ownerID, ok := h.actingOwner(res, req, storage.RoleEditor)
+	if !ok {
+		return
+	}
+
+	link := models.Link{
+		ShortURL:      jReq.Alias,
+		OriginalURL:   jReq.URL,
+		NormalizedURL: normalizedURL,
+		UserID:        ownerID,
+		ExpiresAt:     jReq.ExpiresAt,
+		Tags:          jReq.Tags,
+		Folder:        jReq.Folder,
+	}
+	urlKey, err := h.Storage.Set(ctx, link)
 	HeaderStatus := http.StatusCreated
 
 	if err != nil {
 		var storageErr *storage.StorageError
 		if errors.As(err, &storageErr) && storageErr.Type == "already exists" {
 			HeaderStatus = http.StatusConflict
+		} else if errors.As(err, &storageErr) && storageErr.Type == "alias taken" {
+			http.Error(res, "The alias is already taken", http.StatusConflict)
+			return
 		} else {
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
@@ -113,31 +180,49 @@ func (h *Handlers) ShortenURL(res http.ResponseWriter, req *http.Request) {
 	res.Write(out)
 }
 
+// GetUserURL - lists a page of the user's links, the cursor of the next page is sent in X-Next-Cursor
 func (h *Handlers) GetUserURL(res http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-	userID, err := getUserIDFromContext(req)
+	_, err := getUserIDFromContext(req)
 
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusUnauthorized)
 		return
 	}
+	ownerID, ok := h.actingOwner(res, req, storage.RoleViewer)
+	if !ok {
+		return
+	}
+	query, err := parseURLQuery(req.URL.Query())
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	jResBatch, err := h.Storage.GetUserURLs(ctx, userID)
+	page, err := h.Storage.GetUserURLs(ctx, ownerID, query)
+	if storage.IsErrorType(err, "invalid cursor") {
+		http.Error(res, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(res, "No content", http.StatusNoContent)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if len(jResBatch) == 0 {
+	if len(page.Links) == 0 {
 		http.Error(res, "No content", http.StatusNoContent)
 		return
 	}
 
-	out, err := json.Marshal(jResBatch)
+	out, err := json.Marshal(page.Links)
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// The body stays a JSON array, the next page is found by the header
+	if page.NextCursor != "" {
+		res.Header().Set(NextCursorHeader, page.NextCursor)
+	}
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(http.StatusOK)
 	res.Write([]byte(out))
@@ -160,12 +245,162 @@ func (h *Handlers) DeleteUserURL(res http.ResponseWriter, req *http.Request) {
 	}
 
 	userID, _ := getUserIDFromContext(req)
+	ownerID, ok := h.actingOwner(res, req, storage.RoleEditor)
+	if !ok {
+		return
+	}
 
-	// send key to the queue for deleting
-	h.DeleteQueue <- models.KeysToDelete{Keys: keys, UserID: userID}
+	// With ?wait=true the keys are deleted right away and the outcome of every key is returned
+	if wait, _ := strconv.ParseBool(req.URL.Query().Get("wait")); wait {
+		h.deleteUserURLNow(res, req, models.KeysToDelete{Keys: keys, UserID: ownerID})
+		return
+	}
+
+	// Register a job, so the caller can follow the deletion
+	job, err := h.DeleteJobs.Create(userID, len(keys))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Persist the request, so it is not lost if the server restarts before the worker gets to it
+	err = h.Storage.EnqueueDeletion(req.Context(), models.KeysToDelete{Keys: keys, UserID: ownerID, JobID: job.ID})
+	if err != nil {
+		h.DeleteJobs.Fail(job.ID, err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(job)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	//Notify the sender that the key was accepted successfully
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Location", "/api/user/deletions/"+job.ID)
 	res.WriteHeader(http.StatusAccepted)
+	res.Write(out)
+}
+
+// GetDeletionJob - reports the progress of the user's deletion request
+func (h *Handlers) GetDeletionJob(res http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The jobs of other users are not disclosed
+	job, found := h.DeleteJobs.Get(chi.URLParam(req, "jobID"))
+	if !found || job.UserID != userID {
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	}
+
+	out, err := json.Marshal(job)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
+}
+
+// GetUserTrash - lists the deleted links of the user that can still be restored
+func (h *Handlers) GetUserTrash(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	_, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ownerID, ok := h.actingOwner(res, req, storage.RoleViewer)
+	if !ok {
+		return
+	}
+
+	jResBatch, err := h.Storage.GetUserTrash(ctx, ownerID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(jResBatch) == 0 {
+		http.Error(res, "No content", http.StatusNoContent)
+		return
+	}
+
+	out, err := json.Marshal(jResBatch)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
+}
+
+// RestoreUserURL - undeletes the user's links, the body is a JSON array of keys like in DeleteUserURL.
+// Responds with the keys that were restored.
+func (h *Handlers) RestoreUserURL(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	_, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(req.Body).Decode(&keys); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	ownerID, ok := h.actingOwner(res, req, storage.RoleEditor)
+	if !ok {
+		return
+	}
+
+	restored, err := h.Storage.Restore(ctx, ownerID, keys)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(restored)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
+}
+
+// deleteUserURLNow - deletes the keys synchronously and responds with the per-key results
+func (h *Handlers) deleteUserURLNow(res http.ResponseWriter, req *http.Request, item models.KeysToDelete) {
+	if len(item.Keys) == 0 {
+		http.Error(res, "No keys provided for deletion", http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.Storage.DeleteBatch(req.Context(), []models.KeysToDelete{item})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(results)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
 }
 
 func (h *Handlers) GetURL(res http.ResponseWriter, req *http.Request) {
@@ -183,7 +418,7 @@ func (h *Handlers) GetURL(res http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		var storageErr *storage.StorageError
 
-		if errors.As(err, &storageErr) && storageErr.Type == "deleted" {
+		if errors.As(err, &storageErr) && (storageErr.Type == "deleted" || storageErr.Type == "expired") {
 			res.WriteHeader(http.StatusGone)
 		} else {
 			http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -193,11 +428,135 @@ func (h *Handlers) GetURL(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Record the click in the background
+	h.trackClick(req, urlKey)
+
 	// Set the Location header and return a 307 Temporary Redirect
 	res.Header().Set("Location", originalURL)
 	res.WriteHeader(http.StatusTemporaryRedirect)
 }
 
+// GetLinkStats - returns the click statistics of the link to its owner
+func (h *Handlers) GetLinkStats(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	urlKey := chi.URLParam(req, "urlKey")
+
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	link, err := h.Storage.GetLink(ctx, urlKey)
+	if err != nil {
+		var storageErr *storage.StorageError
+		if errors.As(err, &storageErr) && storageErr.Type == "not found" {
+			http.Error(res, "Not found", http.StatusNotFound)
+			return
+		}
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if allowed, err := h.allows(ctx, userID, link.UserID, storage.RoleViewer); err != nil || !allowed {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	stats, err := h.Storage.GetLinkStats(ctx, urlKey)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
+}
+
+// UpdateUserURL - points the user's link to a new URL, the key stays the same
+func (h *Handlers) UpdateUserURL(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	urlKey := chi.URLParam(req, "urlKey")
+
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var jReq models.JSONReq
+	if err := json.NewDecoder(req.Body).Decode(&jReq); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	normalizedURL, err := normalizeURL(jReq.URL)
+	if _, valid := urlkey.IsValidURL(jReq.URL); !valid || err != nil {
+		http.Error(res, "The incoming JSON string should contain a valid URL", http.StatusBadRequest)
+		return
+	}
+
+	link, err := h.Storage.GetLink(ctx, urlKey)
+	if err != nil {
+		var storageErr *storage.StorageError
+		if errors.As(err, &storageErr) && storageErr.Type == "not found" {
+			http.Error(res, "Not found", http.StatusNotFound)
+			return
+		}
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if allowed, err := h.allows(ctx, userID, link.UserID, storage.RoleEditor); err != nil || !allowed {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// The link stays with its owner, who may be a workspace rather than the user
+	link = models.Link{ShortURL: urlKey, OriginalURL: jReq.URL, NormalizedURL: normalizedURL, UserID: link.UserID}
+	if err := h.Storage.Update(ctx, link); err != nil {
+		var storageErr *storage.StorageError
+		if !errors.As(err, &storageErr) {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch storageErr.Type {
+		case "not found":
+			http.Error(res, "Not found", http.StatusNotFound)
+		case "deleted":
+			http.Error(res, "The link is deleted", http.StatusGone)
+		case "already exists":
+			http.Error(res, "The URL is already shortened: "+config.AppConfig.ResultHost+"/"+storageErr.ShortURL, http.StatusConflict)
+		default:
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	history, err := h.Storage.GetLinkHistory(ctx, urlKey)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jRes := models.JSONLinkRes{
+		ShortURL:    config.AppConfig.ResultHost + "/" + urlKey,
+		OriginalURL: jReq.URL,
+		History:     history,
+	}
+
+	out, err := json.Marshal(jRes)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(out)
+}
+
 func (h *Handlers) IsAvailable(res http.ResponseWriter, req *http.Request) {
 	if h.Storage.IsAvailable() {
 		res.WriteHeader(http.StatusOK)
@@ -216,10 +575,43 @@ func (h *Handlers) ShortenBatchURL(res http.ResponseWriter, req *http.Request) {
 	}
 	defer req.Body.Close()
 
-	userID, _ := getUserIDFromContext(req)
-	jResBatch, err := h.Storage.SetBatch(ctx, jReqBatch, userID)
+	for i, el := range jReqBatch {
+		normalizedURL, err := normalizeURL(el.OriginalURL)
+		if err != nil {
+			http.Error(res, "The batch should contain valid URLs: "+el.OriginalURL, http.StatusBadRequest)
+			return
+		}
+		jReqBatch[i].NormalizedURL = normalizedURL
+
+		if el.Alias != "" {
+			if err := urlkey.ValidateAlias(el.Alias); err != nil {
+				http.Error(res, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := resolveExpiry(&jReqBatch[i]); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jReqBatch[i].Tags, jReqBatch[i].Folder, err = normalizeLabels(el.Tags, el.Folder)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ownerID, ok := h.actingOwner(res, req, storage.RoleEditor)
+	if !ok {
+		return
+	}
+	jResBatch, err := h.Storage.SetBatch(ctx, jReqBatch, ownerID)
 
 	if err != nil {
+		var storageErr *storage.StorageError
+		if errors.As(err, &storageErr) && storageErr.Type == "alias taken" {
+			http.Error(res, "The alias is already taken: "+storageErr.ShortURL, http.StatusConflict)
+			return
+		}
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -1,23 +1,59 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
 	"net/http/httptest"
 	"shorter/internal/config"
+	"shorter/internal/jobs"
+	"shorter/internal/middleware"
 	"shorter/internal/models"
-
 	"shorter/internal/storage"
+	"shorter/internal/urlkey"
 	"strings"
 	"testing"
+	"time"
 )
 
+var testKeys = urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet)
+
+// expectedKey - the key the test storage gives to the first stored URL
+func expectedKey(originalURL string) string {
+	normalizedURL, _ := urlkey.Normalize(originalURL, false)
+	key, _ := testKeys.Generate(normalizedURL, 0)
+	return key
+}
+
+// serve - sends the request on behalf of the user and records the response, the options adjust the request
+func serve(t *testing.T, r http.Handler, method, target, userID, body string, opts ...func(*http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, userID))
+	for _, opt := range opts {
+		opt(req)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// withWorkspace - makes the request act on the links of the workspace
+func withWorkspace(workspaceID string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set(WorkspaceHeader, workspaceID)
+	}
+}
+
 func setupRouter() *chi.Mux {
 
-	memStorage := storage.NewMemoryStorage()
-	deleteQueue := make(chan models.KeysToDelete, 1024)
+	memStorage := storage.NewMemoryStorage(testKeys)
+	clickQueue := make(chan models.Click, 1024)
 
-	h := NewHandlers(memStorage, deleteQueue)
+	h := NewHandlers(memStorage, jobs.NewTracker(time.Hour), clickQueue, nil)
 
 	r := chi.NewRouter()
 	r.Post("/", h.PostURL)
@@ -51,7 +87,7 @@ func TestRouter(t *testing.T) {
 			want: want{
 				code:   201,
 				header: "",
-				body:   config.AppConfig.ResultHost + "/3985", // Expected body will vary depending on generated key
+				body:   config.AppConfig.ResultHost + "/" + expectedKey("https://yandex.ru"),
 			},
 		},
 		{
@@ -67,7 +103,7 @@ func TestRouter(t *testing.T) {
 		},
 		{
 			name:   "GET: Positive. Extract URL by a valid key",
-			target: "/3985", // Use the expected key from the POST test
+			target: "/" + expectedKey("https://yandex.ru"),
 			method: "GET",
 			body:   "",
 			want: want{
@@ -95,7 +131,7 @@ func TestRouter(t *testing.T) {
 			want: want{
 				code:   201,
 				header: "",
-				body:   `{"result":"` + config.AppConfig.ResultHost + `/921c"}`, // Expected body will vary depending on generated key
+				body:   `{"result":"` + config.AppConfig.ResultHost + "/" + expectedKey("https://practicum.yandex.ru") + `"}`,
 			},
 		},
 		{
@@ -117,7 +153,73 @@ func TestRouter(t *testing.T) {
 			want: want{
 				code:   409,
 				header: "",
-				body:   `{"result":"` + config.AppConfig.ResultHost + `/921c"}`,
+				body:   `{"result":"` + config.AppConfig.ResultHost + "/" + expectedKey("https://practicum.yandex.ru") + `"}`,
+			},
+		},
+		{
+			name:   "POST: Negative. The same URL written differently already exists",
+			target: "/api/shorten",
+			method: "POST",
+			body:   `{"url":"HTTPS://Practicum.Yandex.ru:443/#about"}`,
+			want: want{
+				code:   409,
+				header: "",
+				body:   `{"result":"` + config.AppConfig.ResultHost + "/" + expectedKey("https://practicum.yandex.ru") + `"}`,
+			},
+		},
+		{
+			name:   "POST: Positive. JSON with a custom alias",
+			target: "/api/shorten",
+			method: "POST",
+			body:   `{"url":"https://practicum.yandex.ru/spring","alias":"spring-sale"}`,
+			want: want{
+				code:   201,
+				header: "",
+				body:   `{"result":"` + config.AppConfig.ResultHost + `/spring-sale"}`,
+			},
+		},
+		{
+			name:   "GET: Positive. Extract URL by a custom alias",
+			target: "/spring-sale",
+			method: "GET",
+			body:   "",
+			want: want{
+				code:   307,
+				header: "https://practicum.yandex.ru/spring",
+				body:   "",
+			},
+		},
+		{
+			name:   "POST: Negative. Alias is taken by another URL",
+			target: "/api/shorten",
+			method: "POST",
+			body:   `{"url":"https://practicum.yandex.ru/autumn","alias":"spring-sale"}`,
+			want: want{
+				code:   409,
+				header: "",
+				body:   "The alias is already taken",
+			},
+		},
+		{
+			name:   "POST: Negative. Expiry time in the past",
+			target: "/api/shorten",
+			method: "POST",
+			body:   `{"url":"https://practicum.yandex.ru/autumn","expires_at":"2020-01-01T00:00:00Z"}`,
+			want: want{
+				code:   400,
+				header: "",
+				body:   "expires_at should be in the future",
+			},
+		},
+		{
+			name:   "POST: Negative. Reserved alias",
+			target: "/api/shorten",
+			method: "POST",
+			body:   `{"url":"https://practicum.yandex.ru/autumn","alias":"ping"}`,
+			want: want{
+				code:   400,
+				header: "",
+				body:   `the alias "ping" is reserved`,
 			},
 		},
 	}
@@ -145,3 +247,84 @@ func TestRouter(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateUserURL(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, nil)
+
+	r := chi.NewRouter()
+	r.Patch("/api/user/urls/{urlKey}", h.UpdateUserURL)
+
+	key, err := memStorage.Set(context.Background(), models.Link{OriginalURL: "https://a.example.com", UserID: "owner"})
+	require.NoError(t, err)
+
+	assert.Equal(t, 403, serve(t, r, "PATCH", "/api/user/urls/"+key, "intruder", `{"url":"https://b.example.com"}`).Code)
+	assert.Equal(t, 400, serve(t, r, "PATCH", "/api/user/urls/"+key, "owner", `{"url":"b.example.com"}`).Code)
+
+	w := serve(t, r, "PATCH", "/api/user/urls/"+key, "owner", `{"url":"https://b.example.com"}`)
+	require.Equal(t, 200, w.Code)
+
+	var jRes models.JSONLinkRes
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jRes))
+	assert.Equal(t, config.AppConfig.ResultHost+"/"+key, jRes.ShortURL)
+	assert.Equal(t, "https://b.example.com", jRes.OriginalURL)
+	require.Len(t, jRes.History, 1)
+	assert.Equal(t, "https://a.example.com", jRes.History[0].OriginalURL)
+}
+
+func TestDeleteUserURL_Wait(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, nil)
+
+	r := chi.NewRouter()
+	r.Delete("/api/user/urls", h.DeleteUserURL)
+
+	key, err := memStorage.Set(context.Background(), models.Link{OriginalURL: "https://a.example.com", UserID: "user"})
+	require.NoError(t, err)
+
+	w := serve(t, r, "DELETE", "/api/user/urls?wait=true", "user", `["`+key+`","missing"]`)
+	require.Equal(t, 200, w.Code)
+	var results []models.DeleteResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	assert.Equal(t, []models.DeleteResult{
+		{Key: key, Status: storage.DeleteDeleted},
+		{Key: "missing", Status: storage.DeleteNotFound},
+	}, results)
+	pending, err := memStorage.PendingDeletions(context.Background(), time.Now(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending, "The synchronous delete should bypass the queue")
+}
+
+func TestDeleteUserURL_Job(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, jobs.NewTracker(time.Hour), nil, nil)
+
+	r := chi.NewRouter()
+	r.Delete("/api/user/urls", h.DeleteUserURL)
+	r.Get("/api/user/deletions/{jobID}", h.GetDeletionJob)
+
+	w := serve(t, r, "DELETE", "/api/user/urls", "user", `["a","b"]`)
+	require.Equal(t, 202, w.Code)
+
+	var job models.DeletionJob
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, jobs.StatusQueued, job.Status)
+	assert.Equal(t, 2, job.Total)
+	assert.Equal(t, "/api/user/deletions/"+job.ID, w.Header().Get("Location"))
+
+	pending, err := memStorage.PendingDeletions(context.Background(), time.Now(), 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, job.ID, pending[0].Item.JobID)
+	assert.Equal(t, []string{"a", "b"}, pending[0].Item.Keys)
+	h.DeleteJobs.Finish(job.ID, []models.DeleteResult{{Key: "a", Status: storage.DeleteDeleted}, {Key: "b", Status: storage.DeleteNotFound}})
+
+	w = serve(t, r, "GET", w.Header().Get("Location"), "user", "")
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, jobs.StatusDone, job.Status)
+	assert.Equal(t, 1, job.Deleted)
+	assert.Equal(t, 1, job.NotFound)
+
+	assert.Equal(t, 404, serve(t, r, "GET", "/api/user/deletions/"+job.ID, "intruder", "").Code)
+}
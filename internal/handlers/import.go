@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"shorter/internal/config"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"shorter/internal/urlkey"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importChunkSize - the number of rows stored by one SetBatch call
+const importChunkSize = 100
+
+// maxImportLine - the longest NDJSON line of the import
+const maxImportLine = 1 << 20
+
+// importRow - a row of the import with the line it starts at. A row that cannot be stored has the error.
+type importRow struct {
+	line int
+	req  models.JSONReq
+	err  error
+}
+
+// ImportURLs - shortens the URLs streamed in the body as CSV with a header or as NDJSON.
+// The rows are stored in chunks, and the result of every row is streamed back as NDJSON,
+// so a malformed row is reported without failing the others.
+func (h *Handlers) ImportURLs(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if _, err := getUserIDFromContext(req); err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ownerID, ok := h.actingOwner(res, req, storage.RoleEditor)
+	if !ok {
+		return
+	}
+
+	var next func() (importRow, bool)
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		var err error
+		if next, err = csvRows(req.Body); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "application/x-ndjson":
+		next = ndjsonRows(req.Body)
+	default:
+		http.Error(res, "The body should be text/csv or application/x-ndjson", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// The results of every chunk are flushed while the body is still read. Over HTTP/1 the server
+	// closes the body once the response starts, unless the handler asks for the full duplex.
+	// The controller reaches the server's writer behind the middleware.
+	controller := http.NewResponseController(res)
+	if err := controller.EnableFullDuplex(); err != nil {
+		http.Error(res, "The import cannot be streamed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(res)
+
+	chunk := make([]importRow, 0, importChunkSize)
+	flush := func() {
+		for _, result := range h.importChunk(ctx, ownerID, chunk) {
+			encoder.Encode(result)
+		}
+		controller.Flush()
+		chunk = chunk[:0]
+	}
+	for row, more := next(); more; row, more = next() {
+		if row.err == nil {
+			row.err = prepareImportRow(&row.req)
+		}
+		chunk = append(chunk, row)
+		if len(chunk) == importChunkSize {
+			flush()
+		}
+	}
+	if len(chunk) > 0 {
+		flush()
+	}
+}
+
+// importChunk - stores the valid rows of the chunk with SetBatch and reports every row in order
+func (h *Handlers) importChunk(ctx context.Context, ownerID string, chunk []importRow) []models.ImportResult {
+	results := make([]models.ImportResult, len(chunk))
+	valid := make([]models.JSONReq, 0, len(chunk))
+	positions := make([]int, 0, len(chunk))
+	for i, row := range chunk {
+		results[i] = models.ImportResult{Line: row.line, CorrID: row.req.CorrID}
+		if row.err != nil {
+			results[i].Error = row.err.Error()
+			continue
+		}
+		valid = append(valid, row.req)
+		positions = append(positions, i)
+	}
+	if len(valid) == 0 {
+		return results
+	}
+
+	started := time.Now().UTC()
+	stored, err := h.Storage.SetBatch(ctx, valid, ownerID)
+	if err == nil && len(stored) == len(valid) {
+		for j, jRes := range stored {
+			// SetBatch returns the key of the link that already has the URL, whatever the alias of the row
+			if alias := valid[j].Alias; alias != "" && jRes.ShortURL != config.AppConfig.ResultHost+"/"+alias {
+				results[positions[j]].Error = "the URL is already shortened: " + jRes.ShortURL
+				continue
+			}
+			results[positions[j]].ShortURL = jRes.ShortURL
+		}
+		return results
+	}
+
+	// A row the storage rejects fails the whole batch, so the rows are stored one by one to find it
+	for j, jReq := range valid {
+		results[positions[j]].ShortURL, results[positions[j]].Error = h.importSingle(ctx, ownerID, jReq, started)
+	}
+	return results
+}
+
+// importSingle - stores a row of the failed chunk and returns its short URL or the error.
+// The memory and the file storages keep the rows stored before the batch failed, so a duplicate
+// created since the chunk started is the row itself, while an older one is reported.
+func (h *Handlers) importSingle(ctx context.Context, ownerID string, jReq models.JSONReq, started time.Time) (string, string) {
+	urlKey, err := h.Storage.Set(ctx, models.Link{
+		ShortURL:      jReq.Alias,
+		OriginalURL:   jReq.OriginalURL,
+		NormalizedURL: jReq.NormalizedURL,
+		UserID:        ownerID,
+		ExpiresAt:     jReq.ExpiresAt,
+		Tags:          jReq.Tags,
+		Folder:        jReq.Folder,
+	})
+	shortURL := config.AppConfig.ResultHost + "/" + urlKey
+	switch {
+	case storage.IsErrorType(err, "alias taken"):
+		return "", "the alias is already taken"
+	case storage.IsErrorType(err, "already exists"):
+		link, err := h.Storage.GetLink(ctx, urlKey)
+		if err != nil {
+			return "", err.Error()
+		}
+		if link.CreatedAt.Before(started) {
+			return "", "the URL is already shortened: " + shortURL
+		}
+	case err != nil:
+		return "", err.Error()
+	}
+	if jReq.Alias != "" && urlKey != jReq.Alias {
+		return "", "the URL is already shortened: " + shortURL
+	}
+	return shortURL, ""
+}
+
+// prepareImportRow - validates the row like ShortenURL and sets its normalized URL, the expiry and the labels
+func prepareImportRow(jReq *models.JSONReq) error {
+	if jReq.OriginalURL == "" {
+		jReq.OriginalURL = jReq.URL
+	}
+	normalizedURL, err := normalizeURL(jReq.OriginalURL)
+	if _, valid := urlkey.IsValidURL(jReq.OriginalURL); !valid || err != nil {
+		return errors.New("the row should contain a valid URL")
+	}
+	jReq.NormalizedURL = normalizedURL
+
+	if jReq.Alias != "" {
+		if err := urlkey.ValidateAlias(jReq.Alias); err != nil {
+			return err
+		}
+	}
+	if err := resolveExpiry(jReq); err != nil {
+		return err
+	}
+	jReq.Tags, jReq.Folder, err = normalizeLabels(jReq.Tags, jReq.Folder)
+	return err
+}
+
+// ndjsonRows - reads a JSON object like the one of ShortenURL from every non-empty line
+func ndjsonRows(body io.Reader) func() (importRow, bool) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+	line, done := 0, false
+
+	return func() (importRow, bool) {
+		for !done && scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			row := importRow{line: line}
+			if err := json.Unmarshal([]byte(text), &row.req); err != nil {
+				row.err = errors.New("invalid JSON")
+			}
+			return row, true
+		}
+		// A read error ends the import, it is reported as the last row
+		if err := scanner.Err(); err != nil && !done {
+			done = true
+			return importRow{line: line + 1, err: err}, true
+		}
+		return importRow{}, false
+	}
+}
+
+// The columns of the CSV import, only url is required. The tags are separated by commas.
+const (
+	csvURL       = "url"
+	csvAlias     = "alias"
+	csvTags      = "tags"
+	csvFolder    = "folder"
+	csvExpiresAt = "expires_at"
+	csvTTL       = "ttl"
+	csvCorrID    = "correlation_id"
+)
+
+// csvRows - reads the header, then a row from every record. The unknown columns are ignored.
+func csvRows(body io.Reader) (func() (importRow, bool), error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("the CSV should start with a header")
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, found := columns[csvURL]; !found {
+		return nil, errors.New("the CSV header should have the url column")
+	}
+
+	done := false
+	return func() (importRow, bool) {
+		if done {
+			return importRow{}, false
+		}
+		record, err := reader.Read()
+		if err == io.EOF {
+			done = true
+			return importRow{}, false
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return importRow{line: parseErr.StartLine, err: parseErr.Err}, true
+		}
+		if err != nil {
+			done = true
+			line, _ := reader.FieldPos(0)
+			return importRow{line: line, err: err}, true
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := importRow{line: line}
+		field := func(name string) string {
+			if i, found := columns[name]; found && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row.req = models.JSONReq{
+			OriginalURL: field(csvURL),
+			Alias:       field(csvAlias),
+			Folder:      field(csvFolder),
+			CorrID:      field(csvCorrID),
+		}
+		if tags := field(csvTags); tags != "" {
+			row.req.Tags = strings.Split(tags, ",")
+		}
+		if expiresAt := field(csvExpiresAt); expiresAt != "" {
+			t, err := time.Parse(time.RFC3339, expiresAt)
+			if err != nil {
+				row.err = errors.New("expires_at should be an RFC 3339 time")
+				return row, true
+			}
+			row.req.ExpiresAt = &t
+		}
+		if ttl := field(csvTTL); ttl != "" {
+			if row.req.TTL, err = strconv.ParseInt(ttl, 10, 64); err != nil {
+				row.err = errors.New("ttl should be a number of seconds")
+			}
+		}
+		return row, true
+	}, nil
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"shorter/internal/config"
+	"shorter/internal/middleware"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// importServer - serves the import on behalf of the user over HTTP, so the body is read while the results are streamed
+func importServer(t *testing.T, h *Handlers) *httptest.Server {
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, "user")))
+		})
+	})
+	r.Post("/api/shorten/import", h.ImportURLs)
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// postImport - sends the body to the import and reads the status and the results of the rows
+func postImport(t *testing.T, server *httptest.Server, contentType, body string) (int, []models.ImportResult) {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/api/shorten/import", contentType, strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	rows := []models.ImportResult{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var row models.ImportResult
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &row))
+			rows = append(rows, row)
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return resp.StatusCode, rows
+}
+
+func TestImportURLs(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, nil)
+	server := importServer(t, h)
+
+	_, err := memStorage.Set(context.Background(), models.Link{ShortURL: "taken", OriginalURL: "https://other.example.com", UserID: "other"})
+	require.NoError(t, err)
+
+	csvBody := "url,alias,tags,correlation_id\n" +
+		"https://a.example.com,,\"spring,sale\",1\n" +
+		"not a url,,,2\n" +
+		"https://b.example.com,taken,,3\n" +
+		"https://c.example.com,c-link,,4\n"
+	status, results := postImport(t, server, "text/csv", csvBody)
+	require.Equal(t, 200, status)
+	assert.Equal(t, []models.ImportResult{
+		{Line: 2, CorrID: "1", ShortURL: config.AppConfig.ResultHost + "/" + expectedKey("https://a.example.com")},
+		{Line: 3, CorrID: "2", Error: "the row should contain a valid URL"},
+		{Line: 4, CorrID: "3", Error: "the alias is already taken"},
+		{Line: 5, CorrID: "4", ShortURL: config.AppConfig.ResultHost + "/c-link"},
+	}, results)
+
+	page, err := memStorage.GetUserURLs(context.Background(), "user", storage.URLQuery{Tags: []string{"sale"}})
+	require.NoError(t, err)
+	assert.Len(t, page.Links, 1)
+
+	ndjsonBody := `{"url":"https://d.example.com","correlation_id":"a"}` + "\n\n" +
+		`{"url":` + "\n" +
+		`{"url":"https://a.example.com","correlation_id":"b"}` + "\n"
+	status, results = postImport(t, server, "application/x-ndjson", ndjsonBody)
+	require.Equal(t, 200, status)
+	assert.Equal(t, []models.ImportResult{
+		{Line: 1, CorrID: "a", ShortURL: config.AppConfig.ResultHost + "/" + expectedKey("https://d.example.com")},
+		{Line: 3, Error: "invalid JSON"},
+		{Line: 4, CorrID: "b", ShortURL: config.AppConfig.ResultHost + "/" + expectedKey("https://a.example.com")},
+	}, results)
+
+	status, _ = postImport(t, server, "text/csv", "alias,tags\nx,y\n")
+	assert.Equal(t, 400, status)
+	status, _ = postImport(t, server, "application/json", "[]")
+	assert.Equal(t, 415, status)
+}
+
+func TestImportURLs_TakenAliasInChunk(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, nil)
+	server := importServer(t, h)
+
+	ctx := context.Background()
+	_, err := memStorage.Set(ctx, models.Link{ShortURL: "taken", OriginalURL: "https://other.example.com", UserID: "other"})
+	require.NoError(t, err)
+	normalizedURL, err := normalizeURL("https://old.example.com")
+	require.NoError(t, err)
+	_, err = memStorage.Set(ctx, models.Link{ShortURL: "old", OriginalURL: "https://old.example.com", NormalizedURL: normalizedURL, UserID: "user"})
+	require.NoError(t, err)
+
+	// The taken alias fails the chunk after the rows before it are stored
+	ndjsonBody := `{"url":"https://a.example.com","correlation_id":"1"}` + "\n" +
+		`{"url":"https://old.example.com","correlation_id":"2"}` + "\n" +
+		`{"url":"https://a.example.com","alias":"a-link","correlation_id":"3"}` + "\n" +
+		`{"url":"https://b.example.com","alias":"taken","correlation_id":"4"}` + "\n" +
+		`{"url":"https://c.example.com","correlation_id":"5"}` + "\n"
+	status, results := postImport(t, server, "application/x-ndjson", ndjsonBody)
+	require.Equal(t, 200, status)
+	assert.Equal(t, []models.ImportResult{
+		{Line: 1, CorrID: "1", ShortURL: config.AppConfig.ResultHost + "/" + expectedKey("https://a.example.com")},
+		{Line: 2, CorrID: "2", Error: "the URL is already shortened: " + config.AppConfig.ResultHost + "/old"},
+		{Line: 3, CorrID: "3", Error: "the URL is already shortened: " + config.AppConfig.ResultHost + "/" + expectedKey("https://a.example.com")},
+		{Line: 4, CorrID: "4", Error: "the alias is already taken"},
+		{Line: 5, CorrID: "5", ShortURL: config.AppConfig.ResultHost + "/" + expectedKey("https://c.example.com")},
+	}, results)
+
+	page, err := memStorage.GetUserURLs(ctx, "user", storage.URLQuery{})
+	require.NoError(t, err)
+	assert.Len(t, page.Links, 3)
+}
+
+func TestImportURLs_Streamed(t *testing.T) {
+	h := NewHandlers(storage.NewMemoryStorage(testKeys), nil, nil, nil)
+	server := importServer(t, h)
+
+	// More rows than a chunk, so the first results are flushed before the body is read to the end.
+	// The long paths make the rest of the body larger than the server reads ahead on its own.
+	const rows = 2*importChunkSize + 50
+	path := strings.Repeat("a", 2048)
+	var body strings.Builder
+	for i := 1; i <= rows; i++ {
+		fmt.Fprintf(&body, `{"url":"https://example.com/%s/%d","correlation_id":"%d"}`+"\n", path, i, i)
+	}
+
+	status, results := postImport(t, server, "application/x-ndjson", body.String())
+	require.Equal(t, 200, status)
+	require.Len(t, results, rows)
+	for i, result := range results {
+		assert.Equal(t, i+1, result.Line)
+		assert.Equal(t, strconv.Itoa(i+1), result.CorrID)
+		assert.Empty(t, result.Error)
+		assert.NotEmpty(t, result.ShortURL)
+	}
+}
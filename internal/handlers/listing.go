@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"errors"
+	"net/url"
+	"shorter/internal/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NextCursorHeader - the cursor of the next page of the links, absent on the last page
+const NextCursorHeader = "X-Next-Cursor"
+
+// The page size of GET /api/user/urls, the links are only paged when the limit or the cursor is given
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// parseURLQuery - reads the page, the filters and the sort of the user's links from the query string:
+// limit, cursor, sort, domain, from, to, state, q, folder and tag, which can be repeated.
+// Without the limit and the cursor all the links are listed, as before the paging was introduced.
+func parseURLQuery(values url.Values) (storage.URLQuery, error) {
+	query := storage.URLQuery{
+		Domain: strings.TrimSpace(values.Get("domain")),
+		State:  values.Get("state"),
+		Search: values.Get("q"),
+		Folder: strings.TrimSpace(values.Get("folder")),
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+	if query.Cursor != "" {
+		query.Limit = defaultPageSize
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return query, errors.New("limit should be from 1 to " + strconv.Itoa(maxPageSize))
+		}
+		query.Limit = n
+	}
+	if query.Sort != "" && !storage.IsSort(query.Sort) {
+		return query, errors.New("sort should be created, -created, url or -url")
+	}
+	switch query.State {
+	case "", storage.StateActive, storage.StateExpired, storage.StateDeleted:
+	default:
+		return query, errors.New("state should be active, expired or deleted")
+	}
+
+	for _, tag := range values["tag"] {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return query, err
+		}
+		query.Tags = append(query.Tags, tag)
+	}
+
+	var err error
+	if query.CreatedFrom, err = parseTime(values.Get("from")); err != nil {
+		return query, errors.New("from should be a date or an RFC 3339 time")
+	}
+	if query.CreatedTo, err = parseTime(values.Get("to")); err != nil {
+		return query, errors.New("to should be a date or an RFC 3339 time")
+	}
+	return query, nil
+}
+
+// parseTime - accepts a date, which stands for its midnight in UTC, or a full time
+func parseTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, value); err != nil {
+			return nil, err
+		}
+	}
+	t = t.UTC()
+	return &t, nil
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"testing"
+)
+
+func TestGetUserURL_Pages(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, nil)
+
+	r := chi.NewRouter()
+	r.Get("/api/user/urls", h.GetUserURL)
+
+	for _, originalURL := range []string{"https://a.example.com", "https://b.example.com", "https://c.example.org"} {
+		_, err := memStorage.Set(context.Background(), models.Link{OriginalURL: originalURL, UserID: "user"})
+		require.NoError(t, err)
+	}
+
+	w := serve(t, r, "GET", "/api/user/urls?sort=url&limit=2", "user", "")
+	require.Equal(t, 200, w.Code)
+	var links []models.JSONUserRes
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &links))
+	require.Len(t, links, 2)
+	assert.Equal(t, "https://a.example.com", links[0].OriginalURL)
+	assert.NotNil(t, links[0].CreatedAt)
+
+	cursor := w.Header().Get(NextCursorHeader)
+	require.NotEmpty(t, cursor)
+	w = serve(t, r, "GET", "/api/user/urls?sort=url&limit=2&cursor="+url.QueryEscape(cursor), "user", "")
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &links))
+	require.Len(t, links, 1)
+	assert.Equal(t, "https://c.example.org", links[0].OriginalURL)
+	assert.Empty(t, w.Header().Get(NextCursorHeader))
+
+	// Without the limit and the cursor all the links come at once
+	w = serve(t, r, "GET", "/api/user/urls", "user", "")
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &links))
+	assert.Len(t, links, 3)
+	assert.Empty(t, w.Header().Get(NextCursorHeader))
+	query, err := parseURLQuery(url.Values{"cursor": {cursor}})
+	require.NoError(t, err)
+	assert.Equal(t, defaultPageSize, query.Limit)
+
+	w = serve(t, r, "GET", "/api/user/urls?domain=example.org&state=active&from=2020-01-01", "user", "")
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &links))
+	assert.Len(t, links, 1)
+
+	assert.Equal(t, 204, serve(t, r, "GET", "/api/user/urls?q=missing", "user", "").Code)
+	assert.Equal(t, 400, serve(t, r, "GET", "/api/user/urls?limit=0", "user", "").Code)
+	assert.Equal(t, 400, serve(t, r, "GET", "/api/user/urls?sort=clicks", "user", "").Code)
+	assert.Equal(t, 400, serve(t, r, "GET", "/api/user/urls?state=archived", "user", "").Code)
+	assert.Equal(t, 400, serve(t, r, "GET", "/api/user/urls?to=yesterday", "user", "").Code)
+	assert.Equal(t, 400, serve(t, r, "GET", "/api/user/urls?cursor=bogus", "user", "").Code)
+}
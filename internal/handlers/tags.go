@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The limits of the labels of a link
+const (
+	maxTags         = 20
+	maxTagLength    = 64
+	maxFolderLength = 255
+)
+
+// normalizeTag - the tags are compared case-insensitively, so they are kept in lower case
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+		return "", errors.New("a tag should be from 1 to " + strconv.Itoa(maxTagLength) + " characters long")
+	}
+	return tag, nil
+}
+
+// normalizeLabels - returns the sorted unique tags and the trimmed folder, or an error for the client
+func normalizeLabels(tags []string, folder string) ([]string, string, error) {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, "", err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTags {
+		return nil, "", errors.New("a link can have up to " + strconv.Itoa(maxTags) + " tags")
+	}
+	sort.Strings(normalized)
+
+	folder = strings.TrimSpace(folder)
+	if utf8.RuneCountInString(folder) > maxFolderLength {
+		return nil, "", errors.New("the folder should be up to " + strconv.Itoa(maxFolderLength) + " characters long")
+	}
+	return normalized, folder, nil
+}
+
+// SetLinkLabels - replaces the tags and the folder of a link the user can edit
+func (h *Handlers) SetLinkLabels(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	urlKey := chi.URLParam(req, "urlKey")
+
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var jReq models.JSONLabelsReq
+	if err := json.NewDecoder(req.Body).Decode(&jReq); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	tags, folder, err := normalizeLabels(jReq.Tags, jReq.Folder)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	link, err := h.Storage.GetLink(ctx, urlKey)
+	if storage.IsErrorType(err, "not found") {
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if allowed, err := h.allows(ctx, userID, link.UserID, storage.RoleEditor); err != nil || !allowed {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// The link keeps its owner, who may be a workspace rather than the user
+	err = h.Storage.SetLinkLabels(ctx, link.UserID, urlKey, tags, folder)
+	if storage.IsErrorType(err, "not found") {
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, http.StatusOK, models.JSONLabelsReq{Tags: tags, Folder: folder})
+}
+
+// GetUserTags - lists the tags of the acting owner's links with the number of links that have them
+func (h *Handlers) GetUserTags(res http.ResponseWriter, req *http.Request) {
+	if _, err := getUserIDFromContext(req); err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ownerID, ok := h.actingOwner(res, req, storage.RoleViewer)
+	if !ok {
+		return
+	}
+
+	tags, err := h.Storage.GetUserTags(req.Context(), ownerID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, http.StatusOK, tags)
+}
+
+// RenameTag - renames the tag on all links of the acting owner. Renaming to an existing tag merges the two.
+func (h *Handlers) RenameTag(res http.ResponseWriter, req *http.Request) {
+	if _, err := getUserIDFromContext(req); err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ownerID, ok := h.actingOwner(res, req, storage.RoleEditor)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	// The router matches the escaped path, so the tag may come escaped
+	tag, err := url.PathUnescape(chi.URLParam(req, "tag"))
+	if err != nil {
+		http.Error(res, "Invalid tag", http.StatusBadRequest)
+		return
+	}
+	from, err := normalizeTag(tag)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := normalizeTag(body.Name)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	renamed, err := h.Storage.RenameTag(req.Context(), ownerID, from, to)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if renamed == 0 {
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, nil)
+
+	r := chi.NewRouter()
+	r.Post("/api/shorten", h.ShortenURL)
+	r.Post("/api/shorten/batch", h.ShortenBatchURL)
+	r.Get("/api/user/urls", h.GetUserURL)
+	r.Put("/api/user/urls/{urlKey}/labels", h.SetLinkLabels)
+	r.Get("/api/user/tags", h.GetUserTags)
+	r.Put("/api/user/tags/{tag}", h.RenameTag)
+
+	require.Equal(t, 201, serve(t, r, "POST", "/api/shorten", "user", `{"url":"https://a.example.com","tags":[" Spring ","sale","spring"],"folder":"campaigns"}`).Code)
+	require.Equal(t, 201, serve(t, r, "POST", "/api/shorten/batch", "user", `[{"correlation_id":"1","original_url":"https://b.example.com","tags":["promo"]}]`).Code)
+	assert.Equal(t, 400, serve(t, r, "POST", "/api/shorten", "user", `{"url":"https://c.example.com","tags":[""]}`).Code)
+
+	w := serve(t, r, "GET", "/api/user/urls?tag=SPRING&folder=campaigns", "user", "")
+	require.Equal(t, 200, w.Code)
+	var links []models.JSONUserRes
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &links))
+	require.Len(t, links, 1)
+	assert.Equal(t, []string{"sale", "spring"}, links[0].Tags)
+	assert.Equal(t, "campaigns", links[0].Folder)
+
+	key := expectedKey("https://b.example.com")
+	assert.Equal(t, 403, serve(t, r, "PUT", "/api/user/urls/"+key+"/labels", "intruder", `{"tags":["mine"]}`).Code)
+	assert.Equal(t, 200, serve(t, r, "PUT", "/api/user/urls/"+key+"/labels", "user", `{"tags":["promo","Sale"],"folder":"campaigns"}`).Code)
+
+	assert.Equal(t, 204, serve(t, r, "PUT", "/api/user/tags/promo", "user", `{"name":"spring"}`).Code)
+	assert.Equal(t, 404, serve(t, r, "PUT", "/api/user/tags/promo", "user", `{"name":"spring"}`).Code)
+
+	w = serve(t, r, "GET", "/api/user/tags", "user", "")
+	require.Equal(t, 200, w.Code)
+	var tags []models.TagCount
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tags))
+	assert.Equal(t, []models.TagCount{{Tag: "sale", Count: 2}, {Tag: "spring", Count: 2}}, tags)
+}
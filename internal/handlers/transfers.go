@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"shorter/internal/config"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"strings"
+)
+
+// TransferUserURLs - hands the links of the acting owner to a registered user or a workspace, all of them or none.
+// Only the owners of a workspace can give its links away, and a workspace takes links from its editors.
+func (h *Handlers) TransferUserURLs(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	userID, err := getUserIDFromContext(req)
+	if err != nil || userID == "" {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	fromID, ok := h.actingOwner(res, req, storage.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var jReq models.JSONTransferReq
+	if err := json.NewDecoder(req.Body).Decode(&jReq); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	toID := strings.TrimSpace(jReq.To)
+	if toID == "" || toID == fromID {
+		http.Error(res, "The links should go to another user or workspace", http.StatusBadRequest)
+		return
+	}
+	if len(jReq.Keys) == 0 {
+		http.Error(res, "No keys to transfer", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(toID, workspacePrefix) {
+		allowed, err := h.allows(ctx, userID, toID, storage.RoleEditor)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			return
+		}
+	} else {
+		// The links of an anonymous identity would be lost, so they only go to the registered accounts
+		_, err := h.Storage.GetUser(ctx, toID)
+		if storage.IsErrorType(err, "not found") {
+			http.Error(res, "The target user is not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := h.Storage.TransferLinks(ctx, fromID, toID, jReq.Keys, userID); err != nil {
+		var storageErr *storage.StorageError
+		if !errors.As(err, &storageErr) {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch storageErr.Type {
+		case "not found":
+			http.Error(res, "Not found: "+storageErr.ShortURL, http.StatusNotFound)
+		case "deleted":
+			http.Error(res, "The link is deleted: "+storageErr.ShortURL, http.StatusGone)
+		case "already exists":
+			http.Error(res, "The URL is already shortened: "+config.AppConfig.ResultHost+"/"+storageErr.ShortURL, http.StatusConflict)
+		default:
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// GetLinkTransfers - shows the owner changes of the link to those who can see the link
+func (h *Handlers) GetLinkTransfers(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	urlKey := chi.URLParam(req, "urlKey")
+
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	link, err := h.Storage.GetLink(ctx, urlKey)
+	if storage.IsErrorType(err, "not found") {
+		http.Error(res, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if allowed, err := h.allows(ctx, userID, link.UserID, storage.RoleViewer); err != nil || !allowed {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	transfers, err := h.Storage.GetLinkTransfers(ctx, urlKey)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, http.StatusOK, transfers)
+}
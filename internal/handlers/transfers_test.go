@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"testing"
+)
+
+func TestTransferUserURLs(t *testing.T) {
+	ctx := context.Background()
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, nil, nil, nil)
+
+	r := chi.NewRouter()
+	r.Post("/api/user/urls/transfer", h.TransferUserURLs)
+	r.Get("/api/user/urls/{urlKey}/transfers", h.GetLinkTransfers)
+
+	ws := models.Workspace{ID: "ws_team", Name: "team", Members: []models.WorkspaceMember{
+		{UserID: "alice", Role: storage.RoleOwner},
+		{UserID: "bob", Role: storage.RoleEditor},
+		{UserID: "carol", Role: storage.RoleViewer},
+	}}
+	require.NoError(t, memStorage.CreateWorkspace(ctx, ws))
+	require.NoError(t, memStorage.CreateUser(ctx, models.User{ID: "dave", Login: "dave"}))
+
+	first, err := memStorage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "bob"})
+	require.NoError(t, err)
+	second, err := memStorage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "carol"})
+	require.NoError(t, err)
+
+	body := func(to string, keys ...string) string {
+		out, _ := json.Marshal(models.JSONTransferReq{Keys: keys, To: to})
+		return string(out)
+	}
+
+	assert.Equal(t, 400, serve(t, r, "POST", "/api/user/urls/transfer", "bob", body("bob", first)).Code)
+	assert.Equal(t, 404, serve(t, r, "POST", "/api/user/urls/transfer", "bob", body("dave", first, second)).Code)
+	// The links only go to a registered user
+	assert.Equal(t, 404, serve(t, r, "POST", "/api/user/urls/transfer", "bob", body("eve", first)).Code)
+	// A viewer cannot put links into the workspace, an editor can
+	assert.Equal(t, 403, serve(t, r, "POST", "/api/user/urls/transfer", "carol", body(ws.ID, second)).Code)
+	assert.Equal(t, 204, serve(t, r, "POST", "/api/user/urls/transfer", "bob", body(ws.ID, first)).Code)
+
+	// Only an owner gives the links of the workspace away
+	assert.Equal(t, 403, serve(t, r, "POST", "/api/user/urls/transfer", "bob", body("bob", first), withWorkspace(ws.ID)).Code)
+	assert.Equal(t, 204, serve(t, r, "POST", "/api/user/urls/transfer", "alice", body("dave", first), withWorkspace(ws.ID)).Code)
+
+	assert.Equal(t, 403, serve(t, r, "GET", "/api/user/urls/"+first+"/transfers", "bob", "").Code)
+	w := serve(t, r, "GET", "/api/user/urls/"+first+"/transfers", "dave", "")
+	require.Equal(t, 200, w.Code)
+	var transfers []models.LinkTransfer
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &transfers))
+	require.Len(t, transfers, 2)
+	assert.Equal(t, "bob", transfers[0].ActorID)
+	assert.Equal(t, ws.ID, transfers[0].ToID)
+	assert.Equal(t, "alice", transfers[1].ActorID)
+	assert.Equal(t, "dave", transfers[1].ToID)
+}
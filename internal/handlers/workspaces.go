@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"strings"
+	"time"
+)
+
+// WorkspaceHeader - selects the workspace whose links the request works with, the user's own links by default
+const WorkspaceHeader = "X-Workspace-ID"
+
+// workspacePrefix - tells the workspace IDs from the user IDs
+const workspacePrefix = "ws_"
+
+// actingOwner - returns the owner of the links the request works with: the workspace from the header
+// or the user's own links. Responds with 403 if the user's role in the workspace does not allow the action.
+func (h *Handlers) actingOwner(res http.ResponseWriter, req *http.Request, required string) (string, bool) {
+	userID, _ := getUserIDFromContext(req)
+	workspaceID := strings.TrimSpace(req.Header.Get(WorkspaceHeader))
+	if workspaceID == "" || workspaceID == userID {
+		return userID, true
+	}
+
+	allowed, err := h.allows(req.Context(), userID, workspaceID, required)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	if !allowed {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return workspaceID, true
+}
+
+// allows - checks if the user can act on the links of the owner, which is either the user or a workspace
+func (h *Handlers) allows(ctx context.Context, userID, ownerID, required string) (bool, error) {
+	if userID == "" {
+		return false, nil
+	}
+	if ownerID == userID {
+		return true, nil
+	}
+	role, err := h.Storage.GetWorkspaceRole(ctx, ownerID, userID)
+	if storage.IsErrorType(err, "not found") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return storage.RoleAllows(role, required), nil
+}
+
+// CreateWorkspace - creates a workspace owned by the user
+func (h *Handlers) CreateWorkspace(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	userID, err := getUserIDFromContext(req)
+	if err != nil || userID == "" {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || len(body.Name) > 255 {
+		http.Error(res, "The name should be from 1 to 255 characters long", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	ws := models.Workspace{
+		ID:        workspacePrefix + hex.EncodeToString(b),
+		Name:      body.Name,
+		CreatedAt: now,
+		Members:   []models.WorkspaceMember{{UserID: userID, Role: storage.RoleOwner, AddedAt: now}},
+	}
+	if err := h.Storage.CreateWorkspace(ctx, ws); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(res, http.StatusCreated, models.JSONWorkspaceRes{ID: ws.ID, Name: ws.Name, Role: storage.RoleOwner, CreatedAt: ws.CreatedAt})
+}
+
+// GetWorkspaces - lists the workspaces the user is a member of
+func (h *Handlers) GetWorkspaces(res http.ResponseWriter, req *http.Request) {
+	userID, err := getUserIDFromContext(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	workspaces, err := h.Storage.GetUserWorkspaces(req.Context(), userID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, http.StatusOK, workspaces)
+}
+
+// GetWorkspaceMembers - lists the members to any member of the workspace
+func (h *Handlers) GetWorkspaceMembers(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	workspaceID := chi.URLParam(req, "workspaceID")
+	if _, ok := h.memberRole(res, req, workspaceID); !ok {
+		return
+	}
+
+	members, err := h.Storage.GetWorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, http.StatusOK, members)
+}
+
+// SetWorkspaceMember - adds a member or changes the role, only the owners can do it
+func (h *Handlers) SetWorkspaceMember(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	workspaceID := chi.URLParam(req, "workspaceID")
+	role, ok := h.memberRole(res, req, workspaceID)
+	if !ok {
+		return
+	}
+	if role != storage.RoleOwner {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(res, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if !storage.IsRole(body.Role) {
+		http.Error(res, "The role should be owner, editor or viewer", http.StatusBadRequest)
+		return
+	}
+
+	memberID := chi.URLParam(req, "userID")
+	_, err := h.Storage.GetUser(ctx, memberID)
+	if storage.IsErrorType(err, "not found") {
+		http.Error(res, "The user is not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	member := models.WorkspaceMember{UserID: memberID, Role: body.Role, AddedAt: time.Now().UTC()}
+	if err := h.Storage.SetWorkspaceMember(ctx, workspaceID, member); err != nil {
+		writeMembershipError(res, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveWorkspaceMember - removes a member, the owners can remove anyone and the others can leave
+func (h *Handlers) RemoveWorkspaceMember(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	workspaceID := chi.URLParam(req, "workspaceID")
+	memberID := chi.URLParam(req, "userID")
+	role, ok := h.memberRole(res, req, workspaceID)
+	if !ok {
+		return
+	}
+	if userID, _ := getUserIDFromContext(req); role != storage.RoleOwner && memberID != userID {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := h.Storage.RemoveWorkspaceMember(ctx, workspaceID, memberID); err != nil {
+		writeMembershipError(res, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// memberRole - returns the role of the user, responding with 404 to those who are not members
+func (h *Handlers) memberRole(res http.ResponseWriter, req *http.Request, workspaceID string) (string, bool) {
+	userID, _ := getUserIDFromContext(req)
+	role, err := h.Storage.GetWorkspaceRole(req.Context(), workspaceID, userID)
+	if storage.IsErrorType(err, "not found") {
+		http.Error(res, "Not found", http.StatusNotFound)
+		return "", false
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	return role, true
+}
+
+func writeMembershipError(res http.ResponseWriter, err error) {
+	switch {
+	case storage.IsErrorType(err, "not found"):
+		http.Error(res, "Not found", http.StatusNotFound)
+	case storage.IsErrorType(err, "last owner"):
+		http.Error(res, "The workspace should keep at least one owner", http.StatusConflict)
+	default:
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeJSON - responds with the value encoded as JSON
+func writeJSON(res http.ResponseWriter, status int, v any) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(out)
+}
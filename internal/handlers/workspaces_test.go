@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"shorter/internal/jobs"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestWorkspaces(t *testing.T) {
+	memStorage := storage.NewMemoryStorage(testKeys)
+	h := NewHandlers(memStorage, jobs.NewTracker(time.Hour), nil, nil)
+
+	r := chi.NewRouter()
+	r.Post("/api/workspaces", h.CreateWorkspace)
+	r.Get("/api/workspaces", h.GetWorkspaces)
+	r.Put("/api/workspaces/{workspaceID}/members/{userID}", h.SetWorkspaceMember)
+	r.Delete("/api/workspaces/{workspaceID}/members/{userID}", h.RemoveWorkspaceMember)
+	r.Post("/api/shorten", h.ShortenURL)
+	r.Get("/api/user/urls", h.GetUserURL)
+	r.Patch("/api/user/urls/{urlKey}", h.UpdateUserURL)
+	r.Delete("/api/user/urls", h.DeleteUserURL)
+
+	ctx := context.Background()
+	for _, login := range []string{"bob", "carol", "eve"} {
+		require.NoError(t, memStorage.CreateUser(ctx, models.User{ID: login, Login: login}))
+	}
+
+	w := serve(t, r, "POST", "/api/workspaces", "alice", `{"name":"marketing"}`)
+	require.Equal(t, 201, w.Code)
+	var ws models.JSONWorkspaceRes
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ws))
+	assert.Equal(t, storage.RoleOwner, ws.Role)
+
+	assert.Equal(t, 204, serve(t, r, "PUT", "/api/workspaces/"+ws.ID+"/members/bob", "alice", `{"role":"editor"}`).Code)
+	assert.Equal(t, 204, serve(t, r, "PUT", "/api/workspaces/"+ws.ID+"/members/carol", "alice", `{"role":"viewer"}`).Code)
+	assert.Equal(t, 400, serve(t, r, "PUT", "/api/workspaces/"+ws.ID+"/members/carol", "alice", `{"role":"admin"}`).Code)
+	assert.Equal(t, 404, serve(t, r, "PUT", "/api/workspaces/"+ws.ID+"/members/mallory", "alice", `{"role":"viewer"}`).Code)
+	assert.Equal(t, 403, serve(t, r, "PUT", "/api/workspaces/"+ws.ID+"/members/eve", "bob", `{"role":"owner"}`).Code)
+	assert.Equal(t, 404, serve(t, r, "PUT", "/api/workspaces/"+ws.ID+"/members/eve", "eve", `{"role":"owner"}`).Code)
+	assert.Equal(t, 409, serve(t, r, "DELETE", "/api/workspaces/"+ws.ID+"/members/alice", "alice", "").Code)
+
+	// An editor creates a link of the workspace, the other members see it
+	w = serve(t, r, "POST", "/api/shorten", "bob", `{"url":"https://team.example.com"}`, withWorkspace(ws.ID))
+	require.Equal(t, 201, w.Code)
+	key := expectedKey("https://team.example.com")
+
+	link, err := memStorage.GetLink(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, ws.ID, link.UserID)
+
+	w = serve(t, r, "GET", "/api/user/urls", "carol", "", withWorkspace(ws.ID))
+	require.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "https://team.example.com")
+	assert.Equal(t, 204, serve(t, r, "GET", "/api/user/urls", "bob", "").Code, "The workspace links are not personal")
+	assert.Equal(t, 403, serve(t, r, "GET", "/api/user/urls", "eve", "", withWorkspace(ws.ID)).Code)
+
+	// A viewer can not change the links
+	assert.Equal(t, 403, serve(t, r, "POST", "/api/shorten", "carol", `{"url":"https://other.example.com"}`, withWorkspace(ws.ID)).Code)
+	assert.Equal(t, 403, serve(t, r, "PATCH", "/api/user/urls/"+key, "carol", `{"url":"https://new.example.com"}`).Code)
+	assert.Equal(t, 403, serve(t, r, "DELETE", "/api/user/urls?wait=true", "carol", `["`+key+`"]`, withWorkspace(ws.ID)).Code)
+
+	// Any editor can change the links of the workspace
+	assert.Equal(t, 200, serve(t, r, "PATCH", "/api/user/urls/"+key, "alice", `{"url":"https://new.example.com"}`).Code)
+	w = serve(t, r, "DELETE", "/api/user/urls?wait=true", "alice", `["`+key+`"]`, withWorkspace(ws.ID))
+	require.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), storage.DeleteDeleted)
+
+	// A member can leave
+	assert.Equal(t, 204, serve(t, r, "DELETE", "/api/workspaces/"+ws.ID+"/members/carol", "carol", "").Code)
+	assert.Equal(t, 403, serve(t, r, "GET", "/api/user/urls", "carol", "", withWorkspace(ws.ID)).Code)
+}
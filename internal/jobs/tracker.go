@@ -0,0 +1,153 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"sync"
+	"time"
+)
+
+// Statuses of a deletion job
+const (
+	StatusQueued   = "queued"
+	StatusRunning  = "running"
+	StatusRetrying = "retrying" // the last attempt failed, the job stays in the queue
+	StatusDone     = "done"
+	StatusFailed   = "failed"
+)
+
+// Tracker keeps the progress of the deletion jobs in memory.
+// Finished jobs are forgotten after the retention period.
+type Tracker struct {
+	mu        sync.RWMutex
+	jobs      map[string]*models.DeletionJob
+	retention time.Duration
+}
+
+// NewTracker - constructor to create a new Tracker
+func NewTracker(retention time.Duration) *Tracker {
+	return &Tracker{
+		jobs:      make(map[string]*models.DeletionJob),
+		retention: retention,
+	}
+}
+
+// Create - registers a queued job for the keys of the user
+func (t *Tracker) Create(userID string, keys int) (models.DeletionJob, error) {
+	id, err := newJobID()
+	if err != nil {
+		return models.DeletionJob{}, err
+	}
+	job := &models.DeletionJob{
+		ID:        id,
+		UserID:    userID,
+		Status:    StatusQueued,
+		Total:     keys,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune()
+	t.jobs[id] = job
+	return *job, nil
+}
+
+// Get - returns a copy of the job
+func (t *Tracker) Get(id string) (models.DeletionJob, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	job, found := t.jobs[id]
+	if !found {
+		return models.DeletionJob{}, false
+	}
+	return copyJob(job), true
+}
+
+// Start - marks the job as being processed by the deletion worker
+func (t *Tracker) Start(id string) {
+	t.update(id, func(job *models.DeletionJob) {
+		job.Status = StatusRunning
+	})
+}
+
+// Finish - counts the outcomes of the keys and completes the job
+func (t *Tracker) Finish(id string, results []models.DeleteResult) {
+	t.update(id, func(job *models.DeletionJob) {
+		for _, result := range results {
+			switch result.Status {
+			case storage.DeleteDeleted:
+				job.Deleted++
+			case storage.DeleteNotFound:
+				job.NotFound++
+			case storage.DeleteNotOwned:
+				job.NotOwned++
+			case storage.DeleteAlreadyDeleted:
+				job.AlreadyDeleted++
+			}
+		}
+		job.Status = StatusDone
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+	})
+}
+
+// Retry - records the error of a failed attempt, the job will be tried again
+func (t *Tracker) Retry(id string, err error) {
+	t.update(id, func(job *models.DeletionJob) {
+		job.Status = StatusRetrying
+		job.Errors = append(job.Errors, err.Error())
+	})
+}
+
+// Fail - records the error and gives up on the job
+func (t *Tracker) Fail(id string, err error) {
+	t.update(id, func(job *models.DeletionJob) {
+		job.Status = StatusFailed
+		job.Errors = append(job.Errors, err.Error())
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+	})
+}
+
+// update - applies the change to the job if it is still tracked
+func (t *Tracker) update(id string, change func(job *models.DeletionJob)) {
+	if id == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if job, found := t.jobs[id]; found {
+		change(job)
+	}
+}
+
+// prune - forgets the jobs that finished before the retention period. The caller should hold the lock.
+func (t *Tracker) prune() {
+	before := time.Now().Add(-t.retention)
+	for id, job := range t.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(before) {
+			delete(t.jobs, id)
+		}
+	}
+}
+
+func copyJob(job *models.DeletionJob) models.DeletionJob {
+	c := *job
+	c.Errors = append([]string(nil), job.Errors...)
+	return c
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
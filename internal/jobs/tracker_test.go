@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"shorter/internal/models"
+	"shorter/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(time.Hour)
+
+	job, err := tracker.Create("user", 3)
+	require.NoError(t, err)
+	assert.Equal(t, StatusQueued, job.Status)
+
+	tracker.Start(job.ID)
+	tracker.Retry(job.ID, errors.New("connection refused"))
+
+	job, found := tracker.Get(job.ID)
+	require.True(t, found)
+	assert.Equal(t, StatusRetrying, job.Status)
+	assert.Equal(t, []string{"connection refused"}, job.Errors)
+
+	tracker.Finish(job.ID, []models.DeleteResult{
+		{Key: "a", Status: storage.DeleteDeleted},
+		{Key: "b", Status: storage.DeleteNotOwned},
+		{Key: "c", Status: storage.DeleteAlreadyDeleted},
+	})
+
+	job, _ = tracker.Get(job.ID)
+	assert.Equal(t, StatusDone, job.Status)
+	assert.Equal(t, 1, job.Deleted)
+	assert.Equal(t, 1, job.NotOwned)
+	assert.Equal(t, 1, job.AlreadyDeleted)
+	assert.NotNil(t, job.FinishedAt)
+
+	_, found = tracker.Get("missing")
+	assert.False(t, found)
+}
+
+func TestTracker_Prune(t *testing.T) {
+	tracker := NewTracker(0)
+
+	finished, _ := tracker.Create("user", 1)
+	tracker.Finish(finished.ID, nil)
+	pending, _ := tracker.Create("user", 1)
+
+	// Creating a job forgets the finished ones past the retention
+	_, _ = tracker.Create("user", 1)
+
+	_, found := tracker.Get(finished.ID)
+	assert.False(t, found)
+	_, found = tracker.Get(pending.ID)
+	assert.True(t, found)
+}
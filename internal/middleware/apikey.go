@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"shorter/internal/models"
+	"time"
+)
+
+// APIKeyPrefix - marks the bearer tokens that are API keys rather than JWTs
+const APIKeyPrefix = "shk_"
+
+// APIKeyStore - finds the API keys presented by the callers
+type APIKeyStore interface {
+	GetAPIKey(ctx context.Context, hash string) (models.APIKey, error)
+}
+
+// NewAPIKey - generates a key for the user and returns it with the secret, which is not stored anywhere
+func NewAPIKey(userID, name string) (models.APIKey, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	plain := APIKeyPrefix + secret
+
+	key := models.APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		Prefix:    plain[:len(APIKeyPrefix)+8],
+		Hash:      HashAPIKey(plain),
+		CreatedAt: time.Now().UTC(),
+	}
+	return key, plain, nil
+}
+
+// HashAPIKey - the form of the key that is stored. The secret is random enough, so no salt is needed.
+func HashAPIKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate a random value: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
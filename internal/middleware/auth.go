@@ -9,41 +9,67 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 	"log"
 	"net/http"
-	"time"
+	"strings"
 )
 
 type Claims struct {
 	jwt.RegisteredClaims
-	UserID string
+	UserID     string
+	Persistent bool `json:",omitempty"` // the identity was claimed and lives longer than an anonymous one
 }
 
 type contextKey string
 
 const (
 	UserIDKey  contextKey = "userID"
-	TokenExp              = time.Hour * 3
-	SecretKey             = "supersecretkey"
 	CookieName            = "jwt"
 )
 
-func WithAuth(next http.Handler) http.Handler {
+// WithAuth - identifies the user by the Authorization header or by the JWT cookie.
+// A browser without a valid cookie gets a new anonymous identity, while an invalid Authorization header is rejected.
+// A valid cookie is refreshed for the same user once it gets older than the refresh interval.
+func WithAuth(tokens *Tokens, apiKeys APIKeyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return withAuth(tokens, apiKeys, next)
+	}
+}
+
+func withAuth(tokens *Tokens, apiKeys APIKeyStore, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authRequired := r.RequestURI == "/api/user/urls" && r.Method == "GET"
+		authRequired := r.URL.Path == "/api/user/urls" && r.Method == "GET"
+
+		// Non-browser callers present their credentials in the header
+		if header := r.Header.Get("Authorization"); header != "" {
+			userID, err := getUserIDFromHeader(r.Context(), tokens, apiKeys, header)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			ctx := context.WithValue(r.Context(), UserIDKey, userID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
 
-		token := getJWTFromCookie(r)
-		userID, err := getUserID(token)
+		var userID string
+		claims, err := tokens.Parse(getJWTFromCookie(r))
 
-		if err != nil {
+		switch {
+		case err != nil:
 			userID = generateUserID()
-			token = buildJWTString(userID)
-
-			// Set new JWT in cookie
-			http.SetCookie(w, &http.Cookie{
-				Name:    CookieName,
-				Value:   token,
-				Path:    "/",
-				Expires: time.Now().Add(TokenExp),
-			})
+			if userID != "" {
+				if _, err := tokens.SetCookie(w, userID, false); err != nil {
+					log.Println(err)
+				}
+			}
+		case tokens.needsRefresh(claims):
+			// Slide the lifetime, so an active user keeps the identity
+			userID = claims.UserID
+			if _, err := tokens.SetCookie(w, userID, claims.Persistent); err != nil {
+				log.Println(err)
+			}
+		default:
+			userID = claims.UserID
 		}
 
 		// If authentication is required and there's still no valid user ID, return 401
@@ -70,23 +96,28 @@ func getJWTFromCookie(r *http.Request) string {
 	return cookie.Value
 }
 
-func getUserID(tokenString string) (string, error) {
-	if tokenString == "" {
-		return "", errors.New("token is empty")
+// getUserIDFromHeader - accepts "Bearer <JWT>" and "Bearer <API key>"
+func getUserIDFromHeader(ctx context.Context, tokens *Tokens, apiKeys APIKeyStore, header string) (string, error) {
+	scheme, token, _ := strings.Cut(strings.TrimSpace(header), " ")
+	token = strings.TrimSpace(token)
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errors.New("unsupported authorization scheme")
 	}
 
-	claims := &Claims{}
-
-	token, err := jwt.ParseWithClaims(tokenString, claims,
-		func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return []byte(SecretKey), nil
-		})
+	if strings.HasPrefix(token, APIKeyPrefix) {
+		key, err := apiKeys.GetAPIKey(ctx, HashAPIKey(token))
+		if err != nil {
+			return "", fmt.Errorf("invalid API key: %w", err)
+		}
+		return key.UserID, nil
+	}
 
-	if err != nil || !token.Valid {
-		return "", errors.New("invalid token")
+	claims, err := tokens.Parse(token)
+	if err != nil {
+		return "", err
+	}
+	if claims.UserID == "" {
+		return "", errors.New("the token has no user")
 	}
 	return claims.UserID, nil
 }
@@ -100,19 +131,3 @@ func generateUserID() string {
 	}
 	return hex.EncodeToString(b)
 }
-
-// BuildJWTString - creates JWT token
-func buildJWTString(userID string) string {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenExp)),
-		},
-		UserID: userID,
-	})
-
-	tokenString, err := token.SignedString([]byte(SecretKey))
-	if err != nil {
-		return ""
-	}
-	return tokenString
-}
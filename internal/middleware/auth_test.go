@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"shorter/internal/models"
+	"testing"
+	"time"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("new:secret2, old:secret1\nolder:secret0")
+	require.NoError(t, err)
+	assert.Equal(t, "new", keys.signingKID)
+	assert.Len(t, keys.secrets, 3)
+	assert.True(t, keys.Contains("secret0"))
+	assert.False(t, keys.Contains("other"))
+
+	// A comma that does not start a new pair is a part of the secret
+	keys, err = ParseKeys("new:a,b, old:c,d:e\nolder:f")
+	require.NoError(t, err)
+	assert.Equal(t, "a,b", string(keys.secrets["new"]))
+	assert.Equal(t, "c", string(keys.secrets["old"]))
+	assert.Equal(t, "e", string(keys.secrets["d"]))
+	assert.Equal(t, "f", string(keys.secrets["older"]))
+
+	for _, spec := range []string{"", "secret", "kid:", ":secret", "a:1,a:2", "new:secret,:other", "new:secret\nold:"} {
+		_, err := ParseKeys(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+var testPolicy = TokenPolicy{TTL: 24 * time.Hour, PersistentTTL: 365 * 24 * time.Hour, RefreshAfter: time.Hour}
+
+func newTestTokens(t *testing.T, spec string) *Tokens {
+	keys, err := ParseKeys(spec)
+	require.NoError(t, err)
+	return NewTokens(keys, testPolicy)
+}
+
+// issue - signs a token for the user as if it was issued at the given time
+func issue(t *testing.T, tokens *Tokens, userID string, issuedAt time.Time, persistent bool) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(testPolicy.TTL)),
+		},
+		UserID:     userID,
+		Persistent: persistent,
+	})
+	token.Header["kid"] = tokens.keys.signingKID
+	tokenString, err := token.SignedString(tokens.keys.secrets[tokens.keys.signingKID])
+	require.NoError(t, err)
+	return tokenString
+}
+
+func TestTokens_Rotation(t *testing.T) {
+	oldKeys := newTestTokens(t, "old:secret1")
+	rotated := newTestTokens(t, "new:secret2,old:secret1")
+	retired := newTestTokens(t, "new:secret2")
+
+	// The cookies issued before the rotation keep working until the old key is retired
+	token, _, err := oldKeys.Issue("user", false)
+	require.NoError(t, err)
+	claims, err := rotated.Parse(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", claims.UserID)
+
+	_, err = retired.Parse(token)
+	assert.Error(t, err)
+
+	token, _, err = rotated.Issue("user", false)
+	require.NoError(t, err)
+	claims, err = retired.Parse(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", claims.UserID)
+}
+
+func TestTokens_Forged(t *testing.T) {
+	tokens := newTestTokens(t, "current:secret")
+
+	// A token signed with a guessed secret under a valid kid should be rejected
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		UserID:           "victim",
+	})
+	forged.Header["kid"] = "current"
+	token, err := forged.SignedString([]byte("supersecretkey"))
+	require.NoError(t, err)
+
+	_, err = tokens.Parse(token)
+	assert.Error(t, err)
+}
+
+func TestWithAuth_SetsSignedCookie(t *testing.T) {
+	tokens := newTestTokens(t, "current:secret")
+
+	var userID string
+	handler := WithAuth(tokens, apiKeyMap{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ = r.Context().Value(UserIDKey).(string)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.True(t, cookies[0].HttpOnly)
+
+	// The issued cookie should identify the same user on the next request
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	issuedTo := userID
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NotEmpty(t, userID)
+	assert.Equal(t, issuedTo, userID)
+}
+
+func TestWithAuth_Refresh(t *testing.T) {
+	tokens := newTestTokens(t, "current:secret")
+
+	var userID string
+	handler := WithAuth(tokens, apiKeyMap{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ = r.Context().Value(UserIDKey).(string)
+	}))
+
+	send := func(token string) []*http.Cookie {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result().Cookies()
+	}
+
+	// A recent token is kept as it is
+	assert.Empty(t, send(issue(t, tokens, "user", time.Now(), false)))
+	assert.Equal(t, "user", userID)
+
+	// An older token is reissued for the same user and keeps being persistent
+	cookies := send(issue(t, tokens, "user", time.Now().Add(-2*time.Hour), true))
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "user", userID)
+	claims, err := tokens.Parse(cookies[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "user", claims.UserID)
+	assert.True(t, claims.Persistent)
+	assert.True(t, cookies[0].Expires.After(time.Now().Add(testPolicy.TTL)))
+
+	// An expired token can not be refreshed
+	cookies = send(issue(t, tokens, "user", time.Now().Add(-2*testPolicy.TTL), false))
+	require.Len(t, cookies, 1)
+	assert.NotEqual(t, "user", userID)
+}
+
+// apiKeyMap - the API keys by their hashes
+type apiKeyMap map[string]models.APIKey
+
+func (m apiKeyMap) GetAPIKey(ctx context.Context, hash string) (models.APIKey, error) {
+	key, found := m[hash]
+	if !found {
+		return models.APIKey{}, errors.New("not found")
+	}
+	return key, nil
+}
+
+func TestWithAuth_Header(t *testing.T) {
+	tokens := newTestTokens(t, "current:secret")
+	key, secret, err := NewAPIKey("deployer", "ci")
+	require.NoError(t, err)
+	apiKeys := apiKeyMap{key.Hash: key}
+	bearer, _, err := tokens.Issue("user", false)
+	require.NoError(t, err)
+
+	handler := WithAuth(tokens, apiKeys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value(UserIDKey).(string)
+		w.Write([]byte(userID))
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		code   int
+		userID string
+	}{
+		{name: "Bearer JWT", header: "Bearer " + bearer, code: 200, userID: "user"},
+		{name: "API key", header: "Bearer " + secret, code: 200, userID: "deployer"},
+		{name: "Lowercase scheme", header: "bearer " + secret, code: 200, userID: "deployer"},
+		{name: "Unknown API key", header: "Bearer " + APIKeyPrefix + "0000", code: 401},
+		{name: "Invalid JWT", header: "Bearer invalid", code: 401},
+		{name: "Unsupported scheme", header: "Basic dXNlcjpwYXNz", code: 401},
+		{name: "Empty token", header: "Bearer ", code: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/user/urls", nil)
+			req.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+			// The invalid credentials should not be replaced with a new identity
+			assert.Empty(t, w.Result().Cookies())
+			if tt.code == 200 {
+				assert.Equal(t, tt.userID, w.Body.String())
+			}
+		})
+	}
+}
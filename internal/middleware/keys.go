@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// KeySet - the secrets that sign and validate the JWT cookies, identified by the "kid" header.
+// The first key signs the new tokens, the others only validate the tokens issued before a rotation.
+type KeySet struct {
+	signingKID string
+	secrets    map[string][]byte
+}
+
+// kidPrefix - the "kid:" that starts a pair, a comma before it separates the pairs of a line, an empty kid is still a pair to reject
+var kidPrefix = regexp.MustCompile(`^\s*[A-Za-z0-9_.-]*:`)
+
+// splitKeys - splits the spec into the pairs: one per line, or several on a line separated by commas.
+// A comma that is not followed by a kid belongs to the secret.
+func splitKeys(spec string) []string {
+	var entries []string
+	for _, line := range strings.Split(spec, "\n") {
+		start := 0
+		for i := 0; i < len(line); i++ {
+			if line[i] == ',' && kidPrefix.MatchString(line[i+1:]) {
+				entries = append(entries, line[start:i])
+				start = i + 1
+			}
+		}
+		entries = append(entries, line[start:])
+	}
+	return entries
+}
+
+// ParseKeys - parses the "kid:secret" pairs, one per line or separated by commas, the first pair is the signing key
+func ParseKeys(spec string) (*KeySet, error) {
+	keys := &KeySet{secrets: make(map[string][]byte)}
+
+	for _, entry := range splitKeys(spec) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, secret, found := strings.Cut(entry, ":")
+		kid, secret = strings.TrimSpace(kid), strings.TrimSpace(secret)
+		switch {
+		case !found:
+			return nil, errors.New("the JWT key should look like kid:secret")
+		case kid == "":
+			return nil, errors.New("the JWT key has an empty kid")
+		case secret == "":
+			return nil, fmt.Errorf("the JWT key %q has an empty secret", kid)
+		}
+		if _, exists := keys.secrets[kid]; exists {
+			return nil, fmt.Errorf("the JWT key %q is defined twice", kid)
+		}
+		if keys.signingKID == "" {
+			keys.signingKID = kid
+		}
+		keys.secrets[kid] = []byte(secret)
+	}
+
+	if keys.signingKID == "" {
+		return nil, errors.New("no JWT keys are configured")
+	}
+	return keys, nil
+}
+
+// Contains - checks if any key uses the secret
+func (k *KeySet) Contains(secret string) bool {
+	for _, s := range k.secrets {
+		if string(s) == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup - returns the secret of the key, a token without kid is checked with the signing key
+func (k *KeySet) lookup(kid string) ([]byte, error) {
+	if kid == "" {
+		kid = k.signingKID
+	}
+	secret, found := k.secrets[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return secret, nil
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"net/http"
+	"time"
+)
+
+// TokenPolicy - how long the JWT cookies live. The lifetime slides: a token that is older
+// than RefreshAfter is reissued for the same user, so only an idle user loses the identity.
+type TokenPolicy struct {
+	TTL           time.Duration // the lifetime of an anonymous identity since the last refresh
+	PersistentTTL time.Duration // the lifetime of a claimed identity since the last refresh
+	RefreshAfter  time.Duration
+}
+
+// Tokens - issues and validates the JWTs of the users
+type Tokens struct {
+	keys   *KeySet
+	policy TokenPolicy
+}
+
+func NewTokens(keys *KeySet, policy TokenPolicy) *Tokens {
+	return &Tokens{keys: keys, policy: policy}
+}
+
+// Issue - signs a token for the user with the signing key and returns it with its expiry time
+func (t *Tokens) Issue(userID string, persistent bool) (string, time.Time, error) {
+	ttl := t.policy.TTL
+	if persistent {
+		ttl = t.policy.PersistentTTL
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		UserID:     userID,
+		Persistent: persistent,
+	})
+	token.Header["kid"] = t.keys.signingKID
+
+	tokenString, err := token.SignedString(t.keys.secrets[t.keys.signingKID])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign the token: %w", err)
+	}
+	return tokenString, expiresAt, nil
+}
+
+// SetCookie - issues a token for the user and sends it in the cookie
+func (t *Tokens) SetCookie(w http.ResponseWriter, userID string, persistent bool) (time.Time, error) {
+	token, expiresAt, err := t.Issue(userID, persistent)
+	if err != nil {
+		return time.Time{}, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return expiresAt, nil
+}
+
+// ClearCookie - makes the browser forget the token, so the next request gets a new anonymous identity
+func (t *Tokens) ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Parse - validates the token with the key named by its kid, a token without kid is checked with the signing key
+func (t *Tokens) Parse(tokenString string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, errors.New("token is empty")
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims,
+		func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			kid, _ := token.Header["kid"].(string)
+			return t.keys.lookup(kid)
+		})
+
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// needsRefresh - checks if the token was issued long enough ago to be reissued
+func (t *Tokens) needsRefresh(claims *Claims) bool {
+	// The tokens issued before the sliding refresh have no issue time
+	if claims.IssuedAt == nil {
+		return true
+	}
+	return time.Since(claims.IssuedAt.Time) >= t.policy.RefreshAfter
+}
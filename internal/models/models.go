@@ -1,9 +1,18 @@
 package models
 
+import "time"
+
 type JSONReq struct {
-	URL         string `json:"url,omitempty"`
-	CorrID      string `json:"correlation_id,omitempty"`
-	OriginalURL string `json:"original_url,omitempty"`
+	URL         string     `json:"url,omitempty"`
+	CorrID      string     `json:"correlation_id,omitempty"`
+	OriginalURL string     `json:"original_url,omitempty"`
+	Alias       string     `json:"alias,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	TTL         int64      `json:"ttl,omitempty"` // seconds
+	Tags        []string   `json:"tags,omitempty"`
+	Folder      string     `json:"folder,omitempty"`
+	// NormalizedURL - the canonical form of OriginalURL, set by the handlers
+	NormalizedURL string `json:"-"`
 }
 
 type JSONRes struct {
@@ -14,12 +23,201 @@ type JSONRes struct {
 }
 
 type JSONUserRes struct {
-	ShortURL    string `json:"short_url,omitempty"`
-	OriginalURL string `json:"original_url,omitempty"`
-	UserID      string `json:"-"`
+	ShortURL    string     `json:"short_url,omitempty"`
+	OriginalURL string     `json:"original_url,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	State       string     `json:"state,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Folder      string     `json:"folder,omitempty"`
+	UserID      string     `json:"-"`
 }
 
 type KeysToDelete struct {
-	Keys   []string
-	UserID string
+	Keys   []string `json:"keys"`
+	UserID string   `json:"user_id"`
+	JobID  string   `json:"job_id,omitempty"` // the deletion job that tracks the request, if any
+}
+
+// PendingDeletion - a deletion request waiting in the queue and its failed attempts
+type PendingDeletion struct {
+	ID            int64        `json:"id"`
+	Item          KeysToDelete `json:"item"`
+	Attempts      int          `json:"attempts"`
+	NextAttemptAt time.Time    `json:"next_attempt_at"`
+	LastError     string       `json:"last_error,omitempty"`
+	DeadFlag      bool         `json:"dead,omitempty"` // moved to the dead letters after too many failures
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// DeleteResult - the outcome of deleting a single key
+type DeleteResult struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+}
+
+// Link - a URL to be stored. If ShortURL is set, it is used as a custom alias
+// instead of the generated key. The duplicates of a user's URL are found by
+// NormalizedURL, while the redirect goes to OriginalURL as it was given.
+type Link struct {
+	ShortURL      string
+	OriginalURL   string
+	NormalizedURL string
+	UserID        string
+	ExpiresAt     *time.Time
+	DeletedFlag   bool
+	DeletedAt     *time.Time
+	ExpiredFlag   bool
+	CreatedAt     time.Time // set by the storage
+	Tags          []string  // normalized and sorted
+	Folder        string
+}
+
+// DeletionJob - the progress of an asynchronous deletion request
+type DeletionJob struct {
+	ID             string     `json:"id"`
+	Status         string     `json:"status"`
+	Total          int        `json:"total"`
+	Deleted        int        `json:"deleted"`
+	NotFound       int        `json:"not_found"`
+	NotOwned       int        `json:"not_owned"`
+	AlreadyDeleted int        `json:"already_deleted"`
+	Errors         []string   `json:"errors,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	UserID         string     `json:"-"`
+}
+
+// LinkChange - a previous destination of a link and the time it was replaced
+type LinkChange struct {
+	OriginalURL string    `json:"original_url"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+// JSONLinkRes - a link with the history of its destinations, the oldest first
+type JSONLinkRes struct {
+	ShortURL    string       `json:"short_url"`
+	OriginalURL string       `json:"original_url"`
+	History     []LinkChange `json:"history"`
+}
+
+// Click - a single redirect through a short link
+type Click struct {
+	ShortURL  string    `json:"short_url"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"` // anonymised
+}
+
+type StatsBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int       `json:"clicks"`
+}
+
+type LinkStats struct {
+	ShortURL string        `json:"short_url"`
+	Total    int           `json:"total"`
+	Daily    []StatsBucket `json:"daily"`
+	Hourly   []StatsBucket `json:"hourly"`
+}
+
+// APIKey - a long-lived credential of a user. Only the hash of the secret is stored.
+type APIKey struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"` // the beginning of the secret that helps to recognize the key
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// JSONAPIKeyRes - an API key as shown to its owner, the secret is returned only once on creation
+type JSONAPIKeyRes struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Key       string     `json:"key,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Session - the identity the auth cookie was issued for
+type Session struct {
+	UserID     string    `json:"user_id"`
+	Persistent bool      `json:"persistent"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// User - a registered account that owns the links of its UserID
+type User struct {
+	ID           string    `json:"id"`
+	Login        string    `json:"login"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// JSONAuthReq - the credentials of the register and login requests
+type JSONAuthReq struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// Workspace - a group of users that share the links it owns. The links of a workspace
+// have its ID in place of the UserID, while a user's own links form the personal workspace.
+type Workspace struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	CreatedAt time.Time         `json:"created_at"`
+	Members   []WorkspaceMember `json:"members,omitempty"`
+}
+
+type WorkspaceMember struct {
+	UserID  string    `json:"user_id"`
+	Role    string    `json:"role"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// JSONWorkspaceRes - a workspace with the role of the user who asks for it
+type JSONWorkspaceRes struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LinkTransfer - a change of the link's owner, kept for the audit
+type LinkTransfer struct {
+	FromID        string    `json:"from"`
+	ToID          string    `json:"to"`
+	ActorID       string    `json:"by"`
+	TransferredAt time.Time `json:"transferred_at"`
+}
+
+// JSONTransferReq - the keys to hand over and the user or workspace that gets them
+type JSONTransferReq struct {
+	Keys []string `json:"keys"`
+	To   string   `json:"to"`
+}
+
+// JSONLabelsReq - the tags and the folder that replace those of a link
+type JSONLabelsReq struct {
+	Tags   []string `json:"tags"`
+	Folder string   `json:"folder"`
+}
+
+// TagCount - a tag and the number of the owner's links that have it
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// ImportResult - the outcome of a row of the import, either the short URL or the error
+type ImportResult struct {
+	Line     int    `json:"line"`
+	CorrID   string `json:"correlation_id,omitempty"`
+	ShortURL string `json:"short_url,omitempty"`
+	Error    string `json:"error,omitempty"`
 }
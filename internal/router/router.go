@@ -13,19 +13,44 @@ func NewRouter(h *handlers.Handlers) http.Handler {
 	// Add middleware
 	r.Use(middleware.WithLogging)
 	r.Use(middleware.WithGzip)
-	r.Use(middleware.WithAuth)
+	r.Use(middleware.WithAuth(h.Tokens, h.Storage))
 
 	// Add routes
 	r.Post("/", h.PostURL)
 	r.Post("/api/shorten/batch", h.ShortenBatchURL)
+	r.Post("/api/shorten/import", h.ImportURLs)
 	r.Post("/api/shorten", h.ShortenURL)
+	r.Post("/api/user/urls/restore", h.RestoreUserURL)
+	r.Post("/api/user/urls/transfer", h.TransferUserURLs)
+	r.Post("/api/user/keys", h.CreateAPIKey)
+	r.Post("/api/user/claim", h.ClaimUser)
+	r.Post("/api/auth/register", h.Register)
+	r.Post("/api/auth/login", h.Login)
+	r.Post("/api/auth/logout", h.Logout)
+	r.Post("/api/workspaces", h.CreateWorkspace)
 
 	r.Get("/ping", h.IsAvailable)
 	r.Get("/api/user/urls", h.GetUserURL)
+	r.Get("/api/user/urls/trash", h.GetUserTrash)
+	r.Get("/api/user/deletions/{jobID}", h.GetDeletionJob)
+	r.Get("/api/user/keys", h.GetAPIKeys)
+	r.Get("/api/user/tags", h.GetUserTags)
+	r.Get("/api/workspaces", h.GetWorkspaces)
+	r.Get("/api/workspaces/{workspaceID}/members", h.GetWorkspaceMembers)
+	r.Get("/api/user/urls/{urlKey}/stats", h.GetLinkStats)
+	r.Get("/api/user/urls/{urlKey}/transfers", h.GetLinkTransfers)
 	r.Get("/{urlKey}", h.GetURL)
 	r.Get("/", h.GetURL)
 
+	r.Patch("/api/user/urls/{urlKey}", h.UpdateUserURL)
+
+	r.Put("/api/user/urls/{urlKey}/labels", h.SetLinkLabels)
+	r.Put("/api/user/tags/{tag}", h.RenameTag)
+	r.Put("/api/workspaces/{workspaceID}/members/{userID}", h.SetWorkspaceMember)
+
 	r.Delete("/api/user/urls", h.DeleteUserURL)
+	r.Delete("/api/user/keys/{keyID}", h.RevokeAPIKey)
+	r.Delete("/api/workspaces/{workspaceID}/members/{userID}", h.RemoveWorkspaceMember)
 
 	return r
 }
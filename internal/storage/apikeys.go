@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"shorter/internal/models"
+	"sort"
+	"time"
+)
+
+// APIKeyStorer keeps the API keys of the users. The keys are looked up by the hash of the secret.
+type APIKeyStorer interface {
+	CreateAPIKey(ctx context.Context, key models.APIKey) error
+	// GetAPIKey - returns the active key with the given hash, a revoked key is not found
+	GetAPIKey(ctx context.Context, hash string) (models.APIKey, error)
+	GetUserAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error)
+	// RevokeAPIKey - disables the user's key, revoking it again has no effect
+	RevokeAPIKey(ctx context.Context, userID string, id string) error
+}
+
+// apiKeyList - the API keys kept in memory by the memory and file storages.
+// The caller should hold the lock that guards the list.
+type apiKeyList struct {
+	byID   map[string]*models.APIKey
+	byHash map[string]*models.APIKey
+}
+
+func newAPIKeyList() *apiKeyList {
+	return &apiKeyList{
+		byID:   make(map[string]*models.APIKey),
+		byHash: make(map[string]*models.APIKey),
+	}
+}
+
+func (l *apiKeyList) add(key models.APIKey) error {
+	if _, found := l.byID[key.ID]; found {
+		return NewStorageError("already exists", "", "", fmt.Errorf("the API key %s already exists", key.ID))
+	}
+	if _, found := l.byHash[key.Hash]; found {
+		return NewStorageError("already exists", "", "", fmt.Errorf("the API key secret is already used"))
+	}
+	l.byID[key.ID] = &key
+	l.byHash[key.Hash] = &key
+	return nil
+}
+
+func (l *apiKeyList) get(hash string) (models.APIKey, error) {
+	key, found := l.byHash[hash]
+	if !found || key.RevokedAt != nil {
+		return models.APIKey{}, NewStorageError("not found", "", "", fmt.Errorf("the API key is not found"))
+	}
+	return *key, nil
+}
+
+// user - returns the keys of the user, the oldest first
+func (l *apiKeyList) user(userID string) []models.APIKey {
+	keys := []models.APIKey{}
+	for _, key := range l.byID {
+		if key.UserID == userID {
+			keys = append(keys, *key)
+		}
+	}
+	sortAPIKeys(keys)
+	return keys
+}
+
+func (l *apiKeyList) all() []models.APIKey {
+	keys := make([]models.APIKey, 0, len(l.byID))
+	for _, key := range l.byID {
+		keys = append(keys, *key)
+	}
+	sortAPIKeys(keys)
+	return keys
+}
+
+// revoke - returns false if the key was already revoked
+func (l *apiKeyList) revoke(userID string, id string) (bool, error) {
+	key, found := l.byID[id]
+	if !found || key.UserID != userID {
+		return false, NewStorageError("not found", "", "", fmt.Errorf("the API key %s is not found", id))
+	}
+	if key.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	key.RevokedAt = &now
+	return true, nil
+}
+
+func sortAPIKeys(keys []models.APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+}
@@ -3,12 +3,17 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5/pgtype"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"log"
 	"shorter/internal/config"
 	"shorter/internal/models"
 	"shorter/internal/urlkey"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,9 +21,10 @@ import (
 type DBStorage struct {
 	db         *sql.DB
 	connection string
+	keys       urlkey.KeyGenerator
 }
 
-func NewDBStorage(connection string) (*DBStorage, error) {
+func NewDBStorage(connection string, keys urlkey.KeyGenerator) (*DBStorage, error) {
 	db, err := sql.Open("pgx", connection)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %s", connection)
@@ -32,26 +38,39 @@ func NewDBStorage(connection string) (*DBStorage, error) {
 	return &DBStorage{
 		connection: connection,
 		db:         db,
+		keys:       keys,
 	}, nil
 }
 
-// Migrate - creates the tables if they don't exist
+// Migrate - applies the pending schema migrations
 func (storage *DBStorage) Migrate() error {
+	migrator, err := NewMigrator(storage.db, storage.keys)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up(context.Background(), 0)
+	if err != nil {
+		return fmt.Errorf("failed to migrate: %w", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s\n", m.Version, m.Name)
+	}
+	return nil
+}
 
-	query := `CREATE TABLE IF NOT EXISTS Links (
-        ID SERIAL PRIMARY KEY,
-        UserID VARCHAR(128) NULL,
-        CorrelationID VARCHAR(128) NULL,
-        ShortURL VARCHAR(128) NOT NULL,
-        OriginalURL VARCHAR(512) NOT NULL UNIQUE,
-        DeletedFlag BOOLEAN DEFAULT FALSE,
-        AddedDate TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-    )`
+// DB - returns the connection pool, e.g. for the migrate command
+func (storage *DBStorage) DB() *sql.DB {
+	return storage.db
+}
 
-	_, err := storage.db.Exec(query)
+// SeedKeys - lets a sequence based key generator continue after the stored records
+func (storage *DBStorage) SeedKeys(ctx context.Context) error {
+	var maxID int64
+	err := storage.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(ID), 0) FROM Links`).Scan(&maxID)
 	if err != nil {
-		return fmt.Errorf("failed to create migration table: %s", err)
+		return fmt.Errorf("failed to count links: %s", err)
 	}
+	urlkey.Seed(storage.keys, uint64(maxID))
 	return nil
 }
 
@@ -60,39 +79,68 @@ func (storage *DBStorage) IsAvailable() bool {
 	return err == nil
 }
 
-func (storage *DBStorage) Set(ctx context.Context, OriginalURL string, userID string) (string, error) {
+// execer - the common part of *sql.DB and *sql.Tx used by insertLink
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
 
-	query := `INSERT INTO Links (ShortURL, OriginalURL, UserID)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (OriginalURL)
-		DO NOTHING`
+func (storage *DBStorage) Set(ctx context.Context, link models.Link) (string, error) {
+	return storage.insertLink(ctx, storage.db, link)
+}
 
-	urlKey := urlkey.GenerateSlug(OriginalURL)
-	if urlKey == "" {
-		return "", fmt.Errorf("the short url is empty")
+// insertLink - stores the URL under its alias or a new unique key.
+// If the user already stored the URL, its existing key is returned with the "already exists" error.
+func (storage *DBStorage) insertLink(ctx context.Context, db execer, link models.Link) (string, error) {
+	query := `INSERT INTO Links (ShortURL, OriginalURL, NormalizedURL, UserID, ExpiresAt, Tags, Folder)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		ON CONFLICT DO NOTHING`
+	normalizedURL := dedupURL(link.OriginalURL, link.NormalizedURL)
+	tags := link.Tags
+	if tags == nil {
+		tags = []string{}
 	}
 
-	result, err := storage.db.ExecContext(ctx, query, urlKey, OriginalURL, userID)
-	if err != nil {
-		return "", NewStorageError("failed to insert", OriginalURL, urlKey, err)
-	}
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return "", fmt.Errorf("failed to get affected rows: %s", err)
-	}
-	if rowsAffected == 0 {
-		return urlKey, NewStorageError("already exists", OriginalURL, urlKey, err)
+	for attempt := 0; attempt < urlkey.MaxAttempts; attempt++ {
+		urlKey := link.ShortURL
+		if urlKey == "" {
+			generated, err := storage.keys.Generate(normalizedURL, attempt)
+			if err != nil || generated == "" {
+				return "", fmt.Errorf("failed to generate the short url: %v", err)
+			}
+			urlKey = generated
+		}
+
+		result, err := db.ExecContext(ctx, query, urlKey, link.OriginalURL, normalizedURL, link.UserID, link.ExpiresAt, tags, link.Folder)
+		if err != nil {
+			return "", NewStorageError("failed to insert", link.OriginalURL, urlKey, err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return "", fmt.Errorf("failed to get affected rows: %s", err)
+		}
+		if rowsAffected > 0 {
+			return urlKey, nil
+		}
+
+		// Nothing was inserted: either the URL is already stored or the key is taken
+		var storedKey string
+		err = db.QueryRowContext(ctx, `SELECT ShortURL FROM Links WHERE NormalizedURL = $1 AND UserID = $2`,
+			normalizedURL, link.UserID).Scan(&storedKey)
+		if err == nil {
+			return storedKey, NewStorageError("already exists", link.OriginalURL, storedKey, nil)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", NewStorageError("failed to select", link.OriginalURL, urlKey, err)
+		}
+		if link.ShortURL != "" {
+			return "", NewStorageError("alias taken", link.OriginalURL, urlKey, nil)
+		}
 	}
-	return urlKey, nil
+	return "", NewStorageError("key collision", link.OriginalURL, "", errors.New("no free key found"))
 }
 
 func (storage *DBStorage) SetBatch(ctx context.Context, jReqBatch []models.JSONReq, userID string) ([]models.JSONRes, error) {
-
-	query := `INSERT INTO Links (ShortURL, OriginalURL, UserID)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (OriginalURL)
-		DO NOTHING`
-
 	jResBatch := []models.JSONRes{}
 
 	// Start a new transaction
@@ -103,29 +151,26 @@ func (storage *DBStorage) SetBatch(ctx context.Context, jReqBatch []models.JSONR
 	//Flag for the DB Transaction rollback
 	rollback := true
 
-	stmt, err := tx.Prepare(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare statement: %s", err)
-	}
-
-	// Ensure cleanup and rollback in case of error
+	// Ensure rollback in case of error
 	defer func() {
-		if stmt != nil {
-			stmt.Close()
-		}
 		if rollback {
 			tx.Rollback()
 		}
 	}()
 
 	for _, el := range jReqBatch {
-		urlKey := urlkey.GenerateSlug(el.OriginalURL)
-		if urlKey == "" {
-			return nil, fmt.Errorf("the urlKey for Original Url: %s is empty", el.OriginalURL)
+		link := models.Link{
+			ShortURL:      el.Alias,
+			OriginalURL:   el.OriginalURL,
+			NormalizedURL: el.NormalizedURL,
+			UserID:        userID,
+			ExpiresAt:     el.ExpiresAt,
+			Tags:          el.Tags,
+			Folder:        el.Folder,
 		}
-		_, err := stmt.ExecContext(ctx, urlKey, el.OriginalURL, userID)
-		if err != nil {
-			return nil, NewStorageError("failed to insert", urlKey, el.OriginalURL, err)
+		urlKey, err := storage.insertLink(ctx, tx, link)
+		if err != nil && !IsErrorType(err, "already exists") {
+			return nil, err
 		}
 		row := models.JSONRes{
 			CorrID:      el.CorrID,
@@ -146,124 +191,967 @@ func (storage *DBStorage) SetBatch(ctx context.Context, jReqBatch []models.JSONR
 	return jResBatch, nil
 }
 
-func (storage *DBStorage) DeleteBatch(ctx context.Context, keysToDelete []models.KeysToDelete) (bool, error) {
+func (storage *DBStorage) DeleteBatch(ctx context.Context, keysToDelete []models.KeysToDelete) ([]models.DeleteResult, error) {
 	if len(keysToDelete) == 0 {
-		return false, errors.New("no URLs provided for deletion")
+		return nil, errors.New("no URLs provided for deletion")
 	}
 
-	successfulDeletes := 0
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
 
-	// Group keys by UserID
-	keyGroups := make(map[string][]string)
+	results := []models.DeleteResult{}
 	for _, item := range keysToDelete {
-		keyGroups[item.UserID] = append(keyGroups[item.UserID], item.Keys...)
-	}
-	// Process each UserID separately
-	for userID, keys := range keyGroups {
-		if len(keys) == 0 {
+		if len(item.Keys) == 0 {
 			continue
 		}
 
-		// Generate placeholders: $1, $2, ..., $N
-		placeholders := make([]string, len(keys))
-		args := make([]interface{}, len(keys)+1) // +1 for UserID
-
-		for i, key := range keys {
-			placeholders[i] = fmt.Sprintf("$%d", i+1)
-			args[i] = key
-		}
-
-		// Append userID as the last parameter
-		args[len(keys)] = userID
-		userIDPlaceholder := fmt.Sprintf("$%d", len(keys)+1)
-
-		// Construct SQL query
-		query := fmt.Sprintf(
-			`UPDATE Links SET DeletedFlag = true WHERE ShortURL IN (%s) AND UserID = %s`,
-			strings.Join(placeholders, ","), userIDPlaceholder)
-
-		tx, err := storage.db.Begin()
+		// Lock the rows, so the outcomes match what the update does
+		links, err := lockLinks(ctx, tx, item.Keys)
 		if err != nil {
-			return false, fmt.Errorf("failed to begin transaction: %s", err)
+			return nil, err
 		}
 
-		// Ensure rollback only if an error occurs
-		rollback := true
-		defer func() {
-			if rollback {
-				tx.Rollback()
+		toDelete := []string{}
+		for _, key := range item.Keys {
+			link, found := links[key]
+			status := deleteOutcome(found, link.UserID == item.UserID, link.DeletedFlag)
+			if status == DeleteDeleted {
+				toDelete = append(toDelete, key)
+				// A key repeated in the batch is only deleted once
+				link.DeletedFlag = true
+				links[key] = link
 			}
-		}()
-
-		result, err := tx.ExecContext(ctx, query, args...)
-		if err != nil {
-			return false, fmt.Errorf("failed to execute delete query: %w", err)
+			results = append(results, models.DeleteResult{Key: key, Status: status})
+		}
+		if len(toDelete) == 0 {
+			continue
 		}
 
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			return false, fmt.Errorf("error retrieving affected rows: %w", err)
+		query := `UPDATE Links SET DeletedFlag = true, DeletedAt = NOW() WHERE ShortURL = ANY($1)`
+		if _, err := tx.ExecContext(ctx, query, toDelete); err != nil {
+			return nil, fmt.Errorf("failed to execute delete query: %w", err)
 		}
+	}
 
-		successfulDeletes += int(rowsAffected)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return results, nil
+}
 
-		// If we reached here, mark rollback as false before committing
-		rollback = false
+// lockLinks - selects the owners and the deletion flags of the links for update
+func lockLinks(ctx context.Context, tx *sql.Tx, keys []string) (map[string]models.Link, error) {
+	query := `SELECT ShortURL, COALESCE(UserID, ''), DeletedFlag FROM Links WHERE ShortURL = ANY($1) FOR UPDATE`
+	rows, err := tx.QueryContext(ctx, query, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select links: %w", err)
+	}
+	defer rows.Close()
 
-		// Commit the transaction
-		err = tx.Commit()
-		if err != nil {
-			return false, fmt.Errorf("failed to commit transaction: %w", err)
+	links := make(map[string]models.Link)
+	for rows.Next() {
+		var link models.Link
+		if err := rows.Scan(&link.ShortURL, &link.UserID, &link.DeletedFlag); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
 		}
+		links[link.ShortURL] = link
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return links, nil
+}
+
+// ExpireLinks - marks the links whose expiry time has passed
+func (storage *DBStorage) ExpireLinks(ctx context.Context) (int, error) {
+	query := `UPDATE Links SET ExpiredFlag = true
+		WHERE ExpiredFlag = false AND ExpiresAt IS NOT NULL AND ExpiresAt <= NOW()`
 
+	result, err := storage.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark expired links: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving affected rows: %w", err)
 	}
-	return successfulDeletes > 0, nil
+	return int(rowsAffected), nil
 }
 
 func (storage *DBStorage) Get(ctx context.Context, ShortURL string) (string, error) {
-	query := `SELECT OriginalURL, DeletedFlag FROM Links WHERE ShortURL = $1`
+	query := `SELECT OriginalURL, DeletedFlag, ExpiredFlag, ExpiresAt FROM Links WHERE ShortURL = $1`
 
 	var OriginalURL string
-	var DeletedFlag bool
+	var DeletedFlag, ExpiredFlag bool
+	var ExpiresAt *time.Time
 
-	err := storage.db.QueryRowContext(ctx, query, ShortURL).Scan(&OriginalURL, &DeletedFlag)
+	err := storage.db.QueryRowContext(ctx, query, ShortURL).Scan(&OriginalURL, &DeletedFlag, &ExpiredFlag, &ExpiresAt)
 	if err != nil {
 		return "", NewStorageError("failed to select", OriginalURL, ShortURL, err)
 	}
 	if DeletedFlag {
 		return "", NewStorageError("deleted", OriginalURL, ShortURL, nil)
 	}
+	if isExpired(ExpiredFlag, ExpiresAt) {
+		return "", NewStorageError("expired", OriginalURL, ShortURL, nil)
+	}
 	return OriginalURL, nil
 }
 
-func (storage *DBStorage) GetUserURLs(ctx context.Context, userID string) ([]models.JSONUserRes, error) {
-	jResBatch := make([]models.JSONUserRes, 0)
+// GetLink - returns the stored link with its owner and state
+func (storage *DBStorage) GetLink(ctx context.Context, ShortURL string) (models.Link, error) {
+	query := `SELECT ShortURL, OriginalURL, NormalizedURL, COALESCE(UserID, ''), ExpiresAt, DeletedFlag, ExpiredFlag,
+		AddedDate, Tags, COALESCE(Folder, '')
+		FROM Links WHERE ShortURL = $1`
 
-	query := `SELECT ShortURL, OriginalURL FROM Links WHERE UserID = $1`
-	rows, err := storage.db.QueryContext(ctx, query, userID)
+	var link models.Link
+	err := storage.db.QueryRowContext(ctx, query, ShortURL).Scan(&link.ShortURL, &link.OriginalURL,
+		&link.NormalizedURL, &link.UserID, &link.ExpiresAt, &link.DeletedFlag, &link.ExpiredFlag,
+		&link.CreatedAt, pgTypes.SQLScanner(&link.Tags), &link.Folder)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Link{}, NewStorageError("not found", "", ShortURL, err)
+	}
+	if err != nil {
+		return models.Link{}, NewStorageError("failed to select", "", ShortURL, err)
+	}
+	return link, nil
+}
+
+// Update - changes the URL of the user's link and writes the previous one to LinkHistory
+func (storage *DBStorage) Update(ctx context.Context, link models.Link) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the row until the history is written
+	var previousURL string
+	var deletedFlag bool
+	query := `SELECT OriginalURL, DeletedFlag FROM Links WHERE ShortURL = $1 AND UserID = $2 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, link.ShortURL, link.UserID).Scan(&previousURL, &deletedFlag)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NewStorageError("not found", link.OriginalURL, link.ShortURL, err)
+	}
+	if err != nil {
+		return NewStorageError("failed to select", link.OriginalURL, link.ShortURL, err)
+	}
+	if deletedFlag {
+		return NewStorageError("deleted", link.OriginalURL, link.ShortURL, nil)
+	}
+	if previousURL == link.OriginalURL {
+		return nil
+	}
+
+	// The user should not get two links for the same URL
+	normalizedURL := dedupURL(link.OriginalURL, link.NormalizedURL)
+	var storedKey string
+	query = `SELECT ShortURL FROM Links WHERE UserID = $1 AND NormalizedURL = $2 AND ShortURL <> $3`
+	err = tx.QueryRowContext(ctx, query, link.UserID, normalizedURL, link.ShortURL).Scan(&storedKey)
+	if err == nil {
+		return NewStorageError("already exists", link.OriginalURL, storedKey, nil)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return NewStorageError("failed to select", link.OriginalURL, link.ShortURL, err)
+	}
+
+	query = `UPDATE Links SET OriginalURL = $1, NormalizedURL = $2 WHERE ShortURL = $3`
+	if _, err := tx.ExecContext(ctx, query, link.OriginalURL, normalizedURL, link.ShortURL); err != nil {
+		return fmt.Errorf("failed to update link: %w", err)
+	}
+	query = `INSERT INTO LinkHistory (ShortURL, OriginalURL) VALUES ($1, $2)`
+	if _, err := tx.ExecContext(ctx, query, link.ShortURL, previousURL); err != nil {
+		return fmt.Errorf("failed to insert history: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetLinkHistory - returns the previous destinations of the link, the oldest first
+func (storage *DBStorage) GetLinkHistory(ctx context.Context, ShortURL string) ([]models.LinkChange, error) {
+	query := `SELECT OriginalURL, ChangedAt FROM LinkHistory WHERE ShortURL = $1 ORDER BY ChangedAt, ID`
+
+	rows, err := storage.db.QueryContext(ctx, query, ShortURL)
+	if err != nil {
+		return nil, NewStorageError("failed to select", "", ShortURL, err)
+	}
+	defer rows.Close()
+
+	history := []models.LinkChange{}
+	for rows.Next() {
+		var change models.LinkChange
+		if err := rows.Scan(&change.OriginalURL, &change.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		history = append(history, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return history, nil
+}
+
+// TransferLinks - changes the owner of the links and writes the change to LinkTransfers in one transaction
+func (storage *DBStorage) TransferLinks(ctx context.Context, fromID, toID string, keys []string, actorID string) error {
+	keys = uniqueKeys(keys)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	links, err := lockLinks(ctx, tx, keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		link, found := links[key]
+		if !found || link.UserID != fromID {
+			return NewStorageError("not found", "", key, nil)
+		}
+		if link.DeletedFlag {
+			return NewStorageError("deleted", "", key, nil)
+		}
+	}
+
+	// The new owner should not get two links for the same URL
+	var storedKey, originalURL string
+	query := `SELECT t.ShortURL, t.OriginalURL FROM Links t JOIN Links s ON s.NormalizedURL = t.NormalizedURL
+		WHERE s.ShortURL = ANY($1) AND t.UserID = $2 LIMIT 1`
+	err = tx.QueryRowContext(ctx, query, keys, toID).Scan(&storedKey, &originalURL)
+	if err == nil {
+		return NewStorageError("already exists", originalURL, storedKey, nil)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return NewStorageError("failed to select", "", "", err)
+	}
+
+	query = `UPDATE Links SET UserID = $1 WHERE ShortURL = ANY($2)`
+	if _, err := tx.ExecContext(ctx, query, toID, keys); err != nil {
+		return fmt.Errorf("failed to update links: %w", err)
+	}
+	query = `INSERT INTO LinkTransfers (ShortURL, FromID, ToID, ActorID) SELECT UNNEST($1::text[]), $2, $3, $4`
+	if _, err := tx.ExecContext(ctx, query, keys, fromID, toID, actorID); err != nil {
+		return fmt.Errorf("failed to insert transfers: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetLinkTransfers - returns the owner changes of the link, the oldest first
+func (storage *DBStorage) GetLinkTransfers(ctx context.Context, ShortURL string) ([]models.LinkTransfer, error) {
+	query := `SELECT FromID, ToID, ActorID, TransferredAt FROM LinkTransfers WHERE ShortURL = $1 ORDER BY TransferredAt, ID`
+
+	rows, err := storage.db.QueryContext(ctx, query, ShortURL)
+	if err != nil {
+		return nil, NewStorageError("failed to select", "", ShortURL, err)
+	}
+	defer rows.Close()
+
+	transfers := []models.LinkTransfer{}
+	for rows.Next() {
+		var transfer models.LinkTransfer
+		if err := rows.Scan(&transfer.FromID, &transfer.ToID, &transfer.ActorID, &transfer.TransferredAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		transfers = append(transfers, transfer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return transfers, nil
+}
+
+// RecordClicks - inserts the batch of clicks in one transaction
+func (storage *DBStorage) RecordClicks(ctx context.Context, clicks []models.Click) error {
+	query := `INSERT INTO Clicks (ShortURL, ClickedAt, Referrer, UserAgent, IP)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %s", err)
+	}
+	defer stmt.Close()
+
+	for _, click := range clicks {
+		_, err := stmt.ExecContext(ctx, click.ShortURL, click.Time, click.Referrer, click.UserAgent, click.IP)
+		if err != nil {
+			return fmt.Errorf("failed to insert click: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetLinkStats - counts the clicks of the link by days and by the hours of the recent window
+func (storage *DBStorage) GetLinkStats(ctx context.Context, ShortURL string) (models.LinkStats, error) {
+	stats := models.LinkStats{
+		ShortURL: config.AppConfig.ResultHost + "/" + ShortURL,
+	}
+
+	query := `SELECT COUNT(*) FROM Clicks WHERE ShortURL = $1`
+	if err := storage.db.QueryRowContext(ctx, query, ShortURL).Scan(&stats.Total); err != nil {
+		return stats, fmt.Errorf("failed to count clicks: %w", err)
+	}
+
+	query = `SELECT date_trunc('day', ClickedAt AT TIME ZONE 'UTC'), COUNT(*)
+		FROM Clicks WHERE ShortURL = $1
+		GROUP BY 1 ORDER BY 1`
+
+	daily, err := storage.queryBuckets(ctx, query, ShortURL)
+	if err != nil {
+		return stats, err
+	}
+	stats.Daily = daily
+
+	query = `SELECT date_trunc('hour', ClickedAt AT TIME ZONE 'UTC'), COUNT(*)
+		FROM Clicks WHERE ShortURL = $1 AND ClickedAt > $2
+		GROUP BY 1 ORDER BY 1`
+
+	hourly, err := storage.queryBuckets(ctx, query, ShortURL, time.Now().Add(-HourlyStatsWindow))
+	if err != nil {
+		return stats, err
+	}
+	stats.Hourly = hourly
+
+	return stats, nil
+}
+
+// queryBuckets - reads (bucket start, count) rows
+func (storage *DBStorage) queryBuckets(ctx context.Context, query string, args ...any) ([]models.StatsBucket, error) {
+	rows, err := storage.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select clicks: %w", err)
+	}
+	defer rows.Close()
+
+	buckets := []models.StatsBucket{}
+	for rows.Next() {
+		var bucket models.StatsBucket
+		if err := rows.Scan(&bucket.Start, &bucket.Clicks); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		bucket.Start = time.Date(bucket.Start.Year(), bucket.Start.Month(), bucket.Start.Day(),
+			bucket.Start.Hour(), 0, 0, 0, time.UTC)
+		buckets = append(buckets, bucket)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return buckets, nil
+}
+
+// GetUserURLs - selects a page of the user's links in SQL. The sort columns are indexed after UserID,
+// so the page after the cursor is read from the index without sorting all the links of the user.
+func (storage *DBStorage) GetUserURLs(ctx context.Context, userID string, q URLQuery) (URLPage, error) {
+	after, err := decodeCursor(q)
+	if err != nil {
+		return URLPage{}, err
+	}
+	order := q.sortOrder()
+
+	conditions := []string{"UserID = $1"}
+	args := []any{userID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if q.Domain != "" {
+		domain := strings.ToLower(q.Domain)
+		conditions = append(conditions, fmt.Sprintf("(Domain = %s OR Domain LIKE %s)", arg(domain), arg("%."+escapeLike(domain))))
+	}
+	if q.CreatedFrom != nil {
+		conditions = append(conditions, "AddedDate >= "+arg(*q.CreatedFrom))
+	}
+	if q.CreatedTo != nil {
+		conditions = append(conditions, "AddedDate < "+arg(*q.CreatedTo))
+	}
+	switch q.State {
+	case StateDeleted:
+		conditions = append(conditions, "DeletedFlag = true")
+	case StateExpired:
+		conditions = append(conditions, "DeletedFlag IS NOT TRUE AND (ExpiredFlag = true OR ExpiresAt <= NOW())")
+	case StateActive:
+		conditions = append(conditions, "DeletedFlag IS NOT TRUE AND ExpiredFlag IS NOT TRUE AND (ExpiresAt IS NULL OR ExpiresAt > NOW())")
+	}
+	if len(q.Tags) > 0 {
+		conditions = append(conditions, "Tags @> "+arg(q.Tags)+"::text[]")
+	}
+	if q.Folder != "" {
+		conditions = append(conditions, "Folder = "+arg(q.Folder))
+	}
+	if q.Search != "" {
+		search := arg("%" + escapeLike(q.Search) + "%")
+		conditions = append(conditions, fmt.Sprintf("(OriginalURL ILIKE %s OR ShortURL ILIKE %s)", search, search))
+	}
+
+	column, direction, seek := "AddedDate", "ASC", ">"
+	if order == SortURLAsc || order == SortURLDesc {
+		column = "OriginalURL"
+	}
+	if order == SortCreatedDesc || order == SortURLDesc {
+		direction, seek = "DESC", "<"
+	}
+	if after != nil {
+		var value any = after.CreatedAt
+		if column == "OriginalURL" {
+			value = after.URL
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s, ShortURL) %s (%s, %s)", column, seek, arg(value), arg(after.Key)))
+	}
+
+	query := `SELECT ShortURL, OriginalURL, ExpiresAt, DeletedFlag, DeletedAt, ExpiredFlag, AddedDate, Tags, COALESCE(Folder, '')
+		FROM Links WHERE ` + strings.Join(conditions, " AND ") + fmt.Sprintf(" ORDER BY %[1]s %[2]s, ShortURL %[2]s", column, direction)
+	if q.Limit > 0 {
+		// One more link tells if there is a next page
+		query += " LIMIT " + arg(q.Limit+1)
+	}
+
+	rows, err := storage.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return URLPage{}, fmt.Errorf("failed to retrieve links for user: %s", userID)
+	}
+	defer rows.Close()
+
+	links := []models.Link{}
+	for rows.Next() {
+		link := models.Link{UserID: userID}
+		err := rows.Scan(&link.ShortURL, &link.OriginalURL, &link.ExpiresAt, &link.DeletedFlag, &link.DeletedAt, &link.ExpiredFlag,
+			&link.CreatedAt, pgTypes.SQLScanner(&link.Tags), &link.Folder)
+		if err != nil {
+			return URLPage{}, fmt.Errorf("failed to scan row: %s", err)
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return URLPage{}, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+
+	page := URLPage{}
+	if q.Limit > 0 && len(links) > q.Limit {
+		links = links[:q.Limit]
+		page.NextCursor = encodeCursor(order, links[len(links)-1])
+	}
+	page.Links = make([]models.JSONUserRes, 0, len(links))
+	for _, link := range links {
+		page.Links = append(page.Links, userURLRes(link))
+	}
+	return page, nil
+}
+
+// pgTypes - scans the Postgres arrays, which database/sql does not support
+var pgTypes = pgtype.NewMap()
+
+// SetLinkLabels - replaces the tags and the folder of the owner's link
+func (storage *DBStorage) SetLinkLabels(ctx context.Context, ownerID, ShortURL string, tags []string, folder string) error {
+	if tags == nil {
+		tags = []string{}
+	}
+	query := `UPDATE Links SET Tags = $1, Folder = NULLIF($2, '') WHERE ShortURL = $3 AND UserID = $4`
+	result, err := storage.db.ExecContext(ctx, query, tags, folder, ShortURL, ownerID)
+	if err != nil {
+		return fmt.Errorf("failed to update labels: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %s", err)
+	}
+	if rowsAffected == 0 {
+		return NewStorageError("not found", "", ShortURL, nil)
+	}
+	return nil
+}
 
+// GetUserTags - counts the tags of the owner's links in alphabetical order
+func (storage *DBStorage) GetUserTags(ctx context.Context, ownerID string) ([]models.TagCount, error) {
+	query := `SELECT tag, COUNT(*) FROM Links, UNNEST(Tags) AS tag
+		WHERE UserID = $1 AND DeletedFlag IS NOT TRUE
+		GROUP BY tag ORDER BY tag`
+	rows, err := storage.db.QueryContext(ctx, query, ownerID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve links for user: %s", userID)
+		return nil, fmt.Errorf("failed to retrieve tags for user: %s", ownerID)
 	}
 	defer rows.Close()
 
+	counts := []models.TagCount{}
 	for rows.Next() {
-		var row models.JSONUserRes
+		var count models.TagCount
+		if err := rows.Scan(&count.Tag, &count.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return counts, nil
+}
+
+// RenameTag - renames the tag in a single statement, the duplicates made by a merge are removed
+func (storage *DBStorage) RenameTag(ctx context.Context, ownerID, from, to string) (int, error) {
+	query := `UPDATE Links SET Tags = ARRAY(SELECT DISTINCT t FROM UNNEST(ARRAY_REPLACE(Tags, $2, $3)) AS t ORDER BY t)
+		WHERE UserID = $1 AND Tags @> ARRAY[$2]::text[]`
+	result, err := storage.db.ExecContext(ctx, query, ownerID, from, to)
+	if err != nil {
+		return 0, fmt.Errorf("failed to rename tag: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows: %s", err)
+	}
+	return int(rowsAffected), nil
+}
+
+// escapeLike - makes the wildcards of the value match literally in a LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// GetUserTrash - returns the deleted links of the user, the most recently deleted first
+func (storage *DBStorage) GetUserTrash(ctx context.Context, userID string) ([]models.JSONUserRes, error) {
+	jResBatch := make([]models.JSONUserRes, 0)
 
-		if err := rows.Scan(&row.ShortURL, &row.OriginalURL); err != nil {
+	query := `SELECT ShortURL, OriginalURL, ExpiresAt, DeletedAt FROM Links
+		WHERE UserID = $1 AND DeletedFlag = true
+		ORDER BY DeletedAt DESC`
+	rows, err := storage.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve deleted links for user: %s", userID)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := models.JSONUserRes{State: StateDeleted}
+		if err := rows.Scan(&row.ShortURL, &row.OriginalURL, &row.ExpiresAt, &row.DeletedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %s", err)
 		}
 		row.ShortURL = config.AppConfig.ResultHost + "/" + row.ShortURL
 		jResBatch = append(jResBatch, row)
 	}
-
-	// **Check for errors during iteration**
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error while iterating over rows: %w", err)
 	}
 	return jResBatch, nil
 }
 
+// Restore - clears the deletion of the user's links
+func (storage *DBStorage) Restore(ctx context.Context, userID string, keys []string) ([]string, error) {
+	query := `UPDATE Links SET DeletedFlag = false, DeletedAt = NULL
+		WHERE ShortURL = ANY($1) AND UserID = $2 AND DeletedFlag = true
+		RETURNING ShortURL`
+	rows, err := storage.db.QueryContext(ctx, query, keys, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore links: %w", err)
+	}
+	defer rows.Close()
+
+	restored := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		restored = append(restored, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return restored, nil
+}
+
+// PurgeDeleted - deletes the links deleted before the given time with their clicks and history
+func (storage *DBStorage) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	// A single statement, so the links and their data are removed atomically
+	query := `WITH purged AS (
+			DELETE FROM Links WHERE DeletedFlag = true AND DeletedAt < $1 RETURNING ShortURL
+		), clicks AS (
+			DELETE FROM Clicks WHERE ShortURL IN (SELECT ShortURL FROM purged)
+		), history AS (
+			DELETE FROM LinkHistory WHERE ShortURL IN (SELECT ShortURL FROM purged)
+		), transfers AS (
+			DELETE FROM LinkTransfers WHERE ShortURL IN (SELECT ShortURL FROM purged)
+		)
+		SELECT COUNT(*) FROM purged`
+
+	var purged int
+	if err := storage.db.QueryRowContext(ctx, query, before).Scan(&purged); err != nil {
+		return 0, fmt.Errorf("failed to purge deleted links: %w", err)
+	}
+	return purged, nil
+}
+
+// deletionLease - how long the deletions returned by PendingDeletions are hidden from other instances
+const deletionLease = time.Minute
+
+func (storage *DBStorage) EnqueueDeletion(ctx context.Context, item models.KeysToDelete) error {
+	keys, err := json.Marshal(item.Keys)
+	if err != nil {
+		return fmt.Errorf("failed to encode keys: %w", err)
+	}
+
+	query := `INSERT INTO DeleteQueue (UserID, JobID, Keys) VALUES ($1, NULLIF($2, ''), $3)`
+	if _, err := storage.db.ExecContext(ctx, query, item.UserID, item.JobID, string(keys)); err != nil {
+		return fmt.Errorf("failed to enqueue deletion: %w", err)
+	}
+	return nil
+}
+
+// PendingDeletions - claims the due requests for the lease time, so the instances sharing
+// the database do not process the same request at once
+func (storage *DBStorage) PendingDeletions(ctx context.Context, now time.Time, limit int) ([]models.PendingDeletion, error) {
+	query := `UPDATE DeleteQueue SET NextAttemptAt = $2
+		WHERE ID IN (
+			SELECT ID FROM DeleteQueue
+			WHERE DeadFlag = false AND NextAttemptAt <= $1
+			ORDER BY ID LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ID, UserID, COALESCE(JobID, ''), Keys, Attempts, NextAttemptAt, COALESCE(LastError, ''), DeadFlag, CreatedAt`
+
+	entries, err := storage.queryDeletions(ctx, query, now, now.Add(deletionLease), limit)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (storage *DBStorage) CompleteDeletions(ctx context.Context, ids []int64) error {
+	if _, err := storage.db.ExecContext(ctx, `DELETE FROM DeleteQueue WHERE ID = ANY($1)`, ids); err != nil {
+		return fmt.Errorf("failed to complete deletions: %w", err)
+	}
+	return nil
+}
+
+func (storage *DBStorage) RetryDeletion(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) error {
+	query := `UPDATE DeleteQueue SET Attempts = Attempts + 1, LastError = $2, NextAttemptAt = $3 WHERE ID = $1`
+	if _, err := storage.db.ExecContext(ctx, query, id, lastError, nextAttemptAt); err != nil {
+		return fmt.Errorf("failed to postpone deletion: %w", err)
+	}
+	return nil
+}
+
+func (storage *DBStorage) DeadLetterDeletion(ctx context.Context, id int64, lastError string) error {
+	query := `UPDATE DeleteQueue SET Attempts = Attempts + 1, LastError = $2, DeadFlag = true WHERE ID = $1`
+	if _, err := storage.db.ExecContext(ctx, query, id, lastError); err != nil {
+		return fmt.Errorf("failed to dead-letter deletion: %w", err)
+	}
+	return nil
+}
+
+func (storage *DBStorage) DeadDeletions(ctx context.Context) ([]models.PendingDeletion, error) {
+	query := `SELECT ID, UserID, COALESCE(JobID, ''), Keys, Attempts, NextAttemptAt, COALESCE(LastError, ''), DeadFlag, CreatedAt
+		FROM DeleteQueue WHERE DeadFlag = true ORDER BY ID`
+	return storage.queryDeletions(ctx, query)
+}
+
+// queryDeletions - runs the query that returns the columns of DeleteQueue
+func (storage *DBStorage) queryDeletions(ctx context.Context, query string, args ...any) ([]models.PendingDeletion, error) {
+	rows, err := storage.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select deletions: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []models.PendingDeletion{}
+	for rows.Next() {
+		var entry models.PendingDeletion
+		var keys []byte
+		err := rows.Scan(&entry.ID, &entry.Item.UserID, &entry.Item.JobID, &keys, &entry.Attempts,
+			&entry.NextAttemptAt, &entry.LastError, &entry.DeadFlag, &entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		if err := json.Unmarshal(keys, &entry.Item.Keys); err != nil {
+			return nil, fmt.Errorf("failed to decode keys of deletion %d: %w", entry.ID, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return entries, nil
+}
+
+func (storage *DBStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	query := `INSERT INTO APIKeys (ID, UserID, Name, Prefix, Hash, CreatedAt) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := storage.db.ExecContext(ctx, query, key.ID, key.UserID, key.Name, key.Prefix, key.Hash, key.CreatedAt)
+	if err != nil {
+		return NewStorageError("failed to insert", "", "", fmt.Errorf("failed to insert API key: %w", err))
+	}
+	return nil
+}
+
+func (storage *DBStorage) GetAPIKey(ctx context.Context, hash string) (models.APIKey, error) {
+	query := `SELECT ID, UserID, Name, Prefix, Hash, CreatedAt, RevokedAt FROM APIKeys WHERE Hash = $1 AND RevokedAt IS NULL`
+
+	var key models.APIKey
+	err := storage.db.QueryRowContext(ctx, query, hash).
+		Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Hash, &key.CreatedAt, &key.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.APIKey{}, NewStorageError("not found", "", "", fmt.Errorf("the API key is not found"))
+	}
+	if err != nil {
+		return models.APIKey{}, NewStorageError("failed to select", "", "", err)
+	}
+	return key, nil
+}
+
+func (storage *DBStorage) GetUserAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error) {
+	query := `SELECT ID, UserID, Name, Prefix, Hash, CreatedAt, RevokedAt FROM APIKeys WHERE UserID = $1 ORDER BY CreatedAt, ID`
+
+	rows, err := storage.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, NewStorageError("failed to select", "", "", err)
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var key models.APIKey
+		if err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Hash, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return keys, nil
+}
+
+func (storage *DBStorage) RevokeAPIKey(ctx context.Context, userID string, id string) error {
+	query := `UPDATE APIKeys SET RevokedAt = COALESCE(RevokedAt, NOW()) WHERE ID = $1 AND UserID = $2`
+
+	result, err := storage.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return NewStorageError("not found", "", "", fmt.Errorf("the API key %s is not found", id))
+	}
+	return nil
+}
+
+func (storage *DBStorage) CreateUser(ctx context.Context, user models.User) error {
+	query := `INSERT INTO Users (ID, Login, PasswordHash, CreatedAt) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`
+	result, err := storage.db.ExecContext(ctx, query, user.ID, user.Login, user.PasswordHash, user.CreatedAt)
+	if err != nil {
+		return NewStorageError("failed to insert", "", "", fmt.Errorf("failed to insert user: %w", err))
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return NewStorageError("already exists", "", "", fmt.Errorf("the login %s is taken", user.Login))
+	}
+	return nil
+}
+
+func (storage *DBStorage) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
+	return storage.getUser(ctx, `SELECT ID, Login, PasswordHash, CreatedAt FROM Users WHERE Login = $1`, login)
+}
+
+func (storage *DBStorage) GetUser(ctx context.Context, userID string) (models.User, error) {
+	return storage.getUser(ctx, `SELECT ID, Login, PasswordHash, CreatedAt FROM Users WHERE ID = $1`, userID)
+}
+
+func (storage *DBStorage) getUser(ctx context.Context, query string, arg string) (models.User, error) {
+	var user models.User
+	err := storage.db.QueryRowContext(ctx, query, arg).Scan(&user.ID, &user.Login, &user.PasswordHash, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, NewStorageError("not found", "", "", fmt.Errorf("the user %s is not found", arg))
+	}
+	if err != nil {
+		return models.User{}, NewStorageError("failed to select", "", "", err)
+	}
+	return user, nil
+}
+
+func (storage *DBStorage) CreateWorkspace(ctx context.Context, ws models.Workspace) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO Workspaces (ID, Name, CreatedAt) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+	result, err := tx.ExecContext(ctx, query, ws.ID, ws.Name, ws.CreatedAt)
+	if err != nil {
+		return NewStorageError("failed to insert", "", "", fmt.Errorf("failed to insert workspace: %w", err))
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return NewStorageError("already exists", "", "", fmt.Errorf("the workspace %s already exists", ws.ID))
+	}
+
+	for _, member := range ws.Members {
+		query := `INSERT INTO WorkspaceMembers (WorkspaceID, UserID, Role, AddedAt) VALUES ($1, $2, $3, $4)`
+		if _, err := tx.ExecContext(ctx, query, ws.ID, member.UserID, member.Role, member.AddedAt); err != nil {
+			return NewStorageError("failed to insert", "", "", fmt.Errorf("failed to insert member: %w", err))
+		}
+	}
+	return tx.Commit()
+}
+
+func (storage *DBStorage) GetWorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	query := `SELECT Role FROM WorkspaceMembers WHERE WorkspaceID = $1 AND UserID = $2`
+
+	var role string
+	err := storage.db.QueryRowContext(ctx, query, workspaceID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", NewStorageError("not found", "", "", fmt.Errorf("the user %s is not a member of %s", userID, workspaceID))
+	}
+	if err != nil {
+		return "", NewStorageError("failed to select", "", "", err)
+	}
+	return role, nil
+}
+
+func (storage *DBStorage) GetUserWorkspaces(ctx context.Context, userID string) ([]models.JSONWorkspaceRes, error) {
+	query := `SELECT w.ID, w.Name, m.Role, w.CreatedAt FROM Workspaces w
+		JOIN WorkspaceMembers m ON m.WorkspaceID = w.ID
+		WHERE m.UserID = $1 ORDER BY w.CreatedAt, w.ID`
+
+	rows, err := storage.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, NewStorageError("failed to select", "", "", err)
+	}
+	defer rows.Close()
+
+	found := []models.JSONWorkspaceRes{}
+	for rows.Next() {
+		var ws models.JSONWorkspaceRes
+		if err := rows.Scan(&ws.ID, &ws.Name, &ws.Role, &ws.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		found = append(found, ws)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return found, nil
+}
+
+func (storage *DBStorage) GetWorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error) {
+	if err := storage.workspaceExists(ctx, workspaceID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT UserID, Role, AddedAt FROM WorkspaceMembers WHERE WorkspaceID = $1 ORDER BY AddedAt, UserID`
+	rows, err := storage.db.QueryContext(ctx, query, workspaceID)
+	if err != nil {
+		return nil, NewStorageError("failed to select", "", "", err)
+	}
+	defer rows.Close()
+
+	members := []models.WorkspaceMember{}
+	for rows.Next() {
+		var member models.WorkspaceMember
+		if err := rows.Scan(&member.UserID, &member.Role, &member.AddedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return members, nil
+}
+
+func (storage *DBStorage) SetWorkspaceMember(ctx context.Context, workspaceID string, member models.WorkspaceMember) error {
+	return storage.changeMembers(ctx, workspaceID, func(tx *sql.Tx) error {
+		query := `INSERT INTO WorkspaceMembers (WorkspaceID, UserID, Role, AddedAt) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (WorkspaceID, UserID) DO UPDATE SET Role = EXCLUDED.Role`
+		if _, err := tx.ExecContext(ctx, query, workspaceID, member.UserID, member.Role, member.AddedAt); err != nil {
+			return fmt.Errorf("failed to set member: %w", err)
+		}
+		return nil
+	})
+}
+
+func (storage *DBStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error {
+	return storage.changeMembers(ctx, workspaceID, func(tx *sql.Tx) error {
+		query := `DELETE FROM WorkspaceMembers WHERE WorkspaceID = $1 AND UserID = $2`
+		result, err := tx.ExecContext(ctx, query, workspaceID, userID)
+		if err != nil {
+			return fmt.Errorf("failed to remove member: %w", err)
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+			return NewStorageError("not found", "", "", fmt.Errorf("the user %s is not a member of %s", userID, workspaceID))
+		}
+		return nil
+	})
+}
+
+// changeMembers - applies the change while the workspace is locked and rolls it back if no owner is left
+func (storage *DBStorage) changeMembers(ctx context.Context, workspaceID string, change func(tx *sql.Tx) error) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the workspace, so the concurrent changes can not remove all the owners together
+	var id string
+	err = tx.QueryRowContext(ctx, `SELECT ID FROM Workspaces WHERE ID = $1 FOR UPDATE`, workspaceID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return workspaceNotFound(workspaceID)
+	}
+	if err != nil {
+		return NewStorageError("failed to select", "", "", err)
+	}
+
+	if err := change(tx); err != nil {
+		return err
+	}
+
+	var owners int
+	query := `SELECT COUNT(*) FROM WorkspaceMembers WHERE WorkspaceID = $1 AND Role = $2`
+	if err := tx.QueryRowContext(ctx, query, workspaceID, RoleOwner).Scan(&owners); err != nil {
+		return NewStorageError("failed to select", "", "", err)
+	}
+	if owners == 0 {
+		return lastOwner(workspaceID)
+	}
+	return tx.Commit()
+}
+
+// workspaceExists - returns a "not found" error if there is no such workspace
+func (storage *DBStorage) workspaceExists(ctx context.Context, workspaceID string) error {
+	var id string
+	err := storage.db.QueryRowContext(ctx, `SELECT ID FROM Workspaces WHERE ID = $1`, workspaceID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return workspaceNotFound(workspaceID)
+	}
+	if err != nil {
+		return NewStorageError("failed to select", "", "", err)
+	}
+	return nil
+}
+
 func (storage *DBStorage) Close() error {
 	return storage.db.Close()
 }
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"shorter/internal/models"
+	"sort"
+	"time"
+)
+
+// DeletionQueue keeps the requested deletions until the worker applies them,
+// so they are not lost on a restart. Requests that keep failing are moved to the dead letters.
+type DeletionQueue interface {
+	EnqueueDeletion(ctx context.Context, item models.KeysToDelete) error
+	// PendingDeletions - returns up to limit requests that are due for an attempt, the oldest first
+	PendingDeletions(ctx context.Context, now time.Time, limit int) ([]models.PendingDeletion, error)
+	// CompleteDeletions - removes the applied requests from the queue
+	CompleteDeletions(ctx context.Context, ids []int64) error
+	// RetryDeletion - counts the failed attempt and postpones the request
+	RetryDeletion(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) error
+	// DeadLetterDeletion - counts the failed attempt and stops retrying the request
+	DeadLetterDeletion(ctx context.Context, id int64, lastError string) error
+	DeadDeletions(ctx context.Context) ([]models.PendingDeletion, error)
+}
+
+// deletionList - the queue kept in memory by the memory and file storages.
+// The caller should hold the lock that guards the list.
+type deletionList struct {
+	lastID  int64
+	entries map[int64]*models.PendingDeletion
+}
+
+func newDeletionList() *deletionList {
+	return &deletionList{entries: make(map[int64]*models.PendingDeletion)}
+}
+
+func (l *deletionList) enqueue(item models.KeysToDelete) {
+	l.lastID++
+	now := time.Now().UTC()
+	l.entries[l.lastID] = &models.PendingDeletion{ID: l.lastID, Item: item, NextAttemptAt: now, CreatedAt: now}
+}
+
+// add - puts back an entry that was stored earlier
+func (l *deletionList) add(entry models.PendingDeletion) {
+	l.entries[entry.ID] = &entry
+	if entry.ID > l.lastID {
+		l.lastID = entry.ID
+	}
+}
+
+func (l *deletionList) pending(now time.Time, limit int) []models.PendingDeletion {
+	return l.filter(limit, func(entry *models.PendingDeletion) bool {
+		return !entry.DeadFlag && !entry.NextAttemptAt.After(now)
+	})
+}
+
+func (l *deletionList) dead() []models.PendingDeletion {
+	return l.filter(0, func(entry *models.PendingDeletion) bool {
+		return entry.DeadFlag
+	})
+}
+
+func (l *deletionList) all() []models.PendingDeletion {
+	return l.filter(0, func(entry *models.PendingDeletion) bool {
+		return true
+	})
+}
+
+func (l *deletionList) complete(ids []int64) {
+	for _, id := range ids {
+		delete(l.entries, id)
+	}
+}
+
+func (l *deletionList) fail(id int64, lastError string, nextAttemptAt time.Time, dead bool) error {
+	entry, found := l.entries[id]
+	if !found {
+		return fmt.Errorf("deletion %d is not queued", id)
+	}
+	entry.Attempts++
+	entry.LastError = lastError
+	entry.NextAttemptAt = nextAttemptAt
+	entry.DeadFlag = dead
+	return nil
+}
+
+// filter - returns copies of the matching entries ordered by ID, limit <= 0 means all
+func (l *deletionList) filter(limit int, match func(entry *models.PendingDeletion) bool) []models.PendingDeletion {
+	found := []models.PendingDeletion{}
+	for _, entry := range l.entries {
+		if match(entry) {
+			found = append(found, *entry)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
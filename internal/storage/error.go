@@ -1,6 +1,9 @@
 package storage
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type StorageError struct {
 	Type        string
@@ -22,3 +25,9 @@ func NewStorageError(errorType string, originalURL string, shortURL string, err
 		Err:         err,
 	}
 }
+
+// IsErrorType - checks if the error is a StorageError of the given type
+func IsErrorType(err error, errorType string) bool {
+	var storageErr *StorageError
+	return errors.As(err, &storageErr) && storageErr.Type == errorType
+}
@@ -1,97 +1,496 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"shorter/internal/config"
 	"shorter/internal/models"
 	"shorter/internal/urlkey"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Record operations in the storage file. A record without an operation is a full row
+// that replaces the previous version of the row with the same short url.
+const (
+	opDelete = "delete"
+	opPurge  = "purge" // removes the row for good
+)
+
+// Policies of flushing the storage file to the disk
+const (
+	SyncAlways   = "always"   // after every write
+	SyncInterval = "interval" // periodically in the background
+	SyncNever    = "never"    // left to the operating system
+)
+
+// RecoveryReport - what happened to the records of the file when it was loaded
+type RecoveryReport struct {
+	Loaded         int   // valid records
+	Legacy         int   // records without a checksum written by older versions
+	Discarded      int   // corrupted records in the middle of the file
+	Truncated      int   // torn records cut off the end of the file
+	TruncatedBytes int64 // size of the cut off tail
+}
+
 type Row struct {
-	ID          string `json:"uuid"`
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
-	UserID      string `json:"userid"`
-	DeletedFlag bool   `json:"deleted"`
+	Op            string     `json:"op,omitempty"`
+	ID            string     `json:"uuid,omitempty"`
+	ShortURL      string     `json:"short_url"`
+	OriginalURL   string     `json:"original_url,omitempty"`
+	NormalizedURL string     `json:"normalized_url,omitempty"`
+	UserID        string     `json:"userid,omitempty"`
+	DeletedFlag   bool       `json:"deleted,omitempty"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	ExpiredFlag   bool       `json:"expired,omitempty"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"` // unknown for the records written before it was introduced
+	Tags          []string   `json:"tags,omitempty"`
+	Folder        string     `json:"folder,omitempty"`
+	// History - the previous destinations, every update record carries the whole history
+	History []models.LinkChange `json:"history,omitempty"`
+	// Transfers - the owner changes, carried by every record like the history
+	Transfers []models.LinkTransfer `json:"transfers,omitempty"`
 }
 
+// toLink - converts the stored row to the link model
+func (row Row) toLink() models.Link {
+	link := models.Link{
+		ShortURL:      row.ShortURL,
+		OriginalURL:   row.OriginalURL,
+		NormalizedURL: row.NormalizedURL,
+		UserID:        row.UserID,
+		ExpiresAt:     row.ExpiresAt,
+		DeletedFlag:   row.DeletedFlag,
+		DeletedAt:     row.DeletedAt,
+		ExpiredFlag:   row.ExpiredFlag,
+		Tags:          row.Tags,
+		Folder:        row.Folder,
+	}
+	if row.CreatedAt != nil {
+		link.CreatedAt = *row.CreatedAt
+	}
+	return link
+}
+
+// FileStorage keeps an append-only log of records in the file and the current
+// state of the links in memory. The log is read once on start; deletions are
+// appended as tombstones and Compact rewrites the file with the live rows only.
 type FileStorage struct {
-	filePath string
-	file     *os.File
-	encoder  *json.Encoder
-	counter  int // Tracks the number of stored records
+	filePath     string
+	file         *os.File
+	counter      int // Tracks the number of stored rows
+	stale        int // Records in the file that were superseded by later ones
+	keys         urlkey.KeyGenerator
+	mu           sync.RWMutex
+	rows         map[string]*Row     // key -> row
+	urls         map[userURL]string  // (UserID, NormalizedURL) -> key
+	users        map[string][]string // UserID -> keys in the order of creation
+	clicksPath   string
+	clicksFile   *os.File
+	clicksMutex  sync.Mutex
+	clicks       map[string]*clickCounts // key -> the clicks counted since the start
+	syncPolicy   string
+	deletesPath  string
+	deletesMutex sync.Mutex
+	deletes      *deletionList
+	apiKeysPath  string
+	apiKeysMutex sync.RWMutex
+	apiKeys      *apiKeyList
+	accountsPath string
+	usersMutex   sync.RWMutex
+	accounts     *userList
+	wsPath       string
+	wsMutex      sync.RWMutex
+	workspaces   *workspaceList
+	dirty        bool // there are writes that were not synced yet
+	stopSync     chan struct{}
+	syncDone     chan struct{}
+	Recovery     RecoveryReport
 }
 
-func NewFileStorage(filePath string) (*FileStorage, error) {
+func NewFileStorage(filePath string, keys urlkey.KeyGenerator, syncPolicy string, syncInterval time.Duration) (*FileStorage, error) {
 	err := makeDirInPath(filePath)
 	if err != nil {
 		return nil, err
 	}
 
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	switch syncPolicy {
+	case "":
+		// The same default as the config, so the storage is durable without it
+		syncPolicy = SyncInterval
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, fmt.Errorf("unknown file sync policy: %s", syncPolicy)
+	}
+
+	f := &FileStorage{
+		filePath:   filePath,
+		keys:       keys,
+		rows:       make(map[string]*Row),
+		urls:       make(map[userURL]string),
+		users:      make(map[string][]string),
+		syncPolicy: syncPolicy,
+	}
+
+	// Build the indexes from the records stored earlier
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	log.Printf("File storage %s: loaded %d records (%d without checksum), discarded %d corrupted, truncated %d torn (%d bytes)\n",
+		filePath, f.Recovery.Loaded, f.Recovery.Legacy, f.Recovery.Discarded, f.Recovery.Truncated, f.Recovery.TruncatedBytes)
+
+	f.file, err = os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clicks are appended to their own file next to the links
+	f.clicksPath = filePath + ".clicks"
+	f.clicksFile, err = os.OpenFile(f.clicksPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
+		f.file.Close()
+		return nil, err
+	}
+	if err := f.loadClicks(); err != nil {
+		f.file.Close()
+		f.clicksFile.Close()
+		return nil, err
+	}
+
+	// The deletions queued before the restart are picked up again
+	f.deletesPath = filePath + ".deletes"
+	if err := f.loadDeletes(); err != nil {
+		f.file.Close()
+		f.clicksFile.Close()
+		return nil, err
+	}
+
+	// The API keys are kept in their own file, they are few and rarely change
+	f.apiKeysPath = filePath + ".keys"
+	if err := f.loadAPIKeys(); err != nil {
+		f.file.Close()
+		f.clicksFile.Close()
 		return nil, err
 	}
 
-	// Count existing lines (records)
-	count, err := countLines(filePath)
+	// So are the accounts
+	f.accountsPath = filePath + ".users"
+	if err := f.loadAccounts(); err != nil {
+		f.file.Close()
+		f.clicksFile.Close()
+		return nil, err
+	}
+
+	// And the workspaces with their members
+	f.wsPath = filePath + ".workspaces"
+	if err := f.loadWorkspaces(); err != nil {
+		f.file.Close()
+		f.clicksFile.Close()
+		return nil, err
+	}
+
+	urlkey.Seed(keys, uint64(f.counter))
+
+	// Get rid of the superseded records if they take most of the file
+	if f.stale > len(f.rows) {
+		if err := f.Compact(); err != nil {
+			log.Printf("Failed to compact file storage: %v\n", err)
+		}
+	}
+
+	if syncPolicy == SyncInterval {
+		if syncInterval <= 0 {
+			syncInterval = time.Second
+		}
+		f.stopSync = make(chan struct{})
+		f.syncDone = make(chan struct{})
+		go f.syncPeriodically(syncInterval)
+	}
+	return f, nil
+}
+
+// load - replays the records of the file into the indexes.
+// Corrupted records are skipped; torn records at the end of the file are cut off.
+func (f *FileStorage) load() error {
+	file, err := os.OpenFile(f.filePath, os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	var offset int64   // the position of the current line
+	var lastGood int64 // the end of the last valid record
+	badTail := 0       // invalid records after the last valid one
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		// A line without the new line symbol is the end of the file
+		complete := err == nil
+		if !complete && len(line) == 0 {
+			break
+		}
+
+		row, checked, decodeErr := decodeRecord(line)
+		switch {
+		case decodeErr == nil:
+			if row.Op == "" && row.NormalizedURL == "" {
+				row.NormalizedURL = legacyNormalizedURL(row.OriginalURL, row.ShortURL, func(normalizedURL string) bool {
+					key, found := f.urls[newUserURL(row.UserID, "", normalizedURL)]
+					return found && key != row.ShortURL
+				})
+			}
+			if !complete {
+				// Only the new line symbol is missing, restore it before appending
+				if _, err := file.WriteAt([]byte{'\n'}, offset+int64(len(line))); err != nil {
+					return fmt.Errorf("failed to complete the last record: %w", err)
+				}
+				line = append(line, '\n')
+			}
+			f.apply(row)
+			f.Recovery.Loaded++
+			if !checked {
+				f.Recovery.Legacy++
+			}
+			// The invalid records before this one were damaged in the middle of the file
+			f.Recovery.Discarded += badTail
+			badTail = 0
+			lastGood = offset + int64(len(line))
+		case len(bytes.TrimSpace(line)) > 0:
+			log.Printf("File storage: skipping corrupted record at offset %d: %v\n", offset, decodeErr)
+			badTail++
+		}
+		offset += int64(len(line))
+
+		if !complete {
+			break
+		}
+	}
+
+	// Cut off the torn records, so new records are not appended to a broken line
+	if offset > lastGood && badTail > 0 {
+		if err := file.Truncate(lastGood); err != nil {
+			return fmt.Errorf("failed to truncate torn records: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync file: %w", err)
+		}
+		f.Recovery.Truncated = badTail
+		f.Recovery.TruncatedBytes = offset - lastGood
+	}
+	return nil
+}
+
+// encodeRecord - writes the row as "<crc32 of json> <json>\n"
+func encodeRecord(row Row) ([]byte, error) {
+	data, err := json.Marshal(row)
 	if err != nil {
-		count = 0 // Default to 0 if an error occurs
+		return nil, fmt.Errorf("failed to marshal row: %w", err)
+	}
+	record := make([]byte, 0, len(data)+10)
+	record = fmt.Appendf(record, "%08x ", crc32.Checksum(data, crcTable))
+	record = append(record, data...)
+	return append(record, '\n'), nil
+}
+
+// decodeRecord - parses a line of the file. checked is false for the records
+// written before checksums were introduced, which are plain JSON.
+func decodeRecord(line []byte) (row Row, checked bool, err error) {
+	line = bytes.TrimRight(line, "\r\n")
+
+	if len(line) > 9 && line[8] == ' ' && line[0] != '{' {
+		sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+		if err != nil {
+			return row, true, fmt.Errorf("invalid checksum: %w", err)
+		}
+		data := line[9:]
+		if crc32.Checksum(data, crcTable) != uint32(sum) {
+			return row, true, errors.New("checksum mismatch")
+		}
+		return row, true, json.Unmarshal(data, &row)
+	}
+	return row, false, json.Unmarshal(line, &row)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// apply - updates the indexes with the record. The caller should hold the lock.
+func (f *FileStorage) apply(row Row) {
+	existing, found := f.rows[row.ShortURL]
+
+	if row.Op == opDelete {
+		if found {
+			existing.DeletedFlag = true
+			existing.DeletedAt = row.DeletedAt
+			if existing.DeletedAt == nil {
+				// The tombstones written before the trash was introduced have no time,
+				// their retention starts now
+				now := time.Now().UTC()
+				existing.DeletedAt = &now
+			}
+		}
+		f.stale++
+		return
 	}
 
-	// Close the file if an error occurs
-	defer func() {
+	if row.Op == opPurge {
+		if found {
+			delete(f.rows, row.ShortURL)
+			delete(f.urls, newUserURL(existing.UserID, existing.OriginalURL, existing.NormalizedURL))
+			f.users[existing.UserID] = slices.DeleteFunc(f.users[existing.UserID], func(key string) bool {
+				return key == row.ShortURL
+			})
+			// The purged row is superseded as well
+			f.stale++
+		}
+		f.stale++
+		return
+	}
+
+	if found {
+		// A newer version of the row replaces the stored one
+		f.stale++
+		delete(f.urls, newUserURL(existing.UserID, existing.OriginalURL, existing.NormalizedURL))
+		if existing.UserID != row.UserID {
+			f.users[existing.UserID] = slices.DeleteFunc(f.users[existing.UserID], func(key string) bool {
+				return key == row.ShortURL
+			})
+			f.users[row.UserID] = append(f.users[row.UserID], row.ShortURL)
+		}
+		*existing = row
+	} else {
+		f.rows[row.ShortURL] = &row
+		f.users[row.UserID] = append(f.users[row.UserID], row.ShortURL)
+		f.counter++
+		// The IDs of the purged rows are not given out again
+		if id, err := strconv.Atoi(row.ID); err == nil && id > f.counter {
+			f.counter = id
+		}
+	}
+	f.urls[newUserURL(row.UserID, row.OriginalURL, row.NormalizedURL)] = row.ShortURL
+}
+
+// appendRecords - writes the records to the end of the file and applies them to the indexes.
+// The caller should hold the lock.
+func (f *FileStorage) appendRecords(rows ...Row) error {
+	// Write all records at once, so a batch is never split between writes
+	var buf []byte
+	for _, row := range rows {
+		record, err := encodeRecord(row)
 		if err != nil {
-			file.Close()
+			return err
+		}
+		buf = append(buf, record...)
+	}
+	if _, err := f.file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write to file: %s", err)
+	}
+
+	switch f.syncPolicy {
+	case SyncAlways:
+		if err := f.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync file: %w", err)
 		}
-	}()
+	case SyncInterval:
+		f.dirty = true
+	}
 
-	return &FileStorage{
-		filePath: filePath,
-		file:     file,
-		encoder:  json.NewEncoder(file),
-		counter:  count,
-	}, nil
+	for _, row := range rows {
+		f.apply(row)
+	}
+	return nil
 }
 
-func (f *FileStorage) Set(ctx context.Context, OriginalURL string, userID string) (string, error) {
+// syncPeriodically - flushes the written records to the disk until the storage is closed
+func (f *FileStorage) syncPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(f.syncDone)
+
+	for {
+		select {
+		case <-f.stopSync:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			if f.dirty {
+				if err := f.file.Sync(); err != nil {
+					log.Printf("Failed to sync file storage: %v\n", err)
+				} else {
+					f.dirty = false
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+func (f *FileStorage) Set(ctx context.Context, link models.Link) (string, error) {
 	select {
 	case <-ctx.Done(): // Check if the context is canceled
 		return "", ctx.Err()
 	default:
 	}
 
-	urlKey := urlkey.GenerateSlug(OriginalURL)
-	if urlKey == "" {
-		return "", fmt.Errorf("shortURL is empty")
-	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	//Check for duplications
-	if storedURL, _ := f.Get(ctx, urlKey); storedURL != "" {
-		err := fmt.Errorf("the URL: %s is already stored in the file", storedURL)
-		return urlKey, NewStorageError("already exists", storedURL, urlKey, err)
+	if storedKey, found := f.urls[newUserURL(link.UserID, link.OriginalURL, link.NormalizedURL)]; found {
+		err := fmt.Errorf("the URL: %s is already stored in the file", link.OriginalURL)
+		return storedKey, NewStorageError("already exists", link.OriginalURL, storedKey, err)
 	}
 
-	rowID := strconv.Itoa(f.counter + 1)
+	urlKey := link.ShortURL
+	if urlKey != "" {
+		// The custom alias should not be used by another URL
+		if _, taken := f.rows[urlKey]; taken {
+			return "", NewStorageError("alias taken", link.OriginalURL, urlKey, nil)
+		}
+	} else {
+		var err error
+		urlKey, err = f.freeKey(dedupURL(link.OriginalURL, link.NormalizedURL))
+		if err != nil {
+			return "", err
+		}
+	}
 
+	now := time.Now().UTC()
 	row := Row{
-		ID:          rowID,
-		UserID:      userID,
-		ShortURL:    urlKey,
-		OriginalURL: OriginalURL,
+		ID:            strconv.Itoa(f.counter + 1),
+		UserID:        link.UserID,
+		ShortURL:      urlKey,
+		OriginalURL:   link.OriginalURL,
+		NormalizedURL: dedupURL(link.OriginalURL, link.NormalizedURL), // a record without it is older than the normalization
+		ExpiresAt:     link.ExpiresAt,
+		CreatedAt:     &now,
+		Tags:          link.Tags,
+		Folder:        link.Folder,
 	}
 
-	// Write JSON entry
-	err := f.encoder.Encode(row)
-	if err != nil {
-		return "", fmt.Errorf("failed to write to file: %s", err)
+	if err := f.appendRecords(row); err != nil {
+		return "", err
 	}
-	f.counter++
 	return urlKey, nil
 }
 
@@ -102,17 +501,26 @@ func (f *FileStorage) SetBatch(ctx context.Context, jReqBatch []models.JSONReq,
 	default:
 	}
 
-	jResBatch := make([]models.JSONRes, len(jReqBatch))
+	jResBatch := make([]models.JSONRes, 0, len(jReqBatch))
 
 	for _, el := range jReqBatch {
-		ShortURL, err := f.Set(ctx, el.OriginalURL, userID)
-		if err != nil {
+		link := models.Link{
+			ShortURL:      el.Alias,
+			OriginalURL:   el.OriginalURL,
+			NormalizedURL: el.NormalizedURL,
+			UserID:        userID,
+			ExpiresAt:     el.ExpiresAt,
+			Tags:          el.Tags,
+			Folder:        el.Folder,
+		}
+		ShortURL, err := f.Set(ctx, link)
+		if err != nil && !IsErrorType(err, "already exists") {
 			return nil, err
 		}
 
 		row := models.JSONRes{
 			CorrID:      el.CorrID,
-			ShortURL:    ShortURL,
+			ShortURL:    config.AppConfig.ResultHost + "/" + ShortURL,
 			OriginalURL: el.OriginalURL,
 		}
 		jResBatch = append(jResBatch, row)
@@ -120,54 +528,667 @@ func (f *FileStorage) SetBatch(ctx context.Context, jReqBatch []models.JSONReq,
 	return jResBatch, nil
 }
 
-func (f *FileStorage) DeleteBatch(ctx context.Context, keysToDelete []models.KeysToDelete) (bool, error) {
+// DeleteBatch - appends tombstones for the keys owned by the users
+func (f *FileStorage) DeleteBatch(ctx context.Context, keysToDelete []models.KeysToDelete) ([]models.DeleteResult, error) {
 	select {
 	case <-ctx.Done(): // Check if the context is canceled
-		return false, ctx.Err()
+		return nil, ctx.Err()
 	default:
 	}
 
 	if len(keysToDelete) == 0 {
-		return false, errors.New("no URLs provided for deletion")
+		return nil, errors.New("no URLs provided for deletion")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now().UTC()
+	results := []models.DeleteResult{}
+	tombstones := []Row{}
+	// A key repeated in the batch is only deleted once
+	deleting := make(map[string]bool)
+
+	for _, item := range keysToDelete {
+		for _, key := range item.Keys {
+			row, found := f.rows[key]
+			status := deleteOutcome(found, found && row.UserID == item.UserID, found && (row.DeletedFlag || deleting[key]))
+			if status == DeleteDeleted {
+				tombstones = append(tombstones, Row{Op: opDelete, ShortURL: key, UserID: item.UserID, DeletedAt: &now})
+				deleting[key] = true
+			}
+			results = append(results, models.DeleteResult{Key: key, Status: status})
+		}
+	}
+	if len(tombstones) == 0 {
+		return results, nil
+	}
+
+	if err := f.appendRecords(tombstones...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Restore - appends the rows of the user's deleted links with the deletion cleared
+func (f *FileStorage) Restore(ctx context.Context, userID string, keys []string) ([]string, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return nil, ctx.Err()
+	default:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	restored := []string{}
+	rows := []Row{}
+	for _, key := range keys {
+		row, found := f.rows[key]
+		if !found || row.UserID != userID || !row.DeletedFlag {
+			continue
+		}
+		updated := *row
+		updated.DeletedFlag = false
+		updated.DeletedAt = nil
+		rows = append(rows, updated)
+		restored = append(restored, key)
+	}
+	if len(rows) == 0 {
+		return restored, nil
+	}
+
+	if err := f.appendRecords(rows...); err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// PurgeDeleted - appends purge records for the links deleted before the given time
+// and rewrites the files, so the purged links and their clicks are removed from the disk
+func (f *FileStorage) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return 0, ctx.Err()
+	default:
+	}
+
+	f.mu.Lock()
+	purges := []Row{}
+	purged := make(map[string]bool)
+	for key, row := range f.rows {
+		if row.DeletedFlag && row.DeletedAt != nil && row.DeletedAt.Before(before) {
+			purges = append(purges, Row{Op: opPurge, ShortURL: key})
+			purged[key] = true
+		}
 	}
+	var err error
+	if len(purges) > 0 {
+		err = f.appendRecords(purges...)
+	}
+	f.mu.Unlock()
+
+	if len(purges) == 0 || err != nil {
+		return 0, err
+	}
+	if err := f.Compact(); err != nil {
+		return len(purges), err
+	}
+	return len(purges), f.purgeClicks(purged)
+}
 
-	// Read data from the file
-	data, err := os.ReadFile(f.filePath)
+// loadDeletes - reads the deletion queue journal
+func (f *FileStorage) loadDeletes() error {
+	f.deletes = newDeletionList()
+
+	data, err := os.ReadFile(f.deletesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		return false, fmt.Errorf("failed to read file: %s", err)
+		return fmt.Errorf("failed to read deletion queue: %w", err)
 	}
 
-	var rows []Row
+	for _, line := range splitLines(string(data)) {
+		var entry models.PendingDeletion
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			log.Printf("Skipped a corrupted entry of the deletion queue %s: %v\n", f.deletesPath, err)
+			continue
+		}
+		f.deletes.add(entry)
+	}
+	return nil
+}
 
-	// Unmarshal the data
-	if err := json.Unmarshal(data, &rows); err != nil {
-		return false, fmt.Errorf("failed to unmarshal JSON: %w", err)
+// saveDeletes - atomically rewrites the journal with the current queue.
+// The caller should hold deletesMutex.
+func (f *FileStorage) saveDeletes() error {
+	var sb strings.Builder
+	for _, entry := range f.deletes.all() {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode deletion: %w", err)
+		}
+		sb.Write(line)
+		sb.WriteString("\n")
 	}
+	return replaceFile(f.deletesPath, []byte(sb.String()))
+}
 
-	// Set items as deleted
-	for _, item := range keysToDelete {
-		for _, key := range item.Keys {
-			for i, row := range rows {
-				if row.ShortURL == key && row.UserID == item.UserID {
-					// Mark the row as deleted
-					rows[i].DeletedFlag = true
-				}
-			}
+// EnqueueDeletion - writes the request to the journal before it is acknowledged
+func (f *FileStorage) EnqueueDeletion(ctx context.Context, item models.KeysToDelete) error {
+	f.deletesMutex.Lock()
+	defer f.deletesMutex.Unlock()
+
+	f.deletes.enqueue(item)
+	return f.saveDeletes()
+}
+
+func (f *FileStorage) PendingDeletions(ctx context.Context, now time.Time, limit int) ([]models.PendingDeletion, error) {
+	f.deletesMutex.Lock()
+	defer f.deletesMutex.Unlock()
+
+	return f.deletes.pending(now, limit), nil
+}
+
+func (f *FileStorage) CompleteDeletions(ctx context.Context, ids []int64) error {
+	f.deletesMutex.Lock()
+	defer f.deletesMutex.Unlock()
+
+	f.deletes.complete(ids)
+	return f.saveDeletes()
+}
+
+func (f *FileStorage) RetryDeletion(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) error {
+	f.deletesMutex.Lock()
+	defer f.deletesMutex.Unlock()
+
+	if err := f.deletes.fail(id, lastError, nextAttemptAt, false); err != nil {
+		return err
+	}
+	return f.saveDeletes()
+}
+
+func (f *FileStorage) DeadLetterDeletion(ctx context.Context, id int64, lastError string) error {
+	f.deletesMutex.Lock()
+	defer f.deletesMutex.Unlock()
+
+	if err := f.deletes.fail(id, lastError, time.Now().UTC(), true); err != nil {
+		return err
+	}
+	return f.saveDeletes()
+}
+
+func (f *FileStorage) DeadDeletions(ctx context.Context) ([]models.PendingDeletion, error) {
+	f.deletesMutex.Lock()
+	defer f.deletesMutex.Unlock()
+
+	return f.deletes.dead(), nil
+}
+
+// loadAPIKeys - reads the API keys file
+func (f *FileStorage) loadAPIKeys() error {
+	f.apiKeys = newAPIKeyList()
+
+	data, err := os.ReadFile(f.apiKeysPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read API keys: %w", err)
+	}
+
+	for _, line := range splitLines(string(data)) {
+		var key models.APIKey
+		if err := json.Unmarshal([]byte(line), &key); err != nil {
+			log.Printf("Skipped a corrupted API key in %s: %v\n", f.apiKeysPath, err)
+			continue
+		}
+		if err := f.apiKeys.add(key); err != nil {
+			log.Printf("Skipped a duplicated API key in %s: %v\n", f.apiKeysPath, err)
+		}
+	}
+	return nil
+}
+
+// saveAPIKeys - atomically rewrites the API keys file.
+// The caller should hold apiKeysMutex.
+func (f *FileStorage) saveAPIKeys() error {
+	var sb strings.Builder
+	for _, key := range f.apiKeys.all() {
+		line, err := json.Marshal(key)
+		if err != nil {
+			return fmt.Errorf("failed to encode API key: %w", err)
 		}
+		sb.Write(line)
+		sb.WriteString("\n")
+	}
+	return replaceFile(f.apiKeysPath, []byte(sb.String()))
+}
+
+func (f *FileStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	f.apiKeysMutex.Lock()
+	defer f.apiKeysMutex.Unlock()
+
+	if err := f.apiKeys.add(key); err != nil {
+		return err
+	}
+	return f.saveAPIKeys()
+}
+
+func (f *FileStorage) GetAPIKey(ctx context.Context, hash string) (models.APIKey, error) {
+	f.apiKeysMutex.RLock()
+	defer f.apiKeysMutex.RUnlock()
+
+	return f.apiKeys.get(hash)
+}
+
+func (f *FileStorage) GetUserAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error) {
+	f.apiKeysMutex.RLock()
+	defer f.apiKeysMutex.RUnlock()
+
+	return f.apiKeys.user(userID), nil
+}
+
+func (f *FileStorage) RevokeAPIKey(ctx context.Context, userID string, id string) error {
+	f.apiKeysMutex.Lock()
+	defer f.apiKeysMutex.Unlock()
+
+	revoked, err := f.apiKeys.revoke(userID, id)
+	if err != nil || !revoked {
+		return err
+	}
+	if err := f.saveAPIKeys(); err != nil {
+		// The key stays active, so a retry revokes and saves it again
+		f.apiKeys.byID[id].RevokedAt = nil
+		return err
 	}
+	return nil
+}
 
-	// Marshal updated data
-	newData, err := json.Marshal(rows)
+// loadAccounts - reads the accounts file
+func (f *FileStorage) loadAccounts() error {
+	f.accounts = newUserList()
+
+	data, err := os.ReadFile(f.accountsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		return false, fmt.Errorf("failed to marshal updated rows: %w", err)
+		return fmt.Errorf("failed to read accounts: %w", err)
+	}
+
+	for _, line := range splitLines(string(data)) {
+		var user models.User
+		if err := json.Unmarshal([]byte(line), &user); err != nil {
+			log.Printf("Skipped a corrupted account in %s: %v\n", f.accountsPath, err)
+			continue
+		}
+		if err := f.accounts.add(user); err != nil {
+			log.Printf("Skipped a duplicated account in %s: %v\n", f.accountsPath, err)
+		}
 	}
+	return nil
+}
 
-	// Write data into the file
-	if err := os.WriteFile(f.filePath, newData, 0644); err != nil {
-		return false, fmt.Errorf("failed to write to file: %w", err)
+// saveAccounts - atomically rewrites the accounts file.
+// The caller should hold usersMutex.
+func (f *FileStorage) saveAccounts() error {
+	users := f.accounts.all()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+
+	var sb strings.Builder
+	for _, user := range users {
+		line, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("failed to encode account: %w", err)
+		}
+		sb.Write(line)
+		sb.WriteString("\n")
 	}
+	return replaceFile(f.accountsPath, []byte(sb.String()))
+}
 
-	return true, nil
+func (f *FileStorage) CreateUser(ctx context.Context, user models.User) error {
+	f.usersMutex.Lock()
+	defer f.usersMutex.Unlock()
+
+	if err := f.accounts.add(user); err != nil {
+		return err
+	}
+	return f.saveAccounts()
+}
+
+func (f *FileStorage) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
+	f.usersMutex.RLock()
+	defer f.usersMutex.RUnlock()
+
+	return f.accounts.getByLogin(login)
+}
+
+func (f *FileStorage) GetUser(ctx context.Context, userID string) (models.User, error) {
+	f.usersMutex.RLock()
+	defer f.usersMutex.RUnlock()
+
+	return f.accounts.get(userID)
+}
+
+// loadWorkspaces - reads the workspaces file
+func (f *FileStorage) loadWorkspaces() error {
+	f.workspaces = newWorkspaceList()
+
+	data, err := os.ReadFile(f.wsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read workspaces: %w", err)
+	}
+
+	for _, line := range splitLines(string(data)) {
+		var ws models.Workspace
+		if err := json.Unmarshal([]byte(line), &ws); err != nil {
+			log.Printf("Skipped a corrupted workspace in %s: %v\n", f.wsPath, err)
+			continue
+		}
+		if err := f.workspaces.add(ws); err != nil {
+			log.Printf("Skipped a duplicated workspace in %s: %v\n", f.wsPath, err)
+		}
+	}
+	return nil
+}
+
+// saveWorkspaces - atomically rewrites the workspaces file.
+// The caller should hold wsMutex.
+func (f *FileStorage) saveWorkspaces() error {
+	var sb strings.Builder
+	for _, ws := range f.workspaces.all() {
+		line, err := json.Marshal(ws)
+		if err != nil {
+			return fmt.Errorf("failed to encode workspace: %w", err)
+		}
+		sb.Write(line)
+		sb.WriteString("\n")
+	}
+	return replaceFile(f.wsPath, []byte(sb.String()))
+}
+
+func (f *FileStorage) CreateWorkspace(ctx context.Context, ws models.Workspace) error {
+	f.wsMutex.Lock()
+	defer f.wsMutex.Unlock()
+
+	if err := f.workspaces.add(ws); err != nil {
+		return err
+	}
+	return f.saveWorkspaces()
+}
+
+func (f *FileStorage) GetWorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	f.wsMutex.RLock()
+	defer f.wsMutex.RUnlock()
+
+	return f.workspaces.role(workspaceID, userID)
+}
+
+func (f *FileStorage) GetUserWorkspaces(ctx context.Context, userID string) ([]models.JSONWorkspaceRes, error) {
+	f.wsMutex.RLock()
+	defer f.wsMutex.RUnlock()
+
+	return f.workspaces.user(userID), nil
+}
+
+func (f *FileStorage) GetWorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error) {
+	f.wsMutex.RLock()
+	defer f.wsMutex.RUnlock()
+
+	return f.workspaces.members(workspaceID)
+}
+
+func (f *FileStorage) SetWorkspaceMember(ctx context.Context, workspaceID string, member models.WorkspaceMember) error {
+	f.wsMutex.Lock()
+	defer f.wsMutex.Unlock()
+
+	if err := f.workspaces.setMember(workspaceID, member); err != nil {
+		return err
+	}
+	return f.saveWorkspaces()
+}
+
+func (f *FileStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error {
+	f.wsMutex.Lock()
+	defer f.wsMutex.Unlock()
+
+	if err := f.workspaces.removeMember(workspaceID, userID); err != nil {
+		return err
+	}
+	return f.saveWorkspaces()
+}
+
+// purgeClicks - rewrites the clicks file without the clicks of the given links
+func (f *FileStorage) purgeClicks(keys map[string]bool) error {
+	f.clicksMutex.Lock()
+	defer f.clicksMutex.Unlock()
+
+	data, err := os.ReadFile(f.clicksPath)
+	if err != nil {
+		return fmt.Errorf("failed to read clicks file: %s", err)
+	}
+
+	var sb strings.Builder
+	for _, line := range splitLines(string(data)) {
+		var click models.Click
+		if err := json.Unmarshal([]byte(line), &click); err == nil && keys[click.ShortURL] {
+			continue
+		}
+		sb.WriteString(line + "\n")
+	}
+
+	if err := replaceFile(f.clicksPath, []byte(sb.String())); err != nil {
+		return err
+	}
+	for key := range keys {
+		delete(f.clicks, key)
+	}
+	f.clicksFile.Close()
+	f.clicksFile, err = os.OpenFile(f.clicksPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen clicks file: %w", err)
+	}
+	return nil
+}
+
+// Update - appends the row with the new URL, the previous one is added to the history of the row
+func (f *FileStorage) Update(ctx context.Context, link models.Link) error {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return ctx.Err()
+	default:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	row, found := f.rows[link.ShortURL]
+	if !found || row.UserID != link.UserID {
+		return NewStorageError("not found", link.OriginalURL, link.ShortURL, nil)
+	}
+	if row.DeletedFlag {
+		return NewStorageError("deleted", link.OriginalURL, link.ShortURL, nil)
+	}
+	if row.OriginalURL == link.OriginalURL {
+		return nil
+	}
+
+	// The user should not get two links for the same URL
+	storedKey, found := f.urls[newUserURL(link.UserID, link.OriginalURL, link.NormalizedURL)]
+	if found && storedKey != link.ShortURL {
+		return NewStorageError("already exists", link.OriginalURL, storedKey, nil)
+	}
+
+	updated := *row
+	updated.OriginalURL = link.OriginalURL
+	updated.NormalizedURL = dedupURL(link.OriginalURL, link.NormalizedURL)
+	updated.History = append(append([]models.LinkChange{}, row.History...),
+		models.LinkChange{OriginalURL: row.OriginalURL, ChangedAt: time.Now().UTC()})
+	return f.appendRecords(updated)
+}
+
+// TransferLinks - writes the rows of all transferred links in a single append
+func (f *FileStorage) TransferLinks(ctx context.Context, fromID, toID string, keys []string, actorID string) error {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return ctx.Err()
+	default:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	transfer := models.LinkTransfer{FromID: fromID, ToID: toID, ActorID: actorID, TransferredAt: time.Now().UTC()}
+	updated := make([]Row, 0, len(keys))
+	for _, key := range uniqueKeys(keys) {
+		row, found := f.rows[key]
+		if !found || row.UserID != fromID {
+			return NewStorageError("not found", "", key, nil)
+		}
+		if row.DeletedFlag {
+			return NewStorageError("deleted", row.OriginalURL, key, nil)
+		}
+		// The new owner should not get two links for the same URL
+		if storedKey, found := f.urls[newUserURL(toID, row.OriginalURL, row.NormalizedURL)]; found {
+			return NewStorageError("already exists", row.OriginalURL, storedKey, nil)
+		}
+
+		moved := *row
+		moved.Op = ""
+		moved.UserID = toID
+		moved.Transfers = append(append([]models.LinkTransfer{}, row.Transfers...), transfer)
+		updated = append(updated, moved)
+	}
+	if len(updated) == 0 {
+		return nil
+	}
+	return f.appendRecords(updated...)
+}
+
+func (f *FileStorage) SetLinkLabels(ctx context.Context, ownerID, urlKey string, tags []string, folder string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	row, found := f.rows[urlKey]
+	if !found || row.UserID != ownerID {
+		return NewStorageError("not found", "", urlKey, nil)
+	}
+	updated := *row
+	updated.Op = ""
+	updated.Tags = tags
+	updated.Folder = folder
+	return f.appendRecords(updated)
+}
+
+func (f *FileStorage) GetUserTags(ctx context.Context, ownerID string) ([]models.TagCount, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	counter := tagCounter{}
+	for _, key := range f.users[ownerID] {
+		if row, found := f.rows[key]; found && row.UserID == ownerID {
+			counter.add(row.toLink())
+		}
+	}
+	return counter.counts(), nil
+}
+
+// RenameTag - writes the rows of all renamed links in a single append
+func (f *FileStorage) RenameTag(ctx context.Context, ownerID, from, to string) (int, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return 0, ctx.Err()
+	default:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	updated := []Row{}
+	for _, key := range f.users[ownerID] {
+		row, found := f.rows[key]
+		if !found || row.UserID != ownerID {
+			continue
+		}
+		if tags, ok := renameTag(row.Tags, from, to); ok {
+			renamed := *row
+			renamed.Op = ""
+			renamed.Tags = tags
+			updated = append(updated, renamed)
+		}
+	}
+	if len(updated) == 0 {
+		return 0, nil
+	}
+	if err := f.appendRecords(updated...); err != nil {
+		return 0, err
+	}
+	return len(updated), nil
+}
+
+// GetLinkTransfers - returns the owner changes of the link, the oldest first
+func (f *FileStorage) GetLinkTransfers(ctx context.Context, urlKey string) ([]models.LinkTransfer, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	row, found := f.rows[urlKey]
+	if !found {
+		return nil, NewStorageError("not found", "", urlKey, nil)
+	}
+	return append([]models.LinkTransfer{}, row.Transfers...), nil
+}
+
+// GetLinkHistory - returns the previous destinations of the link
+func (f *FileStorage) GetLinkHistory(ctx context.Context, urlKey string) ([]models.LinkChange, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return nil, ctx.Err()
+	default:
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	row, found := f.rows[urlKey]
+	if !found {
+		return nil, NewStorageError("not found", "", urlKey, nil)
+	}
+	return append([]models.LinkChange{}, row.History...), nil
+}
+
+// ExpireLinks - marks the links whose expiry time has passed
+func (f *FileStorage) ExpireLinks(ctx context.Context) (int, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return 0, ctx.Err()
+	default:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	expired := []Row{}
+
+	for _, row := range f.rows {
+		if !row.ExpiredFlag && row.ExpiresAt != nil && !row.ExpiresAt.After(now) {
+			updated := *row
+			updated.ExpiredFlag = true
+			expired = append(expired, updated)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	return len(expired), f.appendRecords(expired...)
 }
 
 func (f *FileStorage) Get(ctx context.Context, ShortURL string) (string, error) {
@@ -177,71 +1198,321 @@ func (f *FileStorage) Get(ctx context.Context, ShortURL string) (string, error)
 	default:
 	}
 
-	ShortURL = strings.ToLower(ShortURL)
 	if ShortURL == "" {
 		return "", fmt.Errorf("shortURL is empty")
 	}
 
-	data, err := os.ReadFile(f.filePath)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// Search for the short URL
+	row, found := f.rows[ShortURL]
+	if !found {
+		return "", fmt.Errorf("failed to find OriginalURL by ShortURL: %s", ShortURL)
+	}
+	if row.DeletedFlag {
+		return "", NewStorageError("deleted", row.OriginalURL, ShortURL, nil)
+	}
+	if isExpired(row.ExpiredFlag, row.ExpiresAt) {
+		return "", NewStorageError("expired", row.OriginalURL, ShortURL, nil)
+	}
+	return row.OriginalURL, nil
+}
+
+// GetLink - returns the stored link with its owner and state
+func (f *FileStorage) GetLink(ctx context.Context, ShortURL string) (models.Link, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return models.Link{}, ctx.Err()
+	default:
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	row, found := f.rows[ShortURL]
+	if !found {
+		return models.Link{}, NewStorageError("not found", "", ShortURL, nil)
+	}
+	return row.toLink(), nil
+}
+
+// RecordClicks - appends the clicks to the clicks file
+func (f *FileStorage) RecordClicks(ctx context.Context, clicks []models.Click) error {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return ctx.Err()
+	default:
+	}
+
+	f.clicksMutex.Lock()
+	defer f.clicksMutex.Unlock()
+
+	// Write the whole batch at once, so a click is never split between writes
+	var sb strings.Builder
+	encoder := json.NewEncoder(&sb)
+	for _, click := range clicks {
+		if err := encoder.Encode(click); err != nil {
+			return fmt.Errorf("failed to marshal click: %w", err)
+		}
+	}
+	if _, err := f.clicksFile.WriteString(sb.String()); err != nil {
+		return fmt.Errorf("failed to write to clicks file: %w", err)
+	}
+	for _, click := range clicks {
+		f.countClick(click)
+	}
+	return nil
+}
+
+// loadClicks - counts the clicks stored earlier, so the stats are not read from the file on every request
+func (f *FileStorage) loadClicks() error {
+	data, err := os.ReadFile(f.clicksPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read file: %s", err)
+		return fmt.Errorf("failed to read clicks file: %s", err)
 	}
-	// Search for the short URL
+
+	f.clicks = make(map[string]*clickCounts)
 	for _, line := range splitLines(string(data)) {
-		var row Row
-		err := json.Unmarshal([]byte(line), &row)
-		if err == nil && row.ShortURL == ShortURL {
-			return row.OriginalURL, nil
+		var click models.Click
+		if err := json.Unmarshal([]byte(line), &click); err == nil {
+			f.countClick(click)
 		}
 	}
-	return "", fmt.Errorf("failed to find OriginalURL by ShortURL: %s", ShortURL)
+	return nil
+}
+
+// countClick - adds the click to the counters of its link. The caller should hold clicksMutex.
+func (f *FileStorage) countClick(click models.Click) {
+	counts, found := f.clicks[click.ShortURL]
+	if !found {
+		counts = &clickCounts{}
+		f.clicks[click.ShortURL] = counts
+	}
+	counts.add(click.Time)
 }
 
-func (f *FileStorage) GetUserURLs(ctx context.Context, userID string) ([]models.JSONUserRes, error) {
+func (f *FileStorage) GetLinkStats(ctx context.Context, ShortURL string) (models.LinkStats, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return models.LinkStats{}, ctx.Err()
+	default:
+	}
+
+	f.clicksMutex.Lock()
+	defer f.clicksMutex.Unlock()
+
+	counts, found := f.clicks[ShortURL]
+	if !found {
+		counts = &clickCounts{}
+	}
+	return counts.stats(ShortURL), nil
+}
+
+// GetUserURLs - takes the links of the user found by the index, then filters and pages them
+func (f *FileStorage) GetUserURLs(ctx context.Context, userID string, query URLQuery) (URLPage, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return URLPage{}, ctx.Err()
+	default:
+	}
+
+	f.mu.RLock()
+	links := make([]models.Link, 0, len(f.users[userID]))
+	for _, key := range f.users[userID] {
+		row, found := f.rows[key]
+		if !found || row.UserID != userID {
+			continue
+		}
+		links = append(links, row.toLink())
+	}
+	f.mu.RUnlock()
+
+	return pageLinks(links, query)
+}
+
+// GetUserTrash - returns the deleted links of the user
+func (f *FileStorage) GetUserTrash(ctx context.Context, userID string) ([]models.JSONUserRes, error) {
 	select {
 	case <-ctx.Done(): // Check if the context is canceled
 		return nil, ctx.Err()
 	default:
 	}
 
-	jResBatch := make([]models.JSONUserRes, 0)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 
-	data, err := os.ReadFile(f.filePath)
+	jResBatch := []models.JSONUserRes{}
+	for _, key := range f.users[userID] {
+		row, found := f.rows[key]
+		if !found || row.UserID != userID || !row.DeletedFlag {
+			continue
+		}
+		jResBatch = append(jResBatch, models.JSONUserRes{
+			UserID:      row.UserID,
+			ShortURL:    config.AppConfig.ResultHost + "/" + row.ShortURL,
+			OriginalURL: row.OriginalURL,
+			ExpiresAt:   row.ExpiresAt,
+			State:       StateDeleted,
+			DeletedAt:   row.DeletedAt,
+		})
+	}
+	return jResBatch, nil
+}
+
+// Compact - atomically replaces the file with one that holds only the current rows
+func (f *FileStorage) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rows := make([]*Row, 0, len(f.rows))
+	for _, row := range f.rows {
+		rows = append(rows, row)
+	}
+	// Keep the order of creation
+	sort.Slice(rows, func(i, j int) bool {
+		a, _ := strconv.Atoi(rows[i].ID)
+		b, _ := strconv.Atoi(rows[j].ID)
+		return a < b
+	})
+
+	dir, name := filepath.Split(f.filePath)
+	tmp, err := os.CreateTemp(dir, name+".compact-*")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %s", err)
+		return fmt.Errorf("failed to create temp file: %w", err)
 	}
+	// Remove the temp file if it was not renamed
+	defer os.Remove(tmp.Name())
 
-	// Search all records that were created by user
-	for _, line := range splitLines(string(data)) {
-		var row Row
-		err := json.Unmarshal([]byte(line), &row)
-		if err == nil && row.UserID == userID {
-			row := models.JSONUserRes{
-				UserID:      row.UserID,
-				ShortURL:    row.ShortURL,
-				OriginalURL: row.OriginalURL,
-			}
-			jResBatch = append(jResBatch, row)
+	writer := bufio.NewWriter(tmp)
+	for _, row := range rows {
+		record, err := encodeRecord(*row)
+		if err == nil {
+			_, err = writer.Write(record)
+		}
+		if err != nil {
+			tmp.Close()
+			return err
 		}
 	}
-	if len(jResBatch) == 0 {
-		return nil, fmt.Errorf("failed to find records for userID: %s", userID)
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
 	}
-	return jResBatch, nil
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), f.filePath); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	// Make the rename itself durable
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	// Continue appending to the new file
+	file, err := os.OpenFile(f.filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen file: %w", err)
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.stale = 0
+	f.dirty = false
+	return nil
 }
 
 // Close the file when FileStorage is no longer needed
 func (f *FileStorage) Close() error {
+	if f.stopSync != nil {
+		close(f.stopSync)
+		<-f.syncDone
+		f.stopSync = nil
+	}
+	if f.clicksFile != nil {
+		f.clicksFile.Close()
+	}
 	if f.file != nil {
+		if f.syncPolicy != SyncNever {
+			f.file.Sync()
+		}
 		return f.file.Close()
 	}
 	return nil
 }
 
 func (f *FileStorage) IsAvailable() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
 	return f.file != nil
 }
 
+// freeKey - generates keys until it finds one that is not stored yet.
+// The caller should hold the lock.
+func (f *FileStorage) freeKey(OriginalURL string) (string, error) {
+	for attempt := 0; attempt < urlkey.MaxAttempts; attempt++ {
+		urlKey, err := f.keys.Generate(OriginalURL, attempt)
+		if err != nil || urlKey == "" {
+			return "", fmt.Errorf("failed to generate the short url: %v", err)
+		}
+		if _, taken := f.rows[urlKey]; !taken {
+			return urlKey, nil
+		}
+	}
+	return "", NewStorageError("key collision", OriginalURL, "", errors.New("no free key found"))
+}
+
+// replaceFile - atomically replaces the file with the data
+func replaceFile(filePath string, data []byte) error {
+	dir, name := filepath.Split(filePath)
+	tmp, err := os.CreateTemp(dir, name+".replace-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	// Remove the temp file if it was not renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir - flushes the directory entries, e.g. after a rename
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
 // makeDirInPath - creates directories to store the file
 func makeDirInPath(filePath string) error {
 	dir := filepath.Dir(filePath)
@@ -252,15 +1523,6 @@ func makeDirInPath(filePath string) error {
 	return nil
 }
 
-// countLines - counts lines in the file
-func countLines(filePath string) (int, error) {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return 0, err
-	}
-	return len(splitLines(string(data))), nil
-}
-
 // splitLines - splits the lines by a new line symbol
 func splitLines(data string) []string {
 	lines := []string{}
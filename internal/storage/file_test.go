@@ -0,0 +1,484 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"shorter/internal/models"
+	"shorter/internal/urlkey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFileStorage(t *testing.T, filePath string) *FileStorage {
+	storage, err := NewFileStorage(filePath, urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet), SyncAlways, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestFileStorage_DeleteAndReload(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	kept, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user"})
+	require.NoError(t, err)
+	removed, err := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "user"})
+	require.NoError(t, err)
+
+	results, err := storage.DeleteBatch(ctx, []models.KeysToDelete{{Keys: []string{removed}, UserID: "user"}})
+	require.NoError(t, err)
+	assert.Equal(t, []models.DeleteResult{{Key: removed, Status: DeleteDeleted}}, results)
+
+	_, err = storage.Get(ctx, removed)
+	assert.True(t, IsErrorType(err, "deleted"))
+	storage.Close()
+
+	// The tombstone should survive the restart
+	reloaded := newTestFileStorage(t, filePath)
+
+	retrievedURL, err := reloaded.Get(ctx, kept)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://a.example.com", retrievedURL)
+
+	_, err = reloaded.Get(ctx, removed)
+	assert.True(t, IsErrorType(err, "deleted"))
+
+	page, err := reloaded.GetUserURLs(ctx, "user", URLQuery{})
+	userURLs := page.Links
+	assert.NoError(t, err)
+	assert.Len(t, userURLs, 2)
+}
+
+func TestFileStorage_Compact(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	var keys []string
+	for _, u := range []string{"https://a.example.com", "https://b.example.com", "https://c.example.com"} {
+		key, err := storage.Set(ctx, models.Link{OriginalURL: u, UserID: "user"})
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+	_, err := storage.DeleteBatch(ctx, []models.KeysToDelete{{Keys: keys[:2], UserID: "user"}})
+	require.NoError(t, err)
+	assert.Len(t, readLines(t, filePath), 5, "3 rows and 2 tombstones")
+
+	require.NoError(t, storage.Compact())
+	assert.Len(t, readLines(t, filePath), 3, "Tombstones are merged into the rows")
+
+	// The storage keeps appending to the compacted file
+	_, err = storage.Set(ctx, models.Link{OriginalURL: "https://d.example.com", UserID: "user"})
+	require.NoError(t, err)
+	storage.Close()
+
+	reloaded := newTestFileStorage(t, filePath)
+	_, err = reloaded.Get(ctx, keys[0])
+	assert.True(t, IsErrorType(err, "deleted"))
+
+	retrievedURL, err := reloaded.Get(ctx, keys[2])
+	assert.NoError(t, err)
+	assert.Equal(t, "https://c.example.com", retrievedURL)
+
+	page, _ := reloaded.GetUserURLs(ctx, "user", URLQuery{})
+	userURLs := page.Links
+	assert.Len(t, userURLs, 4)
+}
+
+func readLines(t *testing.T, filePath string) []string {
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	return splitLines(string(data))
+}
+
+func TestFileStorage_Recovery(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	var keys []string
+	for _, u := range []string{"https://a.example.com", "https://b.example.com", "https://c.example.com"} {
+		key, err := storage.Set(ctx, models.Link{OriginalURL: u, UserID: "user"})
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+	storage.Close()
+
+	lines := readLines(t, filePath)
+	require.Len(t, lines, 3)
+
+	// Damage the second record and tear the third one, as a power loss would
+	damaged := strings.Replace(lines[1], "b.example", "x.example", 1)
+	torn := lines[2][:len(lines[2])/2]
+	content := lines[0] + "\n" + damaged + "\n" + lines[2] + "\n" + torn
+	require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+
+	reloaded := newTestFileStorage(t, filePath)
+	assert.Equal(t, RecoveryReport{Loaded: 2, Discarded: 1, Truncated: 1, TruncatedBytes: int64(len(torn))}, reloaded.Recovery)
+
+	_, err := reloaded.Get(ctx, keys[0])
+	assert.NoError(t, err)
+	_, err = reloaded.Get(ctx, keys[1])
+	assert.Error(t, err, "The damaged record should be discarded")
+
+	// New records are appended after the truncated tail
+	_, err = reloaded.Set(ctx, models.Link{OriginalURL: "https://d.example.com", UserID: "user"})
+	require.NoError(t, err)
+	reloaded.Close()
+
+	again := newTestFileStorage(t, filePath)
+	assert.Equal(t, 3, again.Recovery.Loaded)
+	assert.Equal(t, 1, again.Recovery.Discarded)
+	assert.Zero(t, again.Recovery.Truncated)
+}
+
+func TestFileStorage_LegacyRecords(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+
+	// Records written before checksums, the last one without the new line symbol
+	content := `{"uuid":"1","short_url":"2a1f","original_url":"https://aaaa.ru","userid":"u1"}` + "\n" +
+		`{"uuid":"2","short_url":"2a49","original_url":"https://bbbb.ru","userid":"u1","deleted":false}`
+	require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+
+	storage := newTestFileStorage(t, filePath)
+	assert.Equal(t, RecoveryReport{Loaded: 2, Legacy: 2}, storage.Recovery)
+
+	retrievedURL, err := storage.Get(ctx, "2a49")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://bbbb.ru", retrievedURL)
+
+	_, err = storage.Set(ctx, models.Link{OriginalURL: "https://cccc.ru", UserID: "u1"})
+	require.NoError(t, err)
+	assert.Len(t, readLines(t, filePath), 3)
+}
+
+func TestFileStorage_LegacyNormalizedURL(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+
+	// Records written before the normalization, both URLs have the same canonical form
+	content := `{"uuid":"1","short_url":"first","original_url":"HTTPS://Example.com/a","userid":"u1"}` + "\n" +
+		`{"uuid":"2","short_url":"second","original_url":"https://example.com/a#top","userid":"u1"}` + "\n"
+	require.NoError(t, os.WriteFile(filePath, []byte(content), 0644))
+	storage := newTestFileStorage(t, filePath)
+
+	normalizedURL, err := urlkey.Normalize("https://example.com/a", false)
+	require.NoError(t, err)
+	key, err := storage.Set(ctx, models.Link{OriginalURL: "https://example.com/a", NormalizedURL: normalizedURL, UserID: "u1"})
+	assert.True(t, IsErrorType(err, "already exists"), "The old link should be found by its canonical form")
+	assert.Equal(t, "first", key, "The first link should take the canonical form")
+
+	_, err = storage.Get(ctx, "second")
+	assert.NoError(t, err)
+}
+
+func TestFileStorage_Set_SameURLPerUser(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	first, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "first"})
+	require.NoError(t, err)
+	second, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "second"})
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	storage.Close()
+
+	// Both users should keep their links after the restart
+	reloaded := newTestFileStorage(t, filePath)
+
+	again, err := reloaded.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "second"})
+	assert.True(t, IsErrorType(err, "already exists"))
+	assert.Equal(t, second, again)
+
+	page, err := reloaded.GetUserURLs(ctx, "second", URLQuery{})
+	userURLs := page.Links
+	assert.NoError(t, err)
+	assert.Len(t, userURLs, 1)
+}
+
+func TestFileStorage_UpdateAndReload(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	key, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user"})
+	require.NoError(t, err)
+	require.NoError(t, storage.Update(ctx, models.Link{ShortURL: key, OriginalURL: "https://b.example.com", UserID: "user"}))
+	require.NoError(t, storage.Update(ctx, models.Link{ShortURL: key, OriginalURL: "https://c.example.com", UserID: "user"}))
+	require.NoError(t, storage.Compact())
+	storage.Close()
+
+	// The history should survive the compaction and the restart
+	reloaded := newTestFileStorage(t, filePath)
+
+	retrievedURL, err := reloaded.Get(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://c.example.com", retrievedURL)
+
+	history, err := reloaded.GetLinkHistory(ctx, key)
+	assert.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "https://a.example.com", history[0].OriginalURL)
+	assert.Equal(t, "https://b.example.com", history[1].OriginalURL)
+
+	_, err = reloaded.Set(ctx, models.Link{OriginalURL: "https://c.example.com", UserID: "user"})
+	assert.True(t, IsErrorType(err, "already exists"))
+}
+
+func TestFileStorage_StatsReload(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	now := time.Now()
+	require.NoError(t, storage.RecordClicks(ctx, []models.Click{
+		{ShortURL: "a", Time: now.Add(-10 * 24 * time.Hour)},
+		{ShortURL: "a", Time: now},
+		{ShortURL: "b", Time: now},
+	}))
+	require.NoError(t, storage.RecordClicks(ctx, []models.Click{{ShortURL: "a", Time: now}}))
+
+	check := func(storage *FileStorage) {
+		stats, err := storage.GetLinkStats(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, 3, stats.Total)
+		assert.Len(t, stats.Daily, 2)
+		require.Len(t, stats.Hourly, 1, "The old click is out of the hourly window")
+		assert.Equal(t, 2, stats.Hourly[0].Clicks)
+	}
+	check(storage)
+	storage.Close()
+
+	// The counters are rebuilt from the clicks file
+	check(newTestFileStorage(t, filePath))
+}
+
+func TestFileStorage_RestoreAndPurge(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	restored, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user"})
+	require.NoError(t, err)
+	purged, err := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "user"})
+	require.NoError(t, err)
+	require.NoError(t, storage.RecordClicks(ctx, []models.Click{{ShortURL: purged, Time: time.Now()}}))
+
+	_, err = storage.DeleteBatch(ctx, []models.KeysToDelete{{Keys: []string{restored, purged}, UserID: "user"}})
+	require.NoError(t, err)
+
+	keys, err := storage.Restore(ctx, "user", []string{restored})
+	require.NoError(t, err)
+	assert.Equal(t, []string{restored}, keys)
+
+	// Nothing is deleted long enough yet
+	count, err := storage.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	count, err = storage.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	storage.Close()
+
+	reloaded := newTestFileStorage(t, filePath)
+
+	retrievedURL, err := reloaded.Get(ctx, restored)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://a.example.com", retrievedURL)
+
+	_, err = reloaded.GetLink(ctx, purged)
+	assert.True(t, IsErrorType(err, "not found"))
+
+	trash, err := reloaded.GetUserTrash(ctx, "user")
+	assert.NoError(t, err)
+	assert.Empty(t, trash)
+
+	stats, err := reloaded.GetLinkStats(ctx, purged)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Total, "The clicks of the purged link should be removed")
+	assert.Len(t, readLines(t, filePath), 1)
+}
+
+func TestFileStorage_DeletionQueueReload(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	require.NoError(t, storage.EnqueueDeletion(ctx, models.KeysToDelete{Keys: []string{"a"}, UserID: "user", JobID: "job1"}))
+	require.NoError(t, storage.EnqueueDeletion(ctx, models.KeysToDelete{Keys: []string{"b"}, UserID: "user"}))
+	require.NoError(t, storage.EnqueueDeletion(ctx, models.KeysToDelete{Keys: []string{"c"}, UserID: "user"}))
+	now := time.Now()
+
+	pending, err := storage.PendingDeletions(ctx, now, 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+	require.NoError(t, storage.CompleteDeletions(ctx, []int64{pending[0].ID}))
+	require.NoError(t, storage.DeadLetterDeletion(ctx, pending[2].ID, "timeout"))
+	storage.Close()
+
+	// The requests that were not finished should be replayed after the restart
+	reloaded := newTestFileStorage(t, filePath)
+
+	pending, err = reloaded.PendingDeletions(ctx, now, 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, []string{"b"}, pending[0].Item.Keys)
+
+	dead, err := reloaded.DeadDeletions(ctx)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, "timeout", dead[0].LastError)
+
+	// New requests should not reuse the IDs
+	require.NoError(t, reloaded.EnqueueDeletion(ctx, models.KeysToDelete{Keys: []string{"d"}, UserID: "user"}))
+	pending, err = reloaded.PendingDeletions(ctx, time.Now(), 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Greater(t, pending[1].ID, dead[0].ID)
+}
+
+func TestFileStorage_APIKeysReload(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	require.NoError(t, storage.CreateAPIKey(ctx, models.APIKey{ID: "k1", UserID: "user", Hash: "hash1", CreatedAt: time.Now()}))
+	require.NoError(t, storage.CreateAPIKey(ctx, models.APIKey{ID: "k2", UserID: "user", Hash: "hash2", CreatedAt: time.Now()}))
+	require.NoError(t, storage.RevokeAPIKey(ctx, "user", "k2"))
+	storage.Close()
+
+	reloaded := newTestFileStorage(t, filePath)
+
+	key, err := reloaded.GetAPIKey(ctx, "hash1")
+	require.NoError(t, err)
+	assert.Equal(t, "user", key.UserID)
+
+	_, err = reloaded.GetAPIKey(ctx, "hash2")
+	assert.True(t, IsErrorType(err, "not found"), "The revocation should survive the restart")
+
+	keys, err := reloaded.GetUserAPIKeys(ctx, "user")
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+}
+
+func TestFileStorage_RevokeAPIKey_SaveFails(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "data.txt")
+	storage := newTestFileStorage(t, filePath)
+	require.NoError(t, storage.CreateAPIKey(ctx, models.APIKey{ID: "k1", UserID: "user", Hash: "hash1", CreatedAt: time.Now()}))
+
+	// The keys file cannot be written into a missing directory
+	keysPath := storage.apiKeysPath
+	storage.apiKeysPath = filepath.Join(dir, "missing", "data.txt.keys")
+	assert.Error(t, storage.RevokeAPIKey(ctx, "user", "k1"))
+	_, err := storage.GetAPIKey(ctx, "hash1")
+	assert.NoError(t, err, "The key should stay active when the revocation is not saved")
+
+	storage.apiKeysPath = keysPath
+	require.NoError(t, storage.RevokeAPIKey(ctx, "user", "k1"))
+	storage.Close()
+
+	_, err = newTestFileStorage(t, filePath).GetAPIKey(ctx, "hash1")
+	assert.True(t, IsErrorType(err, "not found"), "The retried revocation should be saved")
+}
+
+func TestFileStorage_UsersReload(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	require.NoError(t, storage.CreateUser(ctx, models.User{ID: "u1", Login: "alice", PasswordHash: "hash", CreatedAt: time.Now()}))
+	assert.True(t, IsErrorType(storage.CreateUser(ctx, models.User{ID: "u2", Login: "alice"}), "already exists"))
+	assert.True(t, IsErrorType(storage.CreateUser(ctx, models.User{ID: "u1", Login: "bob"}), "already exists"))
+	storage.Close()
+
+	reloaded := newTestFileStorage(t, filePath)
+
+	user, err := reloaded.GetUserByLogin(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, "u1", user.ID)
+	assert.Equal(t, "hash", user.PasswordHash)
+
+	_, err = reloaded.GetUser(ctx, "u2")
+	assert.True(t, IsErrorType(err, "not found"))
+}
+
+func TestFileStorage_TransferLinksReload(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	first, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "alice"})
+	require.NoError(t, err)
+	second, err := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "alice"})
+	require.NoError(t, err)
+
+	err = storage.TransferLinks(ctx, "alice", "ws_team", []string{first, "missing"}, "alice")
+	assert.True(t, IsErrorType(err, "not found"))
+	require.NoError(t, storage.TransferLinks(ctx, "alice", "ws_team", []string{first, second}, "alice"))
+	require.NoError(t, storage.TransferLinks(ctx, "ws_team", "bob", []string{second}, "alice"))
+	storage.Close()
+
+	// The owners and the audit trail should survive the restart
+	reloaded := newTestFileStorage(t, filePath)
+
+	page, err := reloaded.GetUserURLs(ctx, "ws_team", URLQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Links, 1)
+	assert.Equal(t, "https://a.example.com", page.Links[0].OriginalURL)
+	page, err = reloaded.GetUserURLs(ctx, "bob", URLQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Links, 1)
+	assert.Equal(t, "https://b.example.com", page.Links[0].OriginalURL)
+
+	transfers, err := reloaded.GetLinkTransfers(ctx, second)
+	require.NoError(t, err)
+	require.Len(t, transfers, 2)
+	assert.Equal(t, "ws_team", transfers[0].ToID)
+	assert.Equal(t, "bob", transfers[1].ToID)
+
+	_, err = reloaded.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "bob"})
+	assert.True(t, IsErrorType(err, "already exists"))
+}
+
+func TestFileStorage_TagsReload(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	storage := newTestFileStorage(t, filePath)
+
+	first, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user", Tags: []string{"spring"}})
+	require.NoError(t, err)
+	second, err := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "user"})
+	require.NoError(t, err)
+	require.NoError(t, storage.SetLinkLabels(ctx, "user", second, []string{"autumn", "spring"}, "campaigns"))
+
+	renamed, err := storage.RenameTag(ctx, "user", "spring", "seasonal")
+	require.NoError(t, err)
+	assert.Equal(t, 2, renamed)
+	storage.Close()
+
+	// The labels should survive the restart
+	reloaded := newTestFileStorage(t, filePath)
+
+	tags, err := reloaded.GetUserTags(ctx, "user")
+	require.NoError(t, err)
+	assert.Equal(t, []models.TagCount{{Tag: "autumn", Count: 1}, {Tag: "seasonal", Count: 2}}, tags)
+
+	page, err := reloaded.GetUserURLs(ctx, "user", URLQuery{Folder: "campaigns"})
+	require.NoError(t, err)
+	require.Len(t, page.Links, 1)
+	assert.Equal(t, []string{"autumn", "seasonal"}, page.Links[0].Tags)
+
+	link, err := reloaded.GetLink(ctx, first)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"seasonal"}, link.Tags)
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"shorter/internal/config"
+	"shorter/internal/models"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sort orders of GetUserURLs, the key of the link breaks the ties
+const (
+	SortCreatedAsc  = "created"
+	SortCreatedDesc = "-created"
+	SortURLAsc      = "url"
+	SortURLDesc     = "-url"
+)
+
+// IsSort - checks if the value is one of the known sort orders
+func IsSort(sort string) bool {
+	switch sort {
+	case SortCreatedAsc, SortCreatedDesc, SortURLAsc, SortURLDesc:
+		return true
+	}
+	return false
+}
+
+// URLQuery - selects a page of the user's links. The zero value returns all links, the newest first.
+type URLQuery struct {
+	Domain      string     // the host of the destination or its parent domain
+	CreatedFrom *time.Time // inclusive
+	CreatedTo   *time.Time // exclusive
+	State       string     // one of the link states, any state if empty
+	Search      string     // a case-insensitive substring of the destination or the key
+	Tags        []string   // the links should have all of them
+	Folder      string
+	Sort        string
+	Cursor      string // the NextCursor of the previous page
+	Limit       int    // no limit if zero
+}
+
+// URLPage - the links of the page and the cursor of the next one, empty on the last page
+type URLPage struct {
+	Links      []models.JSONUserRes
+	NextCursor string
+}
+
+// sortOrder - the sort of the query, the newest first by default
+func (q URLQuery) sortOrder() string {
+	if q.Sort == "" {
+		return SortCreatedDesc
+	}
+	return q.Sort
+}
+
+// cursor - the position after the last link of a page. The sort is kept to reject the cursors of another order.
+type cursor struct {
+	Sort      string    `json:"s"`
+	CreatedAt time.Time `json:"c,omitempty"`
+	URL       string    `json:"u,omitempty"`
+	Key       string    `json:"k"`
+}
+
+func encodeCursor(sort string, link models.Link) string {
+	c := cursor{Sort: sort, Key: link.ShortURL}
+	if sort == SortURLAsc || sort == SortURLDesc {
+		c.URL = link.OriginalURL
+	} else {
+		c.CreatedAt = link.CreatedAt.UTC()
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor - returns nil for the first page
+func decodeCursor(q URLQuery) (*cursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, NewStorageError("invalid cursor", "", "", err)
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, NewStorageError("invalid cursor", "", "", err)
+	}
+	if c.Sort != q.sortOrder() || c.Key == "" {
+		return nil, NewStorageError("invalid cursor", "", "", nil)
+	}
+	return &c, nil
+}
+
+// linkDomain - the lowercase host of the destination
+func linkDomain(link models.Link) string {
+	u, err := url.Parse(dedupURL(link.OriginalURL, link.NormalizedURL))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// matches - checks the link against the filters of the query
+func (q URLQuery) matches(link models.Link) bool {
+	if q.Domain != "" {
+		domain := strings.ToLower(q.Domain)
+		host := linkDomain(link)
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+	if q.CreatedFrom != nil && link.CreatedAt.Before(*q.CreatedFrom) {
+		return false
+	}
+	if q.CreatedTo != nil && !link.CreatedAt.Before(*q.CreatedTo) {
+		return false
+	}
+	if q.State != "" && linkState(link.DeletedFlag, link.ExpiredFlag, link.ExpiresAt) != q.State {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !slices.Contains(link.Tags, tag) {
+			return false
+		}
+	}
+	if q.Folder != "" && link.Folder != q.Folder {
+		return false
+	}
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(link.OriginalURL), search) && !strings.Contains(strings.ToLower(link.ShortURL), search) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareLinks - orders the links by the sort, then by the key
+func compareLinks(sort string, a, b models.Link) int {
+	var c int
+	switch sort {
+	case SortURLAsc, SortURLDesc:
+		c = strings.Compare(a.OriginalURL, b.OriginalURL)
+	default:
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ShortURL, b.ShortURL)
+	}
+	if sort == SortCreatedDesc || sort == SortURLDesc {
+		return -c
+	}
+	return c
+}
+
+// pageLinks - filters, sorts and pages the links of the user taken from the index of a storage
+func pageLinks(links []models.Link, q URLQuery) (URLPage, error) {
+	after, err := decodeCursor(q)
+	if err != nil {
+		return URLPage{}, err
+	}
+	sort := q.sortOrder()
+
+	selected := make([]models.Link, 0, len(links))
+	for _, link := range links {
+		if !q.matches(link) {
+			continue
+		}
+		// Skip the links up to the cursor
+		if after != nil {
+			last := models.Link{ShortURL: after.Key, OriginalURL: after.URL, CreatedAt: after.CreatedAt}
+			if compareLinks(sort, link, last) <= 0 {
+				continue
+			}
+		}
+		selected = append(selected, link)
+	}
+	slices.SortFunc(selected, func(a, b models.Link) int {
+		return compareLinks(sort, a, b)
+	})
+
+	page := URLPage{}
+	if q.Limit > 0 && len(selected) > q.Limit {
+		selected = selected[:q.Limit]
+		page.NextCursor = encodeCursor(sort, selected[len(selected)-1])
+	}
+	page.Links = make([]models.JSONUserRes, 0, len(selected))
+	for _, link := range selected {
+		page.Links = append(page.Links, userURLRes(link))
+	}
+	return page, nil
+}
+
+// userURLRes - the link as it is listed to its owner
+func userURLRes(link models.Link) models.JSONUserRes {
+	res := models.JSONUserRes{
+		UserID:      link.UserID,
+		ShortURL:    config.AppConfig.ResultHost + "/" + link.ShortURL,
+		OriginalURL: link.OriginalURL,
+		ExpiresAt:   link.ExpiresAt,
+		State:       linkState(link.DeletedFlag, link.ExpiredFlag, link.ExpiresAt),
+		DeletedAt:   link.DeletedAt,
+		Tags:        link.Tags,
+		Folder:      link.Folder,
+	}
+	if !link.CreatedAt.IsZero() {
+		createdAt := link.CreatedAt
+		res.CreatedAt = &createdAt
+	}
+	return res
+}
@@ -4,40 +4,131 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"shorter/internal/config"
 	"shorter/internal/models"
 	"shorter/internal/urlkey"
-	"strings"
+	"slices"
+	"sync"
+	"time"
 )
 
+// memoryShards - the number of independently locked parts of the link map
+const memoryShards = 32
+
+type memoryShard struct {
+	mu        sync.RWMutex
+	links     map[string]*models.Link
+	history   map[string][]models.LinkChange
+	transfers map[string][]models.LinkTransfer
+}
+
+// MemoryStorage keeps links in sharded maps, so concurrent requests only contend
+// for the shard of their key. The URL and user indexes are guarded by indexMutex.
+// Locks are always taken in the order: indexMutex, then a shard.
 type MemoryStorage struct {
-	data map[string][]string
+	shards       [memoryShards]*memoryShard
+	indexMutex   sync.RWMutex
+	urls         map[userURL]string             // (UserID, NormalizedURL) -> key
+	users        map[string]map[string]struct{} // UserID -> keys
+	clicksMutex  sync.Mutex
+	clicks       map[string][]models.Click
+	deletesMutex sync.Mutex
+	deletes      *deletionList
+	apiKeysMutex sync.RWMutex
+	apiKeys      *apiKeyList
+	usersMutex   sync.RWMutex
+	accounts     *userList
+	wsMutex      sync.RWMutex
+	workspaces   *workspaceList
+	keys         urlkey.KeyGenerator
 }
 
 // NewMemoryStorage - constructor to create a new MemoryStorage
-func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{data: make(map[string][]string)}
+func NewMemoryStorage(keys urlkey.KeyGenerator) *MemoryStorage {
+	m := &MemoryStorage{
+		urls:       make(map[userURL]string),
+		users:      make(map[string]map[string]struct{}),
+		clicks:     make(map[string][]models.Click),
+		deletes:    newDeletionList(),
+		apiKeys:    newAPIKeyList(),
+		accounts:   newUserList(),
+		workspaces: newWorkspaceList(),
+		keys:       keys,
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{
+			links:     make(map[string]*models.Link),
+			history:   make(map[string][]models.LinkChange),
+			transfers: make(map[string][]models.LinkTransfer),
+		}
+	}
+	return m
+}
+
+// shard - returns the shard the key belongs to
+func (m *MemoryStorage) shard(urlKey string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(urlKey))
+	return m.shards[h.Sum32()%memoryShards]
 }
 
 // Set - stores a url into the memory storage
-func (m *MemoryStorage) Set(ctx context.Context, OriginalURL string, userID string) (string, error) {
+func (m *MemoryStorage) Set(ctx context.Context, link models.Link) (string, error) {
 	select {
 	case <-ctx.Done(): // Check if the context is canceled
 		return "", ctx.Err()
 	default:
 	}
 
-	urlKey := urlkey.GenerateSlug(OriginalURL)
-	if urlKey == "" {
-		return "", fmt.Errorf("ShortURL is empty")
+	m.indexMutex.Lock()
+	defer m.indexMutex.Unlock()
+
+	if storedKey, found := m.urls[newUserURL(link.UserID, link.OriginalURL, link.NormalizedURL)]; found {
+		err := fmt.Errorf("the URL: %s is already stored in the memory", link.OriginalURL)
+		return storedKey, NewStorageError("already exists", link.OriginalURL, storedKey, err)
 	}
-	existing, found := m.data[urlKey]
 
-	if found && existing[0] != "" {
-		err := fmt.Errorf("the URL: %s is already stored in the memory", m.data[urlKey])
-		return urlKey, NewStorageError("already exists", OriginalURL, urlKey, err)
+	if link.ShortURL != "" {
+		if !m.insert(link) {
+			return "", NewStorageError("alias taken", link.OriginalURL, link.ShortURL, nil)
+		}
+		return link.ShortURL, nil
 	}
-	m.data[urlKey] = []string{OriginalURL, userID}
-	return urlKey, nil
+
+	for attempt := 0; attempt < urlkey.MaxAttempts; attempt++ {
+		urlKey, err := m.keys.Generate(dedupURL(link.OriginalURL, link.NormalizedURL), attempt)
+		if err != nil || urlKey == "" {
+			return "", fmt.Errorf("failed to generate the short url: %v", err)
+		}
+		link.ShortURL = urlKey
+		if m.insert(link) {
+			return urlKey, nil
+		}
+	}
+	return "", NewStorageError("key collision", link.OriginalURL, "", errors.New("no free key found"))
+}
+
+// insert - stores the link if its key is free and indexes it.
+// The caller should hold indexMutex for writing.
+func (m *MemoryStorage) insert(link models.Link) bool {
+	s := m.shard(link.ShortURL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.links[link.ShortURL]; found {
+		return false
+	}
+	link.CreatedAt = time.Now().UTC()
+	link.Tags = slices.Clone(link.Tags)
+	s.links[link.ShortURL] = &link
+
+	m.urls[newUserURL(link.UserID, link.OriginalURL, link.NormalizedURL)] = link.ShortURL
+	if m.users[link.UserID] == nil {
+		m.users[link.UserID] = make(map[string]struct{})
+	}
+	m.users[link.UserID][link.ShortURL] = struct{}{}
+	return true
 }
 
 func (m *MemoryStorage) SetBatch(ctx context.Context, jReqBatch []models.JSONReq, userID string) ([]models.JSONRes, error) {
@@ -47,17 +138,26 @@ func (m *MemoryStorage) SetBatch(ctx context.Context, jReqBatch []models.JSONReq
 	default:
 	}
 
-	jResBatch := make([]models.JSONRes, len(jReqBatch))
+	jResBatch := make([]models.JSONRes, 0, len(jReqBatch))
 
 	for _, el := range jReqBatch {
-		ShortURL, err := m.Set(ctx, el.OriginalURL, userID)
-		if err != nil {
+		link := models.Link{
+			ShortURL:      el.Alias,
+			OriginalURL:   el.OriginalURL,
+			NormalizedURL: el.NormalizedURL,
+			UserID:        userID,
+			ExpiresAt:     el.ExpiresAt,
+			Tags:          el.Tags,
+			Folder:        el.Folder,
+		}
+		ShortURL, err := m.Set(ctx, link)
+		if err != nil && !IsErrorType(err, "already exists") {
 			return nil, err
 		}
 
 		row := models.JSONRes{
 			CorrID:      el.CorrID,
-			ShortURL:    ShortURL,
+			ShortURL:    config.AppConfig.ResultHost + "/" + ShortURL,
 			OriginalURL: el.OriginalURL,
 		}
 		jResBatch = append(jResBatch, row)
@@ -65,77 +165,580 @@ func (m *MemoryStorage) SetBatch(ctx context.Context, jReqBatch []models.JSONReq
 	return jResBatch, nil
 }
 
-func (m *MemoryStorage) DeleteBatch(ctx context.Context, keysToDelete []models.KeysToDelete) (bool, error) {
+func (m *MemoryStorage) DeleteBatch(ctx context.Context, keysToDelete []models.KeysToDelete) ([]models.DeleteResult, error) {
 	select {
 	case <-ctx.Done(): // Check if the context is canceled
-		return false, ctx.Err()
+		return nil, ctx.Err()
 	default:
 	}
 
 	if len(keysToDelete) == 0 {
-		return false, errors.New("no URLs provided for deletion")
+		return nil, errors.New("no URLs provided for deletion")
 	}
 
-	// Flag that indicates if any record was deleted
-	deleted := false
+	results := []models.DeleteResult{}
+	now := time.Now()
 
 	// Iterate over each KeysToDelete entry
 	for _, item := range keysToDelete {
 		for _, key := range item.Keys {
-			urlKey := strings.ToLower(key)
-			if existing, found := m.data[urlKey]; found && existing[1] == item.UserID {
-				// Delete the record
-				delete(m.data, urlKey)
-				deleted = true
+			s := m.shard(key)
+			s.mu.Lock()
+			existing, found := s.links[key]
+			status := deleteOutcome(found, found && existing.UserID == item.UserID, found && existing.DeletedFlag)
+			if status == DeleteDeleted {
+				// The link is kept in the trash until it is purged
+				existing.DeletedFlag = true
+				existing.DeletedAt = &now
+			}
+			s.mu.Unlock()
+
+			results = append(results, models.DeleteResult{Key: key, Status: status})
+		}
+	}
+	return results, nil
+}
+
+// Restore - clears the deletion of the user's links
+func (m *MemoryStorage) Restore(ctx context.Context, userID string, keys []string) ([]string, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return nil, ctx.Err()
+	default:
+	}
+
+	m.indexMutex.RLock()
+	defer m.indexMutex.RUnlock()
+
+	restored := []string{}
+	for _, key := range keys {
+		if _, owned := m.users[userID][key]; !owned {
+			continue
+		}
+
+		s := m.shard(key)
+		s.mu.Lock()
+		if existing, found := s.links[key]; found && existing.DeletedFlag {
+			existing.DeletedFlag = false
+			existing.DeletedAt = nil
+			restored = append(restored, key)
+		}
+		s.mu.Unlock()
+	}
+	return restored, nil
+}
+
+// PurgeDeleted - removes the links deleted before the given time with their history and clicks
+func (m *MemoryStorage) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return 0, ctx.Err()
+	default:
+	}
+
+	m.indexMutex.Lock()
+	defer m.indexMutex.Unlock()
+
+	purged := []string{}
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for key, link := range s.links {
+			if !link.DeletedFlag || link.DeletedAt == nil || !link.DeletedAt.Before(before) {
+				continue
+			}
+			delete(s.links, key)
+			delete(s.history, key)
+			delete(s.transfers, key)
+			delete(m.urls, newUserURL(link.UserID, link.OriginalURL, link.NormalizedURL))
+			delete(m.users[link.UserID], key)
+			purged = append(purged, key)
+		}
+		s.mu.Unlock()
+	}
+
+	m.clicksMutex.Lock()
+	for _, key := range purged {
+		delete(m.clicks, key)
+	}
+	m.clicksMutex.Unlock()
+
+	return len(purged), nil
+}
+
+// Update - points the user's link to the new URL and keeps the previous one in the history
+func (m *MemoryStorage) Update(ctx context.Context, link models.Link) error {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return ctx.Err()
+	default:
+	}
+
+	m.indexMutex.Lock()
+	defer m.indexMutex.Unlock()
+
+	s := m.shard(link.ShortURL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, found := s.links[link.ShortURL]
+	if !found || existing.UserID != link.UserID {
+		return NewStorageError("not found", link.OriginalURL, link.ShortURL, nil)
+	}
+	if existing.DeletedFlag {
+		return NewStorageError("deleted", link.OriginalURL, link.ShortURL, nil)
+	}
+	if existing.OriginalURL == link.OriginalURL {
+		return nil
+	}
+
+	// The user should not get two links for the same URL
+	updated := newUserURL(link.UserID, link.OriginalURL, link.NormalizedURL)
+	if storedKey, found := m.urls[updated]; found && storedKey != link.ShortURL {
+		return NewStorageError("already exists", link.OriginalURL, storedKey, nil)
+	}
+	delete(m.urls, newUserURL(existing.UserID, existing.OriginalURL, existing.NormalizedURL))
+	m.urls[updated] = link.ShortURL
+
+	change := models.LinkChange{OriginalURL: existing.OriginalURL, ChangedAt: time.Now()}
+	s.history[link.ShortURL] = append(s.history[link.ShortURL], change)
+	existing.OriginalURL = link.OriginalURL
+	existing.NormalizedURL = link.NormalizedURL
+	return nil
+}
+
+// TransferLinks - checks every link before changing the owner of any of them
+func (m *MemoryStorage) TransferLinks(ctx context.Context, fromID, toID string, keys []string, actorID string) error {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return ctx.Err()
+	default:
+	}
+
+	m.indexMutex.Lock()
+	defer m.indexMutex.Unlock()
+
+	links := make([]*models.Link, 0, len(keys))
+	for _, key := range uniqueKeys(keys) {
+		s := m.shard(key)
+		s.mu.RLock()
+		link, found := s.links[key]
+		s.mu.RUnlock()
+
+		if !found || link.UserID != fromID {
+			return NewStorageError("not found", "", key, nil)
+		}
+		if link.DeletedFlag {
+			return NewStorageError("deleted", link.OriginalURL, key, nil)
+		}
+		// The new owner should not get two links for the same URL
+		if storedKey, found := m.urls[newUserURL(toID, link.OriginalURL, link.NormalizedURL)]; found {
+			return NewStorageError("already exists", link.OriginalURL, storedKey, nil)
+		}
+		links = append(links, link)
+	}
+
+	transfer := models.LinkTransfer{FromID: fromID, ToID: toID, ActorID: actorID, TransferredAt: time.Now()}
+	for _, link := range links {
+		delete(m.urls, newUserURL(fromID, link.OriginalURL, link.NormalizedURL))
+		m.urls[newUserURL(toID, link.OriginalURL, link.NormalizedURL)] = link.ShortURL
+		delete(m.users[fromID], link.ShortURL)
+		if m.users[toID] == nil {
+			m.users[toID] = make(map[string]struct{})
+		}
+		m.users[toID][link.ShortURL] = struct{}{}
+
+		s := m.shard(link.ShortURL)
+		s.mu.Lock()
+		link.UserID = toID
+		s.transfers[link.ShortURL] = append(s.transfers[link.ShortURL], transfer)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// SetLinkLabels - the tags are replaced with a new slice, so the copies of the link made by the readers stay intact
+func (m *MemoryStorage) SetLinkLabels(ctx context.Context, ownerID, urlKey string, tags []string, folder string) error {
+	s := m.shard(urlKey)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, found := s.links[urlKey]
+	if !found || link.UserID != ownerID {
+		return NewStorageError("not found", "", urlKey, nil)
+	}
+	link.Tags = slices.Clone(tags)
+	link.Folder = folder
+	return nil
+}
+
+func (m *MemoryStorage) GetUserTags(ctx context.Context, ownerID string) ([]models.TagCount, error) {
+	m.indexMutex.RLock()
+	defer m.indexMutex.RUnlock()
+
+	counter := tagCounter{}
+	for key := range m.users[ownerID] {
+		s := m.shard(key)
+		s.mu.RLock()
+		if link, found := s.links[key]; found {
+			counter.add(*link)
+		}
+		s.mu.RUnlock()
+	}
+	return counter.counts(), nil
+}
+
+func (m *MemoryStorage) RenameTag(ctx context.Context, ownerID, from, to string) (int, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return 0, ctx.Err()
+	default:
+	}
+
+	// The write lock keeps the links of the owner from changing hands during the rename
+	m.indexMutex.Lock()
+	defer m.indexMutex.Unlock()
+
+	renamed := 0
+	for key := range m.users[ownerID] {
+		s := m.shard(key)
+		s.mu.Lock()
+		if link, found := s.links[key]; found {
+			if tags, ok := renameTag(link.Tags, from, to); ok {
+				link.Tags = tags
+				renamed++
 			}
 		}
+		s.mu.Unlock()
+	}
+	return renamed, nil
+}
+
+// GetLinkTransfers - returns the owner changes of the link, the oldest first
+func (m *MemoryStorage) GetLinkTransfers(ctx context.Context, urlKey string) ([]models.LinkTransfer, error) {
+	s := m.shard(urlKey)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, found := s.links[urlKey]; !found {
+		return nil, NewStorageError("not found", "", urlKey, nil)
+	}
+	return append([]models.LinkTransfer{}, s.transfers[urlKey]...), nil
+}
+
+// GetLinkHistory - returns the previous destinations of the link
+func (m *MemoryStorage) GetLinkHistory(ctx context.Context, urlKey string) ([]models.LinkChange, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return nil, ctx.Err()
+	default:
 	}
 
-	// Return true if at least one record was deleted
-	return deleted, nil
+	s := m.shard(urlKey)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, found := s.links[urlKey]; !found {
+		return nil, NewStorageError("not found", "", urlKey, nil)
+	}
+	return append([]models.LinkChange{}, s.history[urlKey]...), nil
+}
+
+// ExpireLinks - marks the links whose expiry time has passed
+func (m *MemoryStorage) ExpireLinks(ctx context.Context) (int, error) {
+	expired := 0
+	now := time.Now()
+
+	for _, s := range m.shards {
+		select {
+		case <-ctx.Done(): // Check if the context is canceled
+			return expired, ctx.Err()
+		default:
+		}
+
+		s.mu.Lock()
+		for _, link := range s.links {
+			if !link.ExpiredFlag && link.ExpiresAt != nil && !link.ExpiresAt.After(now) {
+				link.ExpiredFlag = true
+				expired++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return expired, nil
 }
 
 // Get - retrieves a value from memory
 func (m *MemoryStorage) Get(ctx context.Context, urlKey string) (string, error) {
+	existing, err := m.GetLink(ctx, urlKey)
+	if err != nil {
+		if IsErrorType(err, "not found") {
+			return "", fmt.Errorf("OriginalURL is empty")
+		}
+		return "", err
+	}
+	if existing.DeletedFlag {
+		return "", NewStorageError("deleted", existing.OriginalURL, urlKey, nil)
+	}
+	if isExpired(existing.ExpiredFlag, existing.ExpiresAt) {
+		return "", NewStorageError("expired", existing.OriginalURL, urlKey, nil)
+	}
+	return existing.OriginalURL, nil
+}
+
+// GetLink - returns the stored link with its owner and state
+func (m *MemoryStorage) GetLink(ctx context.Context, urlKey string) (models.Link, error) {
 	select {
 	case <-ctx.Done(): // Check if the context is canceled
-		return "", ctx.Err()
+		return models.Link{}, ctx.Err()
 	default:
 	}
 
-	urlKey = strings.ToLower(urlKey)
+	s := m.shard(urlKey)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	existing, found := m.data[urlKey]
-	if !found || existing[0] == "" {
-		return "", fmt.Errorf("OriginalURL is empty")
+	existing, found := s.links[urlKey]
+	if !found {
+		return models.Link{}, NewStorageError("not found", "", urlKey, nil)
 	}
-	return existing[0], nil
+	return *existing, nil
 }
 
-func (m *MemoryStorage) GetUserURLs(ctx context.Context, userID string) ([]models.JSONUserRes, error) {
+// RecordClicks - keeps the clicks in memory
+func (m *MemoryStorage) RecordClicks(ctx context.Context, clicks []models.Click) error {
 	select {
 	case <-ctx.Done(): // Check if the context is canceled
-		return nil, ctx.Err()
+		return ctx.Err()
 	default:
 	}
 
-	jResBatch := make([]models.JSONUserRes, 0)
+	m.clicksMutex.Lock()
+	defer m.clicksMutex.Unlock()
 
-	for key, el := range m.data {
-		if el[1] != userID {
-			continue
+	for _, click := range clicks {
+		m.clicks[click.ShortURL] = append(m.clicks[click.ShortURL], click)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) GetLinkStats(ctx context.Context, urlKey string) (models.LinkStats, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return models.LinkStats{}, ctx.Err()
+	default:
+	}
+
+	m.clicksMutex.Lock()
+	times := make([]time.Time, 0, len(m.clicks[urlKey]))
+	for _, click := range m.clicks[urlKey] {
+		times = append(times, click.Time)
+	}
+	m.clicksMutex.Unlock()
+
+	return aggregateClicks(urlKey, times), nil
+}
+
+// GetUserURLs - copies the links of the user found by the index, then filters and pages them
+func (m *MemoryStorage) GetUserURLs(ctx context.Context, userID string, query URLQuery) (URLPage, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return URLPage{}, ctx.Err()
+	default:
+	}
+
+	m.indexMutex.RLock()
+	links := make([]models.Link, 0, len(m.users[userID]))
+	for key := range m.users[userID] {
+		s := m.shard(key)
+		s.mu.RLock()
+		if link, found := s.links[key]; found {
+			links = append(links, *link)
 		}
-		row := models.JSONUserRes{
-			ShortURL:    key,
-			OriginalURL: el[0],
+		s.mu.RUnlock()
+	}
+	m.indexMutex.RUnlock()
+
+	return pageLinks(links, query)
+}
+
+// GetUserTrash - returns the deleted links of the user
+func (m *MemoryStorage) GetUserTrash(ctx context.Context, userID string) ([]models.JSONUserRes, error) {
+	select {
+	case <-ctx.Done(): // Check if the context is canceled
+		return nil, ctx.Err()
+	default:
+	}
+
+	m.indexMutex.RLock()
+	defer m.indexMutex.RUnlock()
+
+	jResBatch := []models.JSONUserRes{}
+
+	for key := range m.users[userID] {
+		s := m.shard(key)
+		s.mu.RLock()
+		if el, found := s.links[key]; found && el.DeletedFlag {
+			jResBatch = append(jResBatch, models.JSONUserRes{
+				ShortURL:    config.AppConfig.ResultHost + "/" + key,
+				OriginalURL: el.OriginalURL,
+				ExpiresAt:   el.ExpiresAt,
+				State:       StateDeleted,
+				DeletedAt:   el.DeletedAt,
+			})
 		}
-		jResBatch = append(jResBatch, row)
+		s.mu.RUnlock()
 	}
 	return jResBatch, nil
 }
 
+// EnqueueDeletion - keeps the request in memory, the queue is lost on a restart like the links
+func (m *MemoryStorage) EnqueueDeletion(ctx context.Context, item models.KeysToDelete) error {
+	m.deletesMutex.Lock()
+	defer m.deletesMutex.Unlock()
+
+	m.deletes.enqueue(item)
+	return nil
+}
+
+func (m *MemoryStorage) PendingDeletions(ctx context.Context, now time.Time, limit int) ([]models.PendingDeletion, error) {
+	m.deletesMutex.Lock()
+	defer m.deletesMutex.Unlock()
+
+	return m.deletes.pending(now, limit), nil
+}
+
+func (m *MemoryStorage) CompleteDeletions(ctx context.Context, ids []int64) error {
+	m.deletesMutex.Lock()
+	defer m.deletesMutex.Unlock()
+
+	m.deletes.complete(ids)
+	return nil
+}
+
+func (m *MemoryStorage) RetryDeletion(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) error {
+	m.deletesMutex.Lock()
+	defer m.deletesMutex.Unlock()
+
+	return m.deletes.fail(id, lastError, nextAttemptAt, false)
+}
+
+func (m *MemoryStorage) DeadLetterDeletion(ctx context.Context, id int64, lastError string) error {
+	m.deletesMutex.Lock()
+	defer m.deletesMutex.Unlock()
+
+	return m.deletes.fail(id, lastError, time.Now().UTC(), true)
+}
+
+func (m *MemoryStorage) DeadDeletions(ctx context.Context) ([]models.PendingDeletion, error) {
+	m.deletesMutex.Lock()
+	defer m.deletesMutex.Unlock()
+
+	return m.deletes.dead(), nil
+}
+
 func (m *MemoryStorage) IsAvailable() bool {
-	return m.data != nil
+	return m.shards[0] != nil
+}
+
+func (m *MemoryStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	m.apiKeysMutex.Lock()
+	defer m.apiKeysMutex.Unlock()
+
+	return m.apiKeys.add(key)
+}
+
+func (m *MemoryStorage) GetAPIKey(ctx context.Context, hash string) (models.APIKey, error) {
+	m.apiKeysMutex.RLock()
+	defer m.apiKeysMutex.RUnlock()
+
+	return m.apiKeys.get(hash)
+}
+
+func (m *MemoryStorage) GetUserAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error) {
+	m.apiKeysMutex.RLock()
+	defer m.apiKeysMutex.RUnlock()
+
+	return m.apiKeys.user(userID), nil
+}
+
+func (m *MemoryStorage) RevokeAPIKey(ctx context.Context, userID string, id string) error {
+	m.apiKeysMutex.Lock()
+	defer m.apiKeysMutex.Unlock()
+
+	_, err := m.apiKeys.revoke(userID, id)
+	return err
+}
+
+func (m *MemoryStorage) CreateUser(ctx context.Context, user models.User) error {
+	m.usersMutex.Lock()
+	defer m.usersMutex.Unlock()
+
+	return m.accounts.add(user)
+}
+
+func (m *MemoryStorage) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
+	m.usersMutex.RLock()
+	defer m.usersMutex.RUnlock()
+
+	return m.accounts.getByLogin(login)
+}
+
+func (m *MemoryStorage) GetUser(ctx context.Context, userID string) (models.User, error) {
+	m.usersMutex.RLock()
+	defer m.usersMutex.RUnlock()
+
+	return m.accounts.get(userID)
+}
+
+func (m *MemoryStorage) CreateWorkspace(ctx context.Context, ws models.Workspace) error {
+	m.wsMutex.Lock()
+	defer m.wsMutex.Unlock()
+
+	if err := m.workspaces.add(ws); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryStorage) GetWorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	m.wsMutex.RLock()
+	defer m.wsMutex.RUnlock()
+
+	return m.workspaces.role(workspaceID, userID)
+}
+
+func (m *MemoryStorage) GetUserWorkspaces(ctx context.Context, userID string) ([]models.JSONWorkspaceRes, error) {
+	m.wsMutex.RLock()
+	defer m.wsMutex.RUnlock()
+
+	return m.workspaces.user(userID), nil
+}
+
+func (m *MemoryStorage) GetWorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error) {
+	m.wsMutex.RLock()
+	defer m.wsMutex.RUnlock()
+
+	return m.workspaces.members(workspaceID)
+}
+
+func (m *MemoryStorage) SetWorkspaceMember(ctx context.Context, workspaceID string, member models.WorkspaceMember) error {
+	m.wsMutex.Lock()
+	defer m.wsMutex.Unlock()
+
+	if err := m.workspaces.setMember(workspaceID, member); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error {
+	m.wsMutex.Lock()
+	defer m.wsMutex.Unlock()
+
+	if err := m.workspaces.removeMember(workspaceID, userID); err != nil {
+		return err
+	}
+	return nil
 }
 
 // Close - ensure that the in memory storage fits the Storer interface
@@ -2,17 +2,22 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"shorter/internal/models"
+	"shorter/internal/urlkey"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMemoryStorage_Set(t *testing.T) {
 	ctx := context.Background()
-	storage := NewMemoryStorage()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
 
 	originalURL := "https://practicum.yandex.ru/"
 	userID := "111222333abc"
-	key, _ := storage.Set(ctx, originalURL, userID)
+	key, _ := storage.Set(ctx, models.Link{OriginalURL: originalURL, UserID: userID})
 	assert.NotEmpty(t, key, "Expected a non-empty key, got an empty string")
 
 	retrievedURL, _ := storage.Get(ctx, key)
@@ -21,7 +26,7 @@ func TestMemoryStorage_Set(t *testing.T) {
 
 func TestMemoryStorage_Get_NonExistentKey(t *testing.T) {
 	ctx := context.Background()
-	storage := NewMemoryStorage()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
 
 	nonExistentKey := "random"
 	result, err := storage.Get(ctx, nonExistentKey)
@@ -29,3 +34,507 @@ func TestMemoryStorage_Get_NonExistentKey(t *testing.T) {
 	assert.NotEmpty(t, err, "Expected non-empty error")
 	assert.Empty(t, result, "Expected empty string for non-existent key")
 }
+
+// stubGenerator - a key generator that returns the keys chosen by the test
+type stubGenerator func(originalURL string, attempt int) (string, error)
+
+func (g stubGenerator) Generate(originalURL string, attempt int) (string, error) {
+	return g(originalURL, attempt)
+}
+
+func TestMemoryStorage_Set_KeyCollision(t *testing.T) {
+	ctx := context.Background()
+	// The first key is already taken, the retry gets a free one
+	var attempts []int
+	storage := NewMemoryStorage(stubGenerator(func(_ string, attempt int) (string, error) {
+		attempts = append(attempts, attempt)
+		if attempt == 0 {
+			return "taken", nil
+		}
+		return "free", nil
+	}))
+
+	_, err := storage.Set(ctx, models.Link{ShortURL: "taken", OriginalURL: "https://a.example.com", UserID: "user"})
+	assert.NoError(t, err)
+
+	key, err := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "user"})
+	assert.NoError(t, err)
+	assert.Equal(t, "free", key, "A taken key should be retried with the next attempt")
+	assert.Equal(t, []int{0, 1}, attempts)
+
+	again, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user"})
+	assert.Error(t, err)
+	assert.Equal(t, "taken", again, "A stored URL should keep its key")
+
+	// Every attempt collides
+	attempts = nil
+	storage.keys = stubGenerator(func(_ string, attempt int) (string, error) {
+		attempts = append(attempts, attempt)
+		return "taken", nil
+	})
+	_, err = storage.Set(ctx, models.Link{OriginalURL: "https://c.example.com", UserID: "user"})
+	assert.True(t, IsErrorType(err, "key collision"), "The storage should give up after all attempts")
+	assert.Len(t, attempts, urlkey.MaxAttempts)
+}
+
+func TestMemoryStorage_Set_Alias(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	key, err := storage.Set(ctx, models.Link{ShortURL: "spring-sale", OriginalURL: "https://a.example.com", UserID: "user"})
+	assert.NoError(t, err)
+	assert.Equal(t, "spring-sale", key)
+
+	_, err = storage.Set(ctx, models.Link{ShortURL: "spring-sale", OriginalURL: "https://b.example.com", UserID: "user"})
+	assert.True(t, IsErrorType(err, "alias taken"), "The alias of another URL should not be reused")
+}
+
+func TestMemoryStorage_ExpireLinks(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	expiredKey, _ := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user", ExpiresAt: &past})
+	activeKey, _ := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "user", ExpiresAt: &future})
+
+	_, err := storage.Get(ctx, expiredKey)
+	assert.True(t, IsErrorType(err, "expired"), "An expired link should not be resolved")
+
+	retrievedURL, err := storage.Get(ctx, activeKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://b.example.com", retrievedURL)
+
+	expired, err := storage.ExpireLinks(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	page, _ := storage.GetUserURLs(ctx, "user", URLQuery{})
+	userURLs := page.Links
+	states := map[string]string{}
+	for _, row := range userURLs {
+		states[row.OriginalURL] = row.State
+	}
+	assert.Equal(t, StateExpired, states["https://a.example.com"])
+	assert.Equal(t, StateActive, states["https://b.example.com"])
+}
+
+func TestMemoryStorage_Concurrency(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewRandomGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	const workers = 16
+	const perWorker = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			userID := fmt.Sprintf("user-%d", w%4)
+			var keys []string
+
+			for i := 0; i < perWorker; i++ {
+				originalURL := fmt.Sprintf("https://example.com/%d/%d", w, i)
+				key, err := storage.Set(ctx, models.Link{OriginalURL: originalURL, UserID: userID})
+				assert.NoError(t, err)
+				keys = append(keys, key)
+
+				retrievedURL, err := storage.Get(ctx, key)
+				assert.NoError(t, err)
+				assert.Equal(t, originalURL, retrievedURL)
+
+				_, err = storage.GetUserURLs(ctx, userID, URLQuery{})
+				assert.NoError(t, err)
+			}
+
+			_, err := storage.ExpireLinks(ctx)
+			assert.NoError(t, err)
+
+			// Delete half of the stored keys
+			_, err = storage.DeleteBatch(ctx, []models.KeysToDelete{{Keys: keys[:perWorker/2], UserID: userID}})
+			assert.NoError(t, err)
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0
+	for u := 0; u < 4; u++ {
+		page, err := storage.GetUserURLs(ctx, fmt.Sprintf("user-%d", u), URLQuery{})
+		userURLs := page.Links
+		assert.NoError(t, err)
+		for _, userURL := range userURLs {
+			if userURL.State == StateActive {
+				total++
+			}
+		}
+	}
+	assert.Equal(t, workers*perWorker/2, total)
+}
+
+func TestMemoryStorage_DeleteBatch_OtherUser(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	key, _ := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "owner"})
+
+	results, err := storage.DeleteBatch(ctx, []models.KeysToDelete{{Keys: []string{key}, UserID: "intruder"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.DeleteResult{{Key: key, Status: DeleteNotOwned}}, results, "Only the owner can delete the link")
+
+	retrievedURL, _ := storage.Get(ctx, key)
+	assert.Equal(t, "https://a.example.com", retrievedURL)
+}
+
+func TestMemoryStorage_Set_SameURLPerUser(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	first, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "first"})
+	assert.NoError(t, err)
+	second, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "second"})
+	assert.NoError(t, err, "Another user should get their own link")
+	assert.NotEqual(t, first, second)
+
+	again, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "second"})
+	assert.True(t, IsErrorType(err, "already exists"))
+	assert.Equal(t, second, again)
+
+	page, err := storage.GetUserURLs(ctx, "second", URLQuery{})
+	userURLs := page.Links
+	assert.NoError(t, err)
+	assert.Len(t, userURLs, 1)
+
+	results, err := storage.DeleteBatch(ctx, []models.KeysToDelete{{Keys: []string{second}, UserID: "second"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.DeleteResult{{Key: second, Status: DeleteDeleted}}, results)
+
+	retrievedURL, err := storage.Get(ctx, first)
+	assert.NoError(t, err, "The link of the first user should be kept")
+	assert.Equal(t, "https://a.example.com", retrievedURL)
+}
+
+func TestMemoryStorage_Update(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	key, _ := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "owner"})
+	other, _ := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "owner"})
+
+	err := storage.Update(ctx, models.Link{ShortURL: key, OriginalURL: "https://c.example.com", UserID: "intruder"})
+	assert.True(t, IsErrorType(err, "not found"), "Only the owner can update the link")
+
+	err = storage.Update(ctx, models.Link{ShortURL: key, OriginalURL: "https://b.example.com", UserID: "owner"})
+	assert.True(t, IsErrorType(err, "already exists"))
+
+	err = storage.Update(ctx, models.Link{ShortURL: key, OriginalURL: "https://c.example.com", UserID: "owner"})
+	assert.NoError(t, err)
+
+	retrievedURL, _ := storage.Get(ctx, key)
+	assert.Equal(t, "https://c.example.com", retrievedURL)
+
+	history, err := storage.GetLinkHistory(ctx, key)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "https://a.example.com", history[0].OriginalURL)
+
+	// The previous URL is free again
+	storedKey, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "owner"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, other, storedKey)
+}
+
+func TestMemoryStorage_RestoreAndPurge(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	restored, _ := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user"})
+	purged, _ := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "user"})
+
+	_, err := storage.DeleteBatch(ctx, []models.KeysToDelete{{Keys: []string{restored, purged}, UserID: "user"}})
+	assert.NoError(t, err)
+
+	_, err = storage.Get(ctx, restored)
+	assert.True(t, IsErrorType(err, "deleted"))
+
+	trash, err := storage.GetUserTrash(ctx, "user")
+	assert.NoError(t, err)
+	assert.Len(t, trash, 2)
+
+	keys, err := storage.Restore(ctx, "intruder", []string{restored})
+	assert.NoError(t, err)
+	assert.Empty(t, keys, "Only the owner can restore the link")
+
+	keys, err = storage.Restore(ctx, "user", []string{restored})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{restored}, keys)
+
+	retrievedURL, err := storage.Get(ctx, restored)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://a.example.com", retrievedURL)
+
+	count, err := storage.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = storage.GetLink(ctx, purged)
+	assert.True(t, IsErrorType(err, "not found"))
+
+	trash, err = storage.GetUserTrash(ctx, "user")
+	assert.NoError(t, err)
+	assert.Empty(t, trash)
+}
+
+func TestMemoryStorage_DeleteBatch_Results(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	owned, _ := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user"})
+	foreign, _ := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "other"})
+
+	results, err := storage.DeleteBatch(ctx, []models.KeysToDelete{
+		{Keys: []string{owned, foreign, "missing", owned}, UserID: "user"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.DeleteResult{
+		{Key: owned, Status: DeleteDeleted},
+		{Key: foreign, Status: DeleteNotOwned},
+		{Key: "missing", Status: DeleteNotFound},
+		{Key: owned, Status: DeleteAlreadyDeleted},
+	}, results)
+}
+
+func TestMemoryStorage_DeletionQueue(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	assert.NoError(t, storage.EnqueueDeletion(ctx, models.KeysToDelete{Keys: []string{"a"}, UserID: "user", JobID: "job1"}))
+	assert.NoError(t, storage.EnqueueDeletion(ctx, models.KeysToDelete{Keys: []string{"b"}, UserID: "user"}))
+	assert.NoError(t, storage.EnqueueDeletion(ctx, models.KeysToDelete{Keys: []string{"c"}, UserID: "user"}))
+	now := time.Now()
+
+	pending, err := storage.PendingDeletions(ctx, now, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 3) {
+		assert.Equal(t, "job1", pending[0].Item.JobID)
+	}
+
+	// A postponed request is not due until its next attempt, a dead one is never due again
+	assert.NoError(t, storage.CompleteDeletions(ctx, []int64{pending[0].ID}))
+	assert.NoError(t, storage.RetryDeletion(ctx, pending[1].ID, "timeout", now.Add(time.Minute)))
+	assert.NoError(t, storage.DeadLetterDeletion(ctx, pending[2].ID, "timeout"))
+
+	due, err := storage.PendingDeletions(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+
+	due, err = storage.PendingDeletions(ctx, now.Add(time.Minute), 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, []string{"b"}, due[0].Item.Keys)
+		assert.Equal(t, 1, due[0].Attempts)
+		assert.Equal(t, "timeout", due[0].LastError)
+	}
+
+	dead, err := storage.DeadDeletions(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, []string{"c"}, dead[0].Item.Keys)
+		assert.True(t, dead[0].DeadFlag)
+	}
+
+	assert.Error(t, storage.RetryDeletion(ctx, pending[0].ID, "timeout", now))
+}
+
+func TestMemoryStorage_APIKeys(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	key := models.APIKey{ID: "k1", UserID: "user", Name: "ci", Prefix: "shk_1", Hash: "hash1", CreatedAt: time.Now()}
+	assert.NoError(t, storage.CreateAPIKey(ctx, key))
+	assert.True(t, IsErrorType(storage.CreateAPIKey(ctx, key), "already exists"))
+
+	found, err := storage.GetAPIKey(ctx, "hash1")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", found.UserID)
+
+	// Only the owner can revoke the key, and a revoked key is not found anymore
+	assert.True(t, IsErrorType(storage.RevokeAPIKey(ctx, "other", "k1"), "not found"))
+	assert.NoError(t, storage.RevokeAPIKey(ctx, "user", "k1"))
+	assert.NoError(t, storage.RevokeAPIKey(ctx, "user", "k1"))
+
+	_, err = storage.GetAPIKey(ctx, "hash1")
+	assert.True(t, IsErrorType(err, "not found"))
+
+	keys, err := storage.GetUserAPIKeys(ctx, "user")
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 1) {
+		assert.NotNil(t, keys[0].RevokedAt)
+	}
+}
+
+func TestMemoryStorage_Workspaces(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	ws := models.Workspace{ID: "ws_1", Name: "marketing", Members: []models.WorkspaceMember{{UserID: "alice", Role: RoleOwner}}}
+	assert.NoError(t, storage.CreateWorkspace(ctx, ws))
+	assert.NoError(t, storage.SetWorkspaceMember(ctx, "ws_1", models.WorkspaceMember{UserID: "bob", Role: RoleViewer}))
+	assert.NoError(t, storage.SetWorkspaceMember(ctx, "ws_1", models.WorkspaceMember{UserID: "bob", Role: RoleEditor}))
+
+	role, err := storage.GetWorkspaceRole(ctx, "ws_1", "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, RoleEditor, role)
+
+	_, err = storage.GetWorkspaceRole(ctx, "ws_1", "eve")
+	assert.True(t, IsErrorType(err, "not found"))
+
+	// The workspace should not lose its last owner
+	assert.True(t, IsErrorType(storage.SetWorkspaceMember(ctx, "ws_1", models.WorkspaceMember{UserID: "alice", Role: RoleEditor}), "last owner"))
+	assert.True(t, IsErrorType(storage.RemoveWorkspaceMember(ctx, "ws_1", "alice"), "last owner"))
+	assert.True(t, IsErrorType(storage.RemoveWorkspaceMember(ctx, "ws_1", "eve"), "not found"))
+	assert.NoError(t, storage.RemoveWorkspaceMember(ctx, "ws_1", "bob"))
+
+	members, err := storage.GetWorkspaceMembers(ctx, "ws_1")
+	assert.NoError(t, err)
+	assert.Len(t, members, 1)
+
+	workspaces, err := storage.GetUserWorkspaces(ctx, "alice")
+	assert.NoError(t, err)
+	if assert.Len(t, workspaces, 1) {
+		assert.Equal(t, RoleOwner, workspaces[0].Role)
+	}
+}
+
+func TestMemoryStorage_TransferLinks(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	first, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "alice"})
+	assert.NoError(t, err)
+	second, err := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "alice"})
+	assert.NoError(t, err)
+	taken, err := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "bob"})
+	assert.NoError(t, err)
+
+	// A conflict on one link keeps all of them with the owner
+	err = storage.TransferLinks(ctx, "alice", "bob", []string{first, second}, "alice")
+	assert.True(t, IsErrorType(err, "already exists"))
+	err = storage.TransferLinks(ctx, "alice", "carol", []string{first, taken}, "alice")
+	assert.True(t, IsErrorType(err, "not found"))
+	page, err := storage.GetUserURLs(ctx, "alice", URLQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Links, 2)
+
+	assert.NoError(t, storage.TransferLinks(ctx, "alice", "carol", []string{first, second, first}, "alice"))
+	page, err = storage.GetUserURLs(ctx, "alice", URLQuery{})
+	assert.NoError(t, err)
+	assert.Empty(t, page.Links)
+	page, err = storage.GetUserURLs(ctx, "carol", URLQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Links, 2)
+
+	// The new owner has the URL now, and the previous one can shorten it again
+	_, err = storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "carol"})
+	assert.True(t, IsErrorType(err, "already exists"))
+	_, err = storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "alice"})
+	assert.NoError(t, err)
+
+	transfers, err := storage.GetLinkTransfers(ctx, first)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice", "carol", "alice"}, []string{transfers[0].FromID, transfers[0].ToID, transfers[0].ActorID})
+}
+
+func TestMemoryStorage_GetUserURLs_Pages(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	for _, originalURL := range []string{
+		"https://b.example.com/1", "https://a.example.com/2", "https://shop.example.com/3",
+		"https://other.org/4", "https://a.example.com/5",
+	} {
+		_, err := storage.Set(ctx, models.Link{OriginalURL: originalURL, UserID: "user"})
+		assert.NoError(t, err)
+	}
+
+	// Walk the pages by the cursor until the last one
+	urls := []string{}
+	query := URLQuery{Sort: SortURLAsc, Limit: 2}
+	for pages := 0; pages < 5; pages++ {
+		page, err := storage.GetUserURLs(ctx, "user", query)
+		assert.NoError(t, err)
+		for _, link := range page.Links {
+			urls = append(urls, link.OriginalURL)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{
+		"https://a.example.com/2", "https://a.example.com/5", "https://b.example.com/1",
+		"https://other.org/4", "https://shop.example.com/3",
+	}, urls)
+
+	page, err := storage.GetUserURLs(ctx, "user", URLQuery{Domain: "example.com", Search: "/5"})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Links, 1) {
+		assert.Equal(t, "https://a.example.com/5", page.Links[0].OriginalURL)
+	}
+
+	page, err = storage.GetUserURLs(ctx, "user", URLQuery{Domain: "shop.example.com", State: StateActive})
+	assert.NoError(t, err)
+	assert.Len(t, page.Links, 1)
+
+	// The newest link comes first by default
+	page, err = storage.GetUserURLs(ctx, "user", URLQuery{Limit: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Links, 1) {
+		assert.Equal(t, "https://a.example.com/5", page.Links[0].OriginalURL)
+	}
+
+	future := time.Now().Add(time.Hour)
+	page, err = storage.GetUserURLs(ctx, "user", URLQuery{CreatedFrom: &future})
+	assert.NoError(t, err)
+	assert.Empty(t, page.Links)
+
+	_, err = storage.GetUserURLs(ctx, "user", URLQuery{Sort: SortCreatedAsc, Cursor: query.Cursor})
+	assert.True(t, IsErrorType(err, "invalid cursor"), "The cursor of another order should be rejected")
+}
+
+func TestMemoryStorage_Tags(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+
+	first, err := storage.Set(ctx, models.Link{OriginalURL: "https://a.example.com", UserID: "user", Tags: []string{"sale", "spring"}, Folder: "campaigns"})
+	assert.NoError(t, err)
+	second, err := storage.Set(ctx, models.Link{OriginalURL: "https://b.example.com", UserID: "user"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, storage.SetLinkLabels(ctx, "user", second, []string{"promo", "spring"}, ""))
+	assert.True(t, IsErrorType(storage.SetLinkLabels(ctx, "intruder", second, nil, ""), "not found"))
+
+	page, err := storage.GetUserURLs(ctx, "user", URLQuery{Tags: []string{"sale", "spring"}, Folder: "campaigns"})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Links, 1) {
+		assert.Equal(t, []string{"sale", "spring"}, page.Links[0].Tags)
+	}
+
+	// Renaming to an existing tag merges the two
+	renamed, err := storage.RenameTag(ctx, "user", "promo", "sale")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, renamed)
+	renamed, err = storage.RenameTag(ctx, "user", "promo", "sale")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, renamed)
+
+	tags, err := storage.GetUserTags(ctx, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, []models.TagCount{{Tag: "sale", Count: 2}, {Tag: "spring", Count: 2}}, tags)
+
+	_, err = storage.DeleteBatch(ctx, []models.KeysToDelete{{Keys: []string{first}, UserID: "user"}})
+	assert.NoError(t, err)
+	tags, err = storage.GetUserTags(ctx, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, []models.TagCount{{Tag: "sale", Count: 1}, {Tag: "spring", Count: 1}}, tags)
+}
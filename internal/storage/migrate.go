@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"shorter/internal/urlkey"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID - the key of the advisory lock that keeps instances from migrating at the same time
+const migrationLockID int64 = 7_311_020_418
+
+// Migration - a versioned schema change loaded from migrations/NNNN_name.{up,down}.sql
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus - a migration and the time it was applied, nil if it is pending
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// migrationStep - the part of a migration that needs Go code, it runs in the transaction of the migration before its SQL
+type migrationStep func(ctx context.Context, tx *sql.Tx, keys urlkey.KeyGenerator) error
+
+// migrationSteps - the Go steps of the migrations by version
+var migrationSteps = map[int64]migrationStep{
+	2:  rekeyDuplicateLinks,
+	16: normalizeLegacyURLs,
+}
+
+type Migrator struct {
+	db         *sql.DB
+	keys       urlkey.KeyGenerator // gives new keys to the links the migrations have to move
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB, keys urlkey.KeyGenerator) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, keys: keys, migrations: migrations}, nil
+}
+
+// loadMigrations - reads the migrations ordered by version
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, file := range files {
+		base := path.Base(file)
+		name, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s should be named NNNN_name.up.sql or NNNN_name.down.sql", base)
+		}
+		prefix, title, _ := strings.Cut(name, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s should start with its version: %w", base, err)
+		}
+
+		body, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", base, err)
+		}
+
+		m, found := byVersion[version]
+		if !found {
+			m = &Migration{Version: version, Name: title}
+			byVersion[version] = m
+		}
+		if m.Name != title {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", m.Name, title, version)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up step", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Status - lists all migrations with the time they were applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Migration: migration}
+			if at, found := applied[migration.Version]; found {
+				status.AppliedAt = &at
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Up - applies up to steps pending migrations, all of them if steps <= 0
+func (m *Migrator) Up(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if steps > 0 && len(done) == steps {
+				break
+			}
+			if _, found := applied[migration.Version]; found {
+				continue
+			}
+			step := func(ctx context.Context, tx *sql.Tx) error {
+				if run, found := migrationSteps[migration.Version]; found {
+					return run(ctx, tx, m.keys)
+				}
+				return nil
+			}
+			insert := `INSERT INTO schema_migrations (Version, Name) VALUES ($1, $2)`
+			err := runInTx(ctx, conn, step, migration.Up, insert, migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down - reverts the last steps applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, found := applied[migration.Version]; !found {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s can't be reverted", migration.Version, migration.Name)
+			}
+			remove := `DELETE FROM schema_migrations WHERE Version = $1`
+			err := runInTx(ctx, conn, nil, migration.Down, remove, migration.Version)
+			if err != nil {
+				return fmt.Errorf("failed to revert migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// withLock - runs fn on a single connection holding the migration advisory lock
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	// Wait until another instance finishes migrating
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+        Version BIGINT PRIMARY KEY,
+        Name VARCHAR(256) NOT NULL,
+        AppliedAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    )`
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return fn(conn)
+}
+
+// appliedMigrations - returns the versions recorded in schema_migrations
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT Version, AppliedAt FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %s", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	return applied, nil
+}
+
+// runInTx - runs the Go step of the migration if there is one, its script and records it in one transaction
+func runInTx(ctx context.Context, conn *sql.Conn, step func(ctx context.Context, tx *sql.Tx) error, script string, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if step != nil {
+		if err := step(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rekeyDuplicateLinks - the positional-sum keys of the first versions collided, so several links could share a key.
+// The oldest link keeps the key, the others get new keys before the key is made unique.
+func rekeyDuplicateLinks(ctx context.Context, tx *sql.Tx, keys urlkey.KeyGenerator) error {
+	query := `SELECT ID, ShortURL, OriginalURL FROM Links
+        WHERE ShortURL IN (SELECT ShortURL FROM Links GROUP BY ShortURL HAVING COUNT(*) > 1)
+        ORDER BY ShortURL, ID`
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to select duplicate keys: %w", err)
+	}
+	defer rows.Close()
+
+	type duplicate struct {
+		id          int64
+		key         string
+		originalURL string
+	}
+	var duplicates []duplicate
+	previousKey := ""
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.id, &d.key, &d.originalURL); err != nil {
+			return fmt.Errorf("failed to scan row: %s", err)
+		}
+		if d.key == previousKey {
+			duplicates = append(duplicates, d)
+		}
+		previousKey = d.key
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	rows.Close()
+
+	if len(duplicates) == 0 {
+		return nil
+	}
+	if keys == nil {
+		return fmt.Errorf("%d links share their keys, a key generator is needed to move them", len(duplicates))
+	}
+
+	// A sequence should not give out the keys of the stored links
+	var maxID int64
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(ID), 0) FROM Links`).Scan(&maxID); err != nil {
+		return fmt.Errorf("failed to select max id: %w", err)
+	}
+	urlkey.Seed(keys, uint64(maxID))
+
+	for _, d := range duplicates {
+		key, err := freeLinkKey(ctx, tx, keys, d.originalURL)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE Links SET ShortURL = $1 WHERE ID = $2`, key, d.id); err != nil {
+			return fmt.Errorf("failed to move link %d to a new key: %w", d.id, err)
+		}
+		log.Printf("Migration: link %d moved from the shared key %s to %s\n", d.id, d.key, key)
+	}
+	return nil
+}
+
+// freeLinkKey - generates keys for the URL until one is not stored yet
+func freeLinkKey(ctx context.Context, tx *sql.Tx, keys urlkey.KeyGenerator, originalURL string) (string, error) {
+	for attempt := 0; attempt < urlkey.MaxAttempts; attempt++ {
+		key, err := keys.Generate(originalURL, attempt)
+		if err != nil || key == "" {
+			return "", fmt.Errorf("failed to generate the short url: %v", err)
+		}
+		var taken bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM Links WHERE ShortURL = $1)`, key).Scan(&taken); err != nil {
+			return "", fmt.Errorf("failed to check the key: %w", err)
+		}
+		if !taken {
+			return key, nil
+		}
+	}
+	return "", errors.New("no free key found")
+}
+
+// normalizeLegacyURLs - 0006 copied OriginalURL into NormalizedURL, so the links stored before it were not found
+// by the canonical form of a new submission. Their NormalizedURL is recomputed as the file storage does on load.
+func normalizeLegacyURLs(ctx context.Context, tx *sql.Tx, _ urlkey.KeyGenerator) error {
+	query := `SELECT ID, COALESCE(UserID, ''), ShortURL, OriginalURL, NormalizedURL FROM Links
+        ORDER BY COALESCE(UserID, ''), ID`
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to select links: %w", err)
+	}
+	defer rows.Close()
+
+	type link struct {
+		id            int64
+		userID        string
+		key           string
+		originalURL   string
+		normalizedURL string
+	}
+	updates := make(map[int64]string)
+	// The links of a user are checked together, the normalized URLs are unique per user
+	normalizeUser := func(links []link) {
+		taken := make(map[string]bool, len(links))
+		for _, l := range links {
+			if l.normalizedURL != l.originalURL {
+				taken[l.normalizedURL] = true
+			}
+		}
+		for _, l := range links {
+			if l.normalizedURL != l.originalURL {
+				continue
+			}
+			normalizedURL := legacyNormalizedURL(l.originalURL, l.key, func(normalizedURL string) bool {
+				return taken[normalizedURL]
+			})
+			taken[normalizedURL] = true
+			if normalizedURL != l.normalizedURL {
+				updates[l.id] = normalizedURL
+			}
+		}
+	}
+
+	var userLinks []link
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(&l.id, &l.userID, &l.key, &l.originalURL, &l.normalizedURL); err != nil {
+			return fmt.Errorf("failed to scan row: %s", err)
+		}
+		if len(userLinks) > 0 && userLinks[0].userID != l.userID {
+			normalizeUser(userLinks)
+			userLinks = userLinks[:0]
+		}
+		userLinks = append(userLinks, l)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error while iterating over rows: %w", err)
+	}
+	rows.Close()
+	normalizeUser(userLinks)
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	// A new value can still be held by another link that is not updated yet, so the links
+	// get a placeholder first. It is unique by the key and never looks like a URL.
+	ids := make([]int64, 0, len(updates))
+	for id := range updates {
+		ids = append(ids, id)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE Links SET NormalizedURL = '#' || ShortURL WHERE ID = ANY($1)`, ids); err != nil {
+		return fmt.Errorf("failed to reset the normalized urls: %w", err)
+	}
+	for id, normalizedURL := range updates {
+		if _, err := tx.ExecContext(ctx, `UPDATE Links SET NormalizedURL = $1 WHERE ID = $2`, normalizedURL, id); err != nil {
+			return fmt.Errorf("failed to normalize the url of link %d: %w", id, err)
+		}
+	}
+	log.Printf("Migration: normalized the urls of %d links\n", len(updates))
+	return nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"shorter/internal/urlkey"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// newTestDB - connects to the database of TEST_DATABASE_DSN in a schema of its own, the test is skipped without it
+func newTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	// The search path belongs to the connection, so there is only one
+	db.SetMaxOpenConns(1)
+
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	_, err = db.Exec(`CREATE SCHEMA ` + schema)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		db.Close()
+	})
+	_, err = db.Exec(`SET search_path TO ` + schema)
+	require.NoError(t, err)
+	return db
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.NotEmpty(t, m.Up, "Migration %d should have an up step", m.Version)
+		assert.NotEmpty(t, m.Down, "Migration %d should have a down step", m.Version)
+		if i > 0 {
+			assert.Greater(t, m.Version, migrations[i-1].Version, "Migrations should be ordered by version")
+		}
+	}
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{
+			name:  "No version",
+			files: fstest.MapFS{"migrations/links.up.sql": {Data: []byte("SELECT 1")}},
+		},
+		{
+			name:  "No direction",
+			files: fstest.MapFS{"migrations/0001_links.sql": {Data: []byte("SELECT 1")}},
+		},
+		{
+			name:  "Only the down step",
+			files: fstest.MapFS{"migrations/0001_links.down.sql": {Data: []byte("SELECT 1")}},
+		},
+		{
+			name: "Shared version",
+			files: fstest.MapFS{
+				"migrations/0001_links.up.sql":  {Data: []byte("SELECT 1")},
+				"migrations/0001_clicks.up.sql": {Data: []byte("SELECT 1")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadMigrations(tt.files)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMigrator_RekeysSharedKeys(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	migrator, err := NewMigrator(db, urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+	require.NoError(t, err)
+
+	_, err = migrator.Up(ctx, 1)
+	require.NoError(t, err)
+	// The positional-sum keys of the first versions collided
+	_, err = db.ExecContext(ctx, `INSERT INTO Links (ShortURL, OriginalURL) VALUES ('abc', 'https://a.example.com'), ('abc', 'https://b.example.com')`)
+	require.NoError(t, err)
+
+	applied, err := migrator.Up(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, applied, 1)
+	assert.Equal(t, int64(2), applied[0].Version)
+
+	rows, err := db.QueryContext(ctx, `SELECT ShortURL, OriginalURL FROM Links ORDER BY ID`)
+	require.NoError(t, err)
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key, originalURL string
+		require.NoError(t, rows.Scan(&key, &originalURL))
+		keys = append(keys, key)
+	}
+	require.NoError(t, rows.Err())
+	require.Len(t, keys, 2)
+	assert.Equal(t, "abc", keys[0], "The oldest link should keep the key")
+	assert.NotEqual(t, "abc", keys[1])
+	assert.NotEmpty(t, keys[1])
+}
+
+func TestMigrator_NormalizesLegacyURLs(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	migrator, err := NewMigrator(db, urlkey.NewHashGenerator(urlkey.DefaultLength, urlkey.Base62Alphabet))
+	require.NoError(t, err)
+
+	_, err = migrator.Up(ctx, 15)
+	require.NoError(t, err)
+	// The links stored before 0006 got their OriginalURL as NormalizedURL, both have the same canonical form
+	_, err = db.ExecContext(ctx, `INSERT INTO Links (ShortURL, OriginalURL, NormalizedURL, UserID) VALUES
+        ('first', 'HTTPS://Example.com/a', 'HTTPS://Example.com/a', 'u1'),
+        ('second', 'https://example.com/a#top', 'https://example.com/a#top', 'u1')`)
+	require.NoError(t, err)
+
+	_, err = migrator.Up(ctx, 0)
+	require.NoError(t, err)
+
+	normalized := func(key string) string {
+		var normalizedURL string
+		require.NoError(t, db.QueryRowContext(ctx, `SELECT NormalizedURL FROM Links WHERE ShortURL = $1`, key).Scan(&normalizedURL))
+		return normalizedURL
+	}
+	assert.Equal(t, "https://example.com/a", normalized("first"), "The first link should take the canonical form")
+	assert.Equal(t, "https://example.com/a#second", normalized("second"))
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS Links (
+    ID SERIAL PRIMARY KEY,
+    UserID VARCHAR(128) NULL,
+    CorrelationID VARCHAR(128) NULL,
+    ShortURL VARCHAR(128) NOT NULL,
+    OriginalURL VARCHAR(512) NOT NULL UNIQUE,
+    DeletedFlag BOOLEAN DEFAULT FALSE,
+    AddedDate TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS Links_ShortURL_idx;
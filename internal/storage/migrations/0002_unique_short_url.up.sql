@@ -0,0 +1,3 @@
+-- Short keys are no longer derived from the URL, so their uniqueness is checked by the DB.
+-- The links that shared a positional-sum key were moved to new keys by the Go step of the migration.
+CREATE UNIQUE INDEX IF NOT EXISTS Links_ShortURL_idx ON Links (ShortURL);
@@ -0,0 +1,3 @@
+ALTER TABLE Links
+    DROP COLUMN IF EXISTS ExpiresAt,
+    DROP COLUMN IF EXISTS ExpiredFlag;
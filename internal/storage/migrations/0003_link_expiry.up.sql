@@ -0,0 +1,3 @@
+ALTER TABLE Links
+    ADD COLUMN IF NOT EXISTS ExpiresAt TIMESTAMPTZ NULL,
+    ADD COLUMN IF NOT EXISTS ExpiredFlag BOOLEAN DEFAULT FALSE;
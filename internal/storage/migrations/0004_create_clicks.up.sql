@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS Clicks (
+    ID BIGSERIAL PRIMARY KEY,
+    ShortURL VARCHAR(128) NOT NULL,
+    ClickedAt TIMESTAMPTZ NOT NULL,
+    Referrer TEXT NULL,
+    UserAgent TEXT NULL,
+    IP VARCHAR(64) NULL
+);
+
+CREATE INDEX IF NOT EXISTS Clicks_ShortURL_ClickedAt_idx ON Clicks (ShortURL, ClickedAt);
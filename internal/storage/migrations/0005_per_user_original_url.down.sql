@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS Links_UserID_OriginalURL_idx;
+
+ALTER TABLE Links ADD CONSTRAINT links_originalurl_key UNIQUE (OriginalURL);
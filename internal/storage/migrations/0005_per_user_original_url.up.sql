@@ -0,0 +1,4 @@
+-- The same destination can be shortened by every user, each gets their own key
+ALTER TABLE Links DROP CONSTRAINT IF EXISTS links_originalurl_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS Links_UserID_OriginalURL_idx ON Links (UserID, OriginalURL);
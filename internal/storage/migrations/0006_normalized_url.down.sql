@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS Links_UserID_NormalizedURL_idx;
+
+ALTER TABLE Links DROP COLUMN IF EXISTS NormalizedURL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS Links_UserID_OriginalURL_idx ON Links (UserID, OriginalURL);
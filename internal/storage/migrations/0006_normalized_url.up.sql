@@ -0,0 +1,10 @@
+-- The duplicates are found by the canonical form of the URL, the redirect still uses OriginalURL
+ALTER TABLE Links ADD COLUMN IF NOT EXISTS NormalizedURL VARCHAR(512) NULL;
+
+UPDATE Links SET NormalizedURL = OriginalURL WHERE NormalizedURL IS NULL;
+
+ALTER TABLE Links ALTER COLUMN NormalizedURL SET NOT NULL;
+
+DROP INDEX IF EXISTS Links_UserID_OriginalURL_idx;
+
+CREATE UNIQUE INDEX IF NOT EXISTS Links_UserID_NormalizedURL_idx ON Links (UserID, NormalizedURL);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS LinkHistory (
+    ID BIGSERIAL PRIMARY KEY,
+    ShortURL VARCHAR(128) NOT NULL,
+    OriginalURL VARCHAR(512) NOT NULL,
+    ChangedAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS LinkHistory_ShortURL_idx ON LinkHistory (ShortURL);
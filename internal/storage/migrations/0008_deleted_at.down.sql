@@ -0,0 +1 @@
+ALTER TABLE Links DROP COLUMN IF EXISTS DeletedAt;
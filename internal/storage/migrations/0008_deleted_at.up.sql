@@ -0,0 +1,4 @@
+ALTER TABLE Links ADD COLUMN IF NOT EXISTS DeletedAt TIMESTAMPTZ NULL;
+
+-- The time of the earlier deletions is unknown, their retention starts now
+UPDATE Links SET DeletedAt = NOW() WHERE DeletedFlag AND DeletedAt IS NULL;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS DeleteQueue (
+    ID BIGSERIAL PRIMARY KEY,
+    UserID VARCHAR(128) NOT NULL,
+    JobID VARCHAR(64) NULL,
+    Keys JSONB NOT NULL,
+    Attempts INT NOT NULL DEFAULT 0,
+    NextAttemptAt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    LastError TEXT NULL,
+    DeadFlag BOOLEAN NOT NULL DEFAULT FALSE,
+    CreatedAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS DeleteQueue_NextAttemptAt_idx ON DeleteQueue (NextAttemptAt) WHERE DeadFlag = false;
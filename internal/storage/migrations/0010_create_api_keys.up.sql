@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS APIKeys (
+    ID VARCHAR(32) PRIMARY KEY,
+    UserID VARCHAR(128) NOT NULL,
+    Name VARCHAR(255) NOT NULL DEFAULT '',
+    Prefix VARCHAR(32) NOT NULL,
+    Hash CHAR(64) NOT NULL UNIQUE,
+    CreatedAt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    RevokedAt TIMESTAMPTZ NULL
+);
+
+CREATE INDEX IF NOT EXISTS APIKeys_UserID_idx ON APIKeys (UserID);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS Users (
+    ID VARCHAR(128) PRIMARY KEY,
+    Login VARCHAR(64) NOT NULL UNIQUE,
+    PasswordHash VARCHAR(255) NOT NULL,
+    CreatedAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
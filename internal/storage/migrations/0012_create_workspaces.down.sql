@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS WorkspaceMembers;
+DROP TABLE IF EXISTS Workspaces;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS Workspaces (
+    ID VARCHAR(128) PRIMARY KEY,
+    Name VARCHAR(255) NOT NULL,
+    CreatedAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS WorkspaceMembers (
+    WorkspaceID VARCHAR(128) NOT NULL REFERENCES Workspaces (ID) ON DELETE CASCADE,
+    UserID VARCHAR(128) NOT NULL,
+    Role VARCHAR(16) NOT NULL,
+    AddedAt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (WorkspaceID, UserID)
+);
+
+CREATE INDEX IF NOT EXISTS WorkspaceMembers_UserID_idx ON WorkspaceMembers (UserID);
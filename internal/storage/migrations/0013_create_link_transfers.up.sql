@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS LinkTransfers (
+    ID BIGSERIAL PRIMARY KEY,
+    ShortURL VARCHAR(128) NOT NULL,
+    FromID VARCHAR(128) NOT NULL,
+    ToID VARCHAR(128) NOT NULL,
+    ActorID VARCHAR(128) NOT NULL,
+    TransferredAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS LinkTransfers_ShortURL_idx ON LinkTransfers (ShortURL);
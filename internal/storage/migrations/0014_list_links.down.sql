@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS Links_UserID_Domain_idx;
+DROP INDEX IF EXISTS Links_UserID_OriginalURL_ShortURL_idx;
+DROP INDEX IF EXISTS Links_UserID_AddedDate_idx;
+
+ALTER TABLE Links DROP COLUMN IF EXISTS Domain;
+
+ALTER TABLE Links
+    ALTER COLUMN AddedDate DROP NOT NULL,
+    ALTER COLUMN AddedDate TYPE TIMESTAMP,
+    ALTER COLUMN AddedDate SET DEFAULT CURRENT_TIMESTAMP;
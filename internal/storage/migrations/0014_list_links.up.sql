@@ -0,0 +1,16 @@
+-- The links are filtered and sorted by the creation time, so every link should have it
+UPDATE Links SET AddedDate = CURRENT_TIMESTAMP WHERE AddedDate IS NULL;
+
+ALTER TABLE Links
+    ALTER COLUMN AddedDate TYPE TIMESTAMPTZ,
+    ALTER COLUMN AddedDate SET DEFAULT NOW(),
+    ALTER COLUMN AddedDate SET NOT NULL;
+
+-- The host of the destination for the domain filter
+ALTER TABLE Links ADD COLUMN IF NOT EXISTS Domain VARCHAR(255)
+    GENERATED ALWAYS AS (lower(substring(NormalizedURL from '^[^:]+://(?:[^@/]*@)?([^/:?#]+)'))) STORED;
+
+-- The pages of a user's links are read in the order of these indexes
+CREATE INDEX IF NOT EXISTS Links_UserID_AddedDate_idx ON Links (UserID, AddedDate, ShortURL);
+CREATE INDEX IF NOT EXISTS Links_UserID_OriginalURL_ShortURL_idx ON Links (UserID, OriginalURL, ShortURL);
+CREATE INDEX IF NOT EXISTS Links_UserID_Domain_idx ON Links (UserID, Domain);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS Links_UserID_Folder_idx;
+DROP INDEX IF EXISTS Links_Tags_idx;
+
+ALTER TABLE Links
+    DROP COLUMN IF EXISTS Folder,
+    DROP COLUMN IF EXISTS Tags;
@@ -0,0 +1,7 @@
+ALTER TABLE Links
+    ADD COLUMN IF NOT EXISTS Tags TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS Folder VARCHAR(255) NULL;
+
+-- The filters by tag look up the links containing the tags
+CREATE INDEX IF NOT EXISTS Links_Tags_idx ON Links USING GIN (Tags);
+CREATE INDEX IF NOT EXISTS Links_UserID_Folder_idx ON Links (UserID, Folder);
@@ -0,0 +1,2 @@
+-- The canonical forms stay, the earlier versions find the duplicates by them as well
+ANALYZE Links;
@@ -0,0 +1,3 @@
+-- 0006 copied OriginalURL into NormalizedURL, the Go step of the migration replaced it with the canonical form.
+-- The statistics of the rewritten column are refreshed for the lookups by the normalized URL.
+ANALYZE Links;
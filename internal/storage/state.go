@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"shorter/internal/config"
+	"shorter/internal/urlkey"
+	"time"
+)
+
+// Link states reported by GetUserURLs
+const (
+	StateActive  = "active"
+	StateExpired = "expired"
+	StateDeleted = "deleted"
+)
+
+// isExpired - a link is expired once it was marked by the sweeper or its expiry time has passed
+func isExpired(expiredFlag bool, expiresAt *time.Time) bool {
+	return expiredFlag || (expiresAt != nil && !expiresAt.After(time.Now()))
+}
+
+// linkState - returns the state of the link, deletion takes precedence over expiry
+func linkState(deletedFlag bool, expiredFlag bool, expiresAt *time.Time) string {
+	if deletedFlag {
+		return StateDeleted
+	}
+	if isExpired(expiredFlag, expiresAt) {
+		return StateExpired
+	}
+	return StateActive
+}
+
+// Outcomes of deleting a key reported by DeleteBatch
+const (
+	DeleteDeleted        = "deleted"
+	DeleteNotFound       = "not found"
+	DeleteNotOwned       = "not owned"
+	DeleteAlreadyDeleted = "already deleted"
+)
+
+// deleteOutcome - only an active link of the user can be deleted
+func deleteOutcome(found bool, owned bool, deletedFlag bool) string {
+	switch {
+	case !found:
+		return DeleteNotFound
+	case !owned:
+		return DeleteNotOwned
+	case deletedFlag:
+		return DeleteAlreadyDeleted
+	}
+	return DeleteDeleted
+}
+
+// userURL - the key of the deduplication indexes: every user has their own copy of a URL
+type userURL struct {
+	userID string
+	url    string
+}
+
+// newUserURL - the URLs are compared in the normalized form, if it is known
+func newUserURL(userID, originalURL, normalizedURL string) userURL {
+	return userURL{userID: userID, url: dedupURL(originalURL, normalizedURL)}
+}
+
+// dedupURL - the records stored before the normalization was introduced only have the original URL
+func dedupURL(originalURL, normalizedURL string) string {
+	if normalizedURL != "" {
+		return normalizedURL
+	}
+	return originalURL
+}
+
+// legacyNormalizedURL - the normalized URL of a link stored before the normalization was introduced.
+// The first link of the user with the canonical form takes it. A later one gets its key as the fragment,
+// which a canonical form never has, so it stays unique and the new submissions find the first link.
+func legacyNormalizedURL(originalURL, key string, taken func(normalizedURL string) bool) string {
+	normalizedURL, err := urlkey.Normalize(originalURL, config.AppConfig.StripTracking)
+	if err != nil {
+		return originalURL
+	}
+	if taken(normalizedURL) {
+		return normalizedURL + "#" + key
+	}
+	return normalizedURL
+}
+
+// uniqueKeys - returns the keys without repetitions, keeping their order
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	unique := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"shorter/internal/config"
+	"shorter/internal/models"
+	"sort"
+	"time"
+)
+
+// HourlyStatsWindow - how far back the hourly buckets of the link stats go
+const HourlyStatsWindow = 48 * time.Hour
+
+type StatsStorer interface {
+	RecordClicks(ctx context.Context, clicks []models.Click) error
+	GetLinkStats(ctx context.Context, key string) (models.LinkStats, error)
+}
+
+// aggregateClicks - counts the clicks of the link by days and by the hours of the recent window
+func aggregateClicks(key string, clicks []time.Time) models.LinkStats {
+	stats := models.LinkStats{
+		ShortURL: config.AppConfig.ResultHost + "/" + key,
+		Total:    len(clicks),
+		Daily:    []models.StatsBucket{},
+		Hourly:   []models.StatsBucket{},
+	}
+
+	since := time.Now().Add(-HourlyStatsWindow)
+	daily := make(map[time.Time]int)
+	hourly := make(map[time.Time]int)
+
+	for _, t := range clicks {
+		t = t.UTC()
+		daily[t.Truncate(24*time.Hour)]++
+		if t.After(since) {
+			hourly[t.Truncate(time.Hour)]++
+		}
+	}
+	stats.Daily = toBuckets(daily)
+	stats.Hourly = toBuckets(hourly)
+	return stats
+}
+
+// toBuckets - converts the counters to buckets sorted by time
+func toBuckets(counters map[time.Time]int) []models.StatsBucket {
+	buckets := make([]models.StatsBucket, 0, len(counters))
+	for start, count := range counters {
+		buckets = append(buckets, models.StatsBucket{Start: start, Clicks: count})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets
+}
+
+// clickCounts - the clicks of a link counted by days and by hours, so the stats are built without the clicks themselves
+type clickCounts struct {
+	total  int
+	daily  map[time.Time]int
+	hourly map[time.Time]int
+}
+
+// add - counts the click, the hours that left the recent window are dropped
+func (c *clickCounts) add(t time.Time) {
+	if c.daily == nil {
+		c.daily = make(map[time.Time]int)
+		c.hourly = make(map[time.Time]int)
+	}
+	t = t.UTC()
+	c.total++
+	c.daily[t.Truncate(24*time.Hour)]++
+
+	since := time.Now().Add(-HourlyStatsWindow).Truncate(time.Hour)
+	if t.Before(since) {
+		return
+	}
+	c.hourly[t.Truncate(time.Hour)]++
+	for start := range c.hourly {
+		if start.Before(since) {
+			delete(c.hourly, start)
+		}
+	}
+}
+
+// stats - the counters as the link stats, the hour the recent window starts in is counted whole
+func (c *clickCounts) stats(key string) models.LinkStats {
+	since := time.Now().Add(-HourlyStatsWindow)
+	hourly := make(map[time.Time]int, len(c.hourly))
+	for start, count := range c.hourly {
+		if start.Add(time.Hour).After(since) {
+			hourly[start] = count
+		}
+	}
+	return models.LinkStats{
+		ShortURL: config.AppConfig.ResultHost + "/" + key,
+		Total:    c.total,
+		Daily:    toBuckets(c.daily),
+		Hourly:   toBuckets(hourly),
+	}
+}
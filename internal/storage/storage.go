@@ -5,22 +5,53 @@ import (
 	"fmt"
 	"shorter/internal/config"
 	"shorter/internal/models"
+	"shorter/internal/urlkey"
+	"time"
 )
 
 type Storer interface {
-	Set(ctx context.Context, url string, userID string) (string, error)
+	Set(ctx context.Context, link models.Link) (string, error)
 	SetBatch(ctx context.Context, entries []models.JSONReq, userID string) ([]models.JSONRes, error)
-	DeleteBatch(ctx context.Context, keysToDelete []models.KeysToDelete) (bool, error)
-	GetUserURLs(ctx context.Context, userID string) ([]models.JSONUserRes, error)
+	// DeleteBatch - marks the links as deleted and reports the outcome of every key in the order of the request
+	DeleteBatch(ctx context.Context, keysToDelete []models.KeysToDelete) ([]models.DeleteResult, error)
+	ExpireLinks(ctx context.Context) (int, error)
+	// GetUserURLs - returns a page of the user's links that pass the filters of the query
+	GetUserURLs(ctx context.Context, userID string, query URLQuery) (URLPage, error)
 	Get(ctx context.Context, key string) (string, error)
+	GetLink(ctx context.Context, key string) (models.Link, error)
+	// Update - points the user's link to link.OriginalURL and keeps the previous URL in the history
+	Update(ctx context.Context, link models.Link) error
+	GetLinkHistory(ctx context.Context, key string) ([]models.LinkChange, error)
+	// GetUserTrash - returns the deleted links of the user that are not purged yet
+	GetUserTrash(ctx context.Context, userID string) ([]models.JSONUserRes, error)
+	// Restore - undeletes the user's links and returns the keys that were restored
+	Restore(ctx context.Context, userID string, keys []string) ([]string, error)
+	// PurgeDeleted - removes for good the links deleted before the given time
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+	// TransferLinks - hands the links from one owner to another and records it on behalf of actorID.
+	// Either all links are transferred or none of them.
+	TransferLinks(ctx context.Context, fromID, toID string, keys []string, actorID string) error
+	GetLinkTransfers(ctx context.Context, key string) ([]models.LinkTransfer, error)
+	StatsStorer
+	DeletionQueue
+	APIKeyStorer
+	UserStorer
+	WorkspaceStorer
+	TagStorer
 	IsAvailable() bool
 	Close() error
 }
 
 func NewStorage(appConfig config.Config) (Storer, error) {
+	// Initialize the short key generator shared by all storages
+	keys, err := urlkey.NewKeyGenerator(appConfig.KeyStrategy, appConfig.KeyLength, appConfig.KeyAlphabet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize key generator: %w", err)
+	}
+
 	// If DB connection is provided, initialize DB storage
 	if appConfig.DBConnection != "" {
-		dbStorage, err := NewDBStorage(appConfig.DBConnection)
+		dbStorage, err := NewDBStorage(appConfig.DBConnection, keys)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize database storage: %w", err)
 		}
@@ -28,16 +59,20 @@ func NewStorage(appConfig config.Config) (Storer, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to migrate database storage: %w", err)
 		}
+		err = dbStorage.SeedKeys(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to seed key generator: %w", err)
+		}
 		return dbStorage, nil
 	}
 	// If FilePath is provided (but no DB), initialize file storage
 	if appConfig.StoragePath != "" {
-		fileStorage, err := NewFileStorage(appConfig.StoragePath)
+		fileStorage, err := NewFileStorage(appConfig.StoragePath, keys, appConfig.FileSync, appConfig.FileSyncInterval)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize file storage: %w", err)
 		}
 		return fileStorage, nil
 	}
 	// Default to in-memory storage
-	return NewMemoryStorage(), nil
+	return NewMemoryStorage(keys), nil
 }
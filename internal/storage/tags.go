@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"shorter/internal/models"
+	"slices"
+	"sort"
+)
+
+// TagStorer keeps the tags and the folders the owners put on their links. The tags are given
+// normalized by the handlers, so they are compared as they are.
+type TagStorer interface {
+	// SetLinkLabels - replaces the tags and the folder of the owner's link
+	SetLinkLabels(ctx context.Context, ownerID, key string, tags []string, folder string) error
+	// GetUserTags - counts the owner's links by tag, the deleted links are not counted
+	GetUserTags(ctx context.Context, ownerID string) ([]models.TagCount, error)
+	// RenameTag - renames the tag on all links of the owner, a link that already has
+	// the new tag keeps one of them. Returns the number of changed links.
+	RenameTag(ctx context.Context, ownerID, from, to string) (int, error)
+}
+
+// renameTag - returns the sorted tags with the tag renamed, or false if the link does not have it
+func renameTag(tags []string, from, to string) ([]string, bool) {
+	if !slices.Contains(tags, from) {
+		return nil, false
+	}
+	renamed := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == from {
+			tag = to
+		}
+		if !slices.Contains(renamed, tag) {
+			renamed = append(renamed, tag)
+		}
+	}
+	sort.Strings(renamed)
+	return renamed, true
+}
+
+// tagCounter - counts the tags of the links kept by the memory and file storages
+type tagCounter map[string]int
+
+func (c tagCounter) add(link models.Link) {
+	if link.DeletedFlag {
+		return
+	}
+	for _, tag := range link.Tags {
+		c[tag]++
+	}
+}
+
+// counts - the tags in alphabetical order
+func (c tagCounter) counts() []models.TagCount {
+	counts := make([]models.TagCount, 0, len(c))
+	for tag, count := range c {
+		counts = append(counts, models.TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Tag < counts[j].Tag })
+	return counts
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"shorter/internal/models"
+)
+
+// UserStorer keeps the registered accounts. The logins are unique.
+type UserStorer interface {
+	CreateUser(ctx context.Context, user models.User) error
+	GetUserByLogin(ctx context.Context, login string) (models.User, error)
+	GetUser(ctx context.Context, userID string) (models.User, error)
+}
+
+// userList - the accounts kept in memory by the memory and file storages.
+// The caller should hold the lock that guards the list.
+type userList struct {
+	byID    map[string]*models.User
+	byLogin map[string]*models.User
+}
+
+func newUserList() *userList {
+	return &userList{
+		byID:    make(map[string]*models.User),
+		byLogin: make(map[string]*models.User),
+	}
+}
+
+func (l *userList) add(user models.User) error {
+	if _, found := l.byLogin[user.Login]; found {
+		return NewStorageError("already exists", "", "", fmt.Errorf("the login %s is taken", user.Login))
+	}
+	if _, found := l.byID[user.ID]; found {
+		return NewStorageError("already exists", "", "", fmt.Errorf("the user %s already has an account", user.ID))
+	}
+	l.byID[user.ID] = &user
+	l.byLogin[user.Login] = &user
+	return nil
+}
+
+func (l *userList) getByLogin(login string) (models.User, error) {
+	user, found := l.byLogin[login]
+	if !found {
+		return models.User{}, NewStorageError("not found", "", "", fmt.Errorf("the login %s is not found", login))
+	}
+	return *user, nil
+}
+
+func (l *userList) get(userID string) (models.User, error) {
+	user, found := l.byID[userID]
+	if !found {
+		return models.User{}, NewStorageError("not found", "", "", fmt.Errorf("the user %s is not found", userID))
+	}
+	return *user, nil
+}
+
+func (l *userList) all() []models.User {
+	users := make([]models.User, 0, len(l.byID))
+	for _, user := range l.byID {
+		users = append(users, *user)
+	}
+	return users
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"shorter/internal/models"
+	"sort"
+)
+
+// The roles of the workspace members, each one can do everything the previous one can
+const (
+	RoleViewer = "viewer" // sees the links
+	RoleEditor = "editor" // creates, changes and deletes the links
+	RoleOwner  = "owner"  // manages the members
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// IsRole - checks if the role is known
+func IsRole(role string) bool {
+	_, found := roleRanks[role]
+	return found
+}
+
+// RoleAllows - checks if the role grants the rights of the required one
+func RoleAllows(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required] && roleRanks[role] > 0
+}
+
+// WorkspaceStorer keeps the workspaces and their members.
+// A workspace always keeps at least one owner.
+type WorkspaceStorer interface {
+	// CreateWorkspace - stores the workspace with its first members
+	CreateWorkspace(ctx context.Context, ws models.Workspace) error
+	// GetWorkspaceRole - returns the role of the user, a user who is not a member is not found
+	GetWorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error)
+	GetUserWorkspaces(ctx context.Context, userID string) ([]models.JSONWorkspaceRes, error)
+	GetWorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error)
+	// SetWorkspaceMember - adds the member or changes the role of an existing one
+	SetWorkspaceMember(ctx context.Context, workspaceID string, member models.WorkspaceMember) error
+	RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error
+}
+
+func workspaceNotFound(workspaceID string) error {
+	return NewStorageError("not found", "", "", fmt.Errorf("the workspace %s is not found", workspaceID))
+}
+
+func lastOwner(workspaceID string) error {
+	return NewStorageError("last owner", "", "", fmt.Errorf("the workspace %s should keep an owner", workspaceID))
+}
+
+// workspaceList - the workspaces kept in memory by the memory and file storages.
+// The caller should hold the lock that guards the list.
+type workspaceList struct {
+	workspaces map[string]*models.Workspace
+}
+
+func newWorkspaceList() *workspaceList {
+	return &workspaceList{workspaces: make(map[string]*models.Workspace)}
+}
+
+func (l *workspaceList) add(ws models.Workspace) error {
+	if _, found := l.workspaces[ws.ID]; found {
+		return NewStorageError("already exists", "", "", fmt.Errorf("the workspace %s already exists", ws.ID))
+	}
+	ws.Members = append([]models.WorkspaceMember(nil), ws.Members...)
+	l.workspaces[ws.ID] = &ws
+	return nil
+}
+
+func (l *workspaceList) role(workspaceID, userID string) (string, error) {
+	ws, found := l.workspaces[workspaceID]
+	if !found {
+		return "", workspaceNotFound(workspaceID)
+	}
+	for _, member := range ws.Members {
+		if member.UserID == userID {
+			return member.Role, nil
+		}
+	}
+	return "", NewStorageError("not found", "", "", fmt.Errorf("the user %s is not a member of %s", userID, workspaceID))
+}
+
+// user - returns the workspaces of the user ordered by the time they were created
+func (l *workspaceList) user(userID string) []models.JSONWorkspaceRes {
+	found := []models.JSONWorkspaceRes{}
+	for _, ws := range l.workspaces {
+		for _, member := range ws.Members {
+			if member.UserID == userID {
+				found = append(found, models.JSONWorkspaceRes{ID: ws.ID, Name: ws.Name, Role: member.Role, CreatedAt: ws.CreatedAt})
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].CreatedAt.Equal(found[j].CreatedAt) {
+			return found[i].ID < found[j].ID
+		}
+		return found[i].CreatedAt.Before(found[j].CreatedAt)
+	})
+	return found
+}
+
+func (l *workspaceList) members(workspaceID string) ([]models.WorkspaceMember, error) {
+	ws, found := l.workspaces[workspaceID]
+	if !found {
+		return nil, workspaceNotFound(workspaceID)
+	}
+	return append([]models.WorkspaceMember{}, ws.Members...), nil
+}
+
+func (l *workspaceList) setMember(workspaceID string, member models.WorkspaceMember) error {
+	ws, found := l.workspaces[workspaceID]
+	if !found {
+		return workspaceNotFound(workspaceID)
+	}
+	members := append([]models.WorkspaceMember(nil), ws.Members...)
+	replaced := false
+	for i := range members {
+		if members[i].UserID == member.UserID {
+			members[i].Role = member.Role
+			replaced = true
+		}
+	}
+	if !replaced {
+		members = append(members, member)
+	}
+	if !hasOwner(members) {
+		return lastOwner(workspaceID)
+	}
+	ws.Members = members
+	return nil
+}
+
+func (l *workspaceList) removeMember(workspaceID, userID string) error {
+	ws, found := l.workspaces[workspaceID]
+	if !found {
+		return workspaceNotFound(workspaceID)
+	}
+	members := make([]models.WorkspaceMember, 0, len(ws.Members))
+	for _, member := range ws.Members {
+		if member.UserID != userID {
+			members = append(members, member)
+		}
+	}
+	if len(members) == len(ws.Members) {
+		return NewStorageError("not found", "", "", fmt.Errorf("the user %s is not a member of %s", userID, workspaceID))
+	}
+	if !hasOwner(members) {
+		return lastOwner(workspaceID)
+	}
+	ws.Members = members
+	return nil
+}
+
+func (l *workspaceList) all() []models.Workspace {
+	found := make([]models.Workspace, 0, len(l.workspaces))
+	for _, ws := range l.workspaces {
+		found = append(found, *ws)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+	return found
+}
+
+func hasOwner(members []models.WorkspaceMember) bool {
+	for _, member := range members {
+		if member.Role == RoleOwner {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package urlkey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	Base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	DefaultLength  = 8
+	MinLength      = 4
+	MaxLength      = 32
+	// MaxAttempts - how many keys a storage tries before giving up on a collision
+	MaxAttempts = 10
+
+	StrategyHash     = "hash"
+	StrategyRandom   = "random"
+	StrategySequence = "sequence"
+)
+
+// KeyGenerator - produces short keys for the stored URLs.
+// attempt is the number of collisions that already happened for the URL,
+// so a generator can return a different key on every retry.
+type KeyGenerator interface {
+	Generate(originalURL string, attempt int) (string, error)
+}
+
+// Seeder - implemented by generators that depend on the number of stored records
+type Seeder interface {
+	Seed(n uint64)
+}
+
+// Seed - moves the generator past the already stored records if it supports it
+func Seed(g KeyGenerator, n uint64) {
+	if s, ok := g.(Seeder); ok {
+		s.Seed(n)
+	}
+}
+
+// NewKeyGenerator - creates the generator for the configured strategy
+func NewKeyGenerator(strategy string, length int, alphabet string) (KeyGenerator, error) {
+	if alphabet == "" {
+		alphabet = Base62Alphabet
+	}
+	if length == 0 {
+		length = DefaultLength
+	}
+	if err := validateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	if length < MinLength || length > MaxLength {
+		return nil, fmt.Errorf("key length should be between %d and %d, got %d", MinLength, MaxLength, length)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(strategy)) {
+	case "", StrategyHash:
+		return NewHashGenerator(length, alphabet), nil
+	case StrategyRandom:
+		return NewRandomGenerator(length, alphabet), nil
+	case StrategySequence:
+		return NewSequenceGenerator(length, alphabet), nil
+	}
+	return nil, fmt.Errorf("unknown key strategy: %s", strategy)
+}
+
+// HashGenerator - derives the key from the SHA-256 of the URL.
+// On a collision the attempt number is mixed into the hash.
+type HashGenerator struct {
+	length   int
+	alphabet string
+}
+
+func NewHashGenerator(length int, alphabet string) *HashGenerator {
+	return &HashGenerator{length: length, alphabet: alphabet}
+}
+
+func (g *HashGenerator) Generate(originalURL string, attempt int) (string, error) {
+	u := strings.TrimSpace(originalURL)
+	if u == "" {
+		return "", fmt.Errorf("the URL is empty")
+	}
+	if attempt > 0 {
+		u += "#" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(u))
+	return encode(new(big.Int).SetBytes(sum[:]), g.alphabet, g.length), nil
+}
+
+// RandomGenerator - returns a random key of the configured length
+type RandomGenerator struct {
+	length   int
+	alphabet string
+}
+
+func NewRandomGenerator(length int, alphabet string) *RandomGenerator {
+	return &RandomGenerator{length: length, alphabet: alphabet}
+}
+
+func (g *RandomGenerator) Generate(originalURL string, attempt int) (string, error) {
+	max := big.NewInt(int64(len(g.alphabet)))
+	key := make([]byte, g.length)
+
+	for i := range key {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random key: %w", err)
+		}
+		key[i] = g.alphabet[n.Int64()]
+	}
+	return string(key), nil
+}
+
+// SequenceGenerator - encodes an increasing counter, padded to the configured length
+type SequenceGenerator struct {
+	length   int
+	alphabet string
+	counter  atomic.Uint64
+}
+
+func NewSequenceGenerator(length int, alphabet string) *SequenceGenerator {
+	return &SequenceGenerator{length: length, alphabet: alphabet}
+}
+
+func (g *SequenceGenerator) Generate(originalURL string, attempt int) (string, error) {
+	n := new(big.Int).SetUint64(g.counter.Add(1))
+	key := encode(n, g.alphabet, 0)
+
+	if pad := g.length - len(key); pad > 0 {
+		key = strings.Repeat(g.alphabet[:1], pad) + key
+	}
+	return key, nil
+}
+
+// Seed - continues the sequence after n already issued keys
+func (g *SequenceGenerator) Seed(n uint64) {
+	for {
+		current := g.counter.Load()
+		if current >= n || g.counter.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+// encode - writes n in the given alphabet, limit == 0 means all digits
+func encode(n *big.Int, alphabet string, limit int) string {
+	base := big.NewInt(int64(len(alphabet)))
+	mod := new(big.Int)
+	n = new(big.Int).Set(n)
+
+	var digits []byte
+	for n.Sign() > 0 && (limit == 0 || len(digits) < limit) {
+		n.DivMod(n, base, mod)
+		digits = append(digits, alphabet[mod.Int64()])
+	}
+	if len(digits) == 0 {
+		digits = append(digits, alphabet[0])
+	}
+
+	// The digits were collected from the least significant one
+	for i, j := 0, len(digits)-1; i < j; i, j = i+1, j-1 {
+		digits[i], digits[j] = digits[j], digits[i]
+	}
+	return string(digits)
+}
+
+// validateAlphabet - the alphabet should consist of unique characters that are safe in a URL path
+func validateAlphabet(alphabet string) error {
+	if len(alphabet) < 2 {
+		return fmt.Errorf("key alphabet should contain at least 2 characters")
+	}
+	seen := make(map[rune]bool, len(alphabet))
+	for _, c := range alphabet {
+		if !isUnreserved(c) {
+			return fmt.Errorf("key alphabet contains a character that is not URL safe: %q", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("key alphabet contains a duplicated character: %q", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// isUnreserved - checks the character against the RFC 3986 unreserved set
+func isUnreserved(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
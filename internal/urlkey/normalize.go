@@ -0,0 +1,146 @@
+package urlkey
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// TrackingParams - query parameters that only identify the campaign, besides the utm_* ones
+var TrackingParams = []string{"fbclid", "gclid", "yclid", "msclkid", "mc_cid", "mc_eid"}
+
+// defaultPorts - the ports that are implied by the scheme
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Normalize - returns the canonical form of the URL that is used to find duplicates.
+// The scheme and host are lowercased, an IDN host is converted to punycode, the default port
+// and the fragment are dropped and the percent-encoding is normalized.
+// If stripTracking is set, tracking parameters like utm_* are removed from the query.
+func Normalize(rawURL string, stripTracking bool) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the URL: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("the URL should contain a scheme and a host")
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	var b strings.Builder
+	b.WriteString(scheme + "://")
+	if u.User != nil {
+		b.WriteString(u.User.String() + "@")
+	}
+	b.WriteString(host)
+
+	path := normalizeEscapes(u.EscapedPath())
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path)
+
+	if query := normalizeQuery(u.RawQuery, stripTracking); query != "" {
+		b.WriteString("?" + query)
+	}
+	return b.String(), nil
+}
+
+// normalizeHost - lowercases the host and converts an internationalized name to punycode
+func normalizeHost(host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("the host %q is not valid: %w", host, err)
+	}
+	return ascii, nil
+}
+
+// normalizeQuery - normalizes the escapes of every parameter, keeping their order
+func normalizeQuery(rawQuery string, stripTracking bool) string {
+	if rawQuery == "" {
+		return ""
+	}
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		if stripTracking && isTrackingParam(param) {
+			continue
+		}
+		kept = append(kept, normalizeEscapes(param))
+	}
+	return strings.Join(kept, "&")
+}
+
+// isTrackingParam - checks the name of the key=value pair
+func isTrackingParam(param string) bool {
+	name, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+	name = strings.ToLower(name)
+
+	if strings.HasPrefix(name, "utm_") {
+		return true
+	}
+	for _, tracking := range TrackingParams {
+		if name == tracking {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeEscapes - decodes the escaped unreserved characters and uppercases the other escapes (RFC 3986, 6.2.2)
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			c := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(rune(c)) {
+				b.WriteByte(c)
+			} else {
+				b.WriteString("%" + strings.ToUpper(s[i+1:i+3]))
+			}
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
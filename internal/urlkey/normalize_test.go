@@ -0,0 +1,48 @@
+package urlkey
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name          string
+		rawURL        string
+		stripTracking bool
+		want          string
+	}{
+		{name: "Lowercase scheme and host", rawURL: "HTTPS://Example.COM/a", want: "https://example.com/a"},
+		{name: "Keep the case of the path", rawURL: "https://example.com/CaseSensitive", want: "https://example.com/CaseSensitive"},
+		{name: "Drop the default port", rawURL: "https://example.com:443/a", want: "https://example.com/a"},
+		{name: "Keep other ports", rawURL: "http://example.com:8080/a", want: "http://example.com:8080/a"},
+		{name: "Drop the fragment", rawURL: "https://example.com/a#frag", want: "https://example.com/a"},
+		{name: "Add the empty path", rawURL: "https://example.com", want: "https://example.com/"},
+		{name: "IDN to punycode", rawURL: "https://Пример.рф/путь", want: "https://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C"},
+		{name: "Percent-encoding", rawURL: "https://example.com/%7euser/%2fa%2Fb?q=%61%3d", want: "https://example.com/~user/%2Fa%2Fb?q=a%3D"},
+		{name: "IPv6 host", rawURL: "http://[::1]:80/a", want: "http://[::1]/a"},
+		{name: "Keep tracking parameters", rawURL: "https://example.com/a?utm_source=x&id=1", want: "https://example.com/a?utm_source=x&id=1"},
+		{
+			name:          "Strip tracking parameters",
+			rawURL:        "https://example.com/a?UTM_Source=x&id=1&fbclid=abc&utm_medium=y",
+			stripTracking: true,
+			want:          "https://example.com/a?id=1",
+		},
+		{name: "Strip all parameters", rawURL: "https://example.com/a?gclid=1", stripTracking: true, want: "https://example.com/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Normalize(tt.rawURL, tt.stripTracking)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNormalize_Invalid(t *testing.T) {
+	for _, rawURL := range []string{"", "example.com/a", "https://", "https://exa mple.com/"} {
+		_, err := Normalize(rawURL, false)
+		assert.Error(t, err, rawURL)
+	}
+}
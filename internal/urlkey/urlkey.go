@@ -15,18 +15,28 @@ func IsValidURL(u string) (string, bool) {
 	return u, true
 }
 
-// Generate - generates the corresponding key for the stored URL
-func GenerateSlug(originalURL string) string {
-	u := strings.ToLower(strings.TrimSpace(originalURL))
+const (
+	MinAliasLength = 3
+	MaxAliasLength = 64
+)
 
-	if len(u) == 0 {
-		return ""
-	}
+// ReservedAliases - words that collide with the service routes
+var ReservedAliases = []string{"api", "ping"}
 
-	var sum int
-	for i, char := range u {
-		// Multiply ASCII value by position (1-based)
-		sum += int(char) * (i + 1)
+// ValidateAlias - checks a custom alias chosen by the user
+func ValidateAlias(alias string) error {
+	if len(alias) < MinAliasLength || len(alias) > MaxAliasLength {
+		return fmt.Errorf("the alias should be from %d to %d characters long", MinAliasLength, MaxAliasLength)
+	}
+	for _, c := range alias {
+		if !isUnreserved(c) || c == '.' || c == '~' {
+			return fmt.Errorf("the alias may only contain latin letters, digits, '-' and '_'")
+		}
+	}
+	for _, reserved := range ReservedAliases {
+		if strings.EqualFold(alias, reserved) {
+			return fmt.Errorf("the alias %q is reserved", alias)
+		}
 	}
-	return fmt.Sprintf("%x", sum)
+	return nil
 }
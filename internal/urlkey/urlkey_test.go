@@ -2,37 +2,82 @@ package urlkey
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
-func TestGenerateSlug(t *testing.T) {
+func TestHashGenerator(t *testing.T) {
+	g := NewHashGenerator(DefaultLength, Base62Alphabet)
+
+	first, err := g.Generate("http://www.test.com/", 0)
+	require.NoError(t, err)
+	assert.Len(t, first, DefaultLength)
+
+	again, _ := g.Generate("http://www.test.com/", 0)
+	assert.Equal(t, first, again, "The same URL and attempt should give the same key")
+
+	retry, _ := g.Generate("http://www.test.com/", 1)
+	assert.NotEqual(t, first, retry, "A retry should give a different key")
+
+	// The old positional sum gave the same key for these URLs
+	other, _ := g.Generate("http://www.tset.com/", 0)
+	assert.NotEqual(t, first, other)
+
+	_, err = g.Generate("", 0)
+	assert.Error(t, err)
+}
+
+func TestSequenceGenerator(t *testing.T) {
+	g := NewSequenceGenerator(6, Base62Alphabet)
+
+	first, _ := g.Generate("http://www.test.com/", 0)
+	second, _ := g.Generate("http://www.test.com/", 0)
+	assert.Equal(t, "000001", first)
+	assert.Equal(t, "000002", second)
+
+	g.Seed(61)
+	next, _ := g.Generate("http://www.test.com/", 0)
+	assert.Equal(t, "000010", next)
+}
+
+func TestRandomGenerator(t *testing.T) {
+	g := NewRandomGenerator(12, "abc")
+
+	key, err := g.Generate("http://www.test.com/", 0)
+	require.NoError(t, err)
+	assert.Len(t, key, 12)
+	assert.Empty(t, strings.Trim(key, "abc"), "The key should only use the alphabet")
+}
+
+func TestNewKeyGenerator(t *testing.T) {
 	tests := []struct {
-		name string
-		url  string
-		want string
+		name     string
+		strategy string
+		length   int
+		alphabet string
+		wantErr  bool
 	}{
-		{
-			name: "Valid URL with the trailing '/' to compress",
-			url:  "http://www.test.com/",
-			want: "4b23",
-		},
-		{
-			name: "Valid Uppercase and lowercase URL to compress",
-			url:  "http://WWW.Test.COM/",
-			want: "4b23",
-		},
-		{
-			name: "Non-Valid URL",
-			url:  "",
-			want: "",
-		},
+		{name: "Default settings", strategy: "", length: 0, alphabet: ""},
+		{name: "Random strategy", strategy: "random", length: 10, alphabet: Base62Alphabet},
+		{name: "Sequence strategy", strategy: "sequence", length: 4, alphabet: "0123456789"},
+		{name: "Unknown strategy", strategy: "md5", wantErr: true},
+		{name: "Too short", strategy: "hash", length: 2, wantErr: true},
+		{name: "Unsafe alphabet", strategy: "hash", alphabet: "ab/c", wantErr: true},
+		{name: "Duplicated characters", strategy: "hash", alphabet: "abca", wantErr: true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := GenerateSlug(tt.url)
-			t.Logf("Generated Key: %s", got) // Debugging output
-			assert.Equal(t, tt.want, got)
+			g, err := NewKeyGenerator(tt.strategy, tt.length, tt.alphabet)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			key, err := g.Generate("https://practicum.yandex.ru", 0)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, key)
 		})
 	}
 }